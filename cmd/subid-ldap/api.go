@@ -0,0 +1,234 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/treydock/subid-ldap/internal/config"
+	"github.com/treydock/subid-ldap/internal/metrics"
+	"github.com/treydock/subid-ldap/internal/subid"
+	"github.com/treydock/subid-ldap/internal/utils"
+)
+
+const (
+	runHistorySize = 20
+	runTypeRun     = "run"
+	runTypeSync    = "sync"
+)
+
+var (
+	// allocation holds the ranges last written for the query APIs
+	allocation     = &subid.Allocation{}
+	runHistory     []runRecord
+	runHistoryLock sync.Mutex
+)
+
+type runRecord struct {
+	Type     string    `json:"type"`
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration_seconds"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type apiRange struct {
+	Owner string `json:"owner"`
+	Start int    `json:"start"`
+	Count int    `json:"count"`
+}
+
+type apiRanges struct {
+	SubUID []apiRange `json:"subuid"`
+	SubGID []apiRange `json:"subgid"`
+}
+
+// recordRun adds a run to the history and loads the ranges it wrote.
+func recordRun(runType string, start time.Time, c *config.Config, err error, logger *slog.Logger) {
+	record := runRecord{
+		Type:     runType,
+		Start:    start,
+		Duration: time.Since(start).Seconds(),
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	runHistoryLock.Lock()
+	runHistory = append(runHistory, record)
+	if len(runHistory) > runHistorySize {
+		runHistory = runHistory[len(runHistory)-runHistorySize:]
+	}
+	runHistoryLock.Unlock()
+	if err == nil {
+		_ = loadAllocation(c, logger)
+	}
+}
+
+// loadAllocation loads the ranges in the subid files of the first output for the query APIs,
+// the ranges loaded before are kept when the files cannot be read.
+func loadAllocation(c *config.Config, logger *slog.Logger) error {
+	c = c.OutputConfigs()[0]
+	if err := allocation.Load(c.SubUIDPath, c.SubGIDPath, logger); err != nil {
+		metrics.MetricAllocationLoadSuccess.Set(0)
+		return err
+	}
+	metrics.MetricAllocationLoadSuccess.Set(1)
+	return nil
+}
+
+// loadExistingAllocation loads the subid files written before the daemon started so the query
+// APIs answer before the first run completes. Files that do not exist yet are not an error.
+func loadExistingAllocation(c *config.Config, logger *slog.Logger) error {
+	c = c.OutputConfigs()[0]
+	for _, path := range []string{c.SubUIDPath, c.SubGIDPath} {
+		if exists, err := utils.Exists(path); err == nil && !exists {
+			logger.Debug("No subid file to load yet", "path", path)
+			return nil
+		}
+	}
+	return loadAllocation(c, logger)
+}
+
+// apiHandler serves the JSON API under /api/v1/.
+func apiHandler(logger *slog.Logger) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/allocations", func(w http.ResponseWriter, r *http.Request) {
+		if allocation.Loaded().IsZero() {
+			writeAPIError(w, "no allocation has been loaded", http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, http.StatusOK, struct {
+			Updated time.Time `json:"updated"`
+			apiRanges
+		}{allocation.Loaded(), apiRanges{
+			SubUID: toAPIRanges(allocation.Ranges(subid.KindSubUID)),
+			SubGID: toAPIRanges(allocation.Ranges(subid.KindSubGID)),
+		}})
+	})
+	mux.HandleFunc("GET /api/v1/allocations/{user}", func(w http.ResponseWriter, r *http.Request) {
+		user := r.PathValue("user")
+		ranges := apiRanges{
+			SubUID: toAPIRanges(allocation.OwnerRanges(subid.KindSubUID, user)),
+			SubGID: toAPIRanges(allocation.OwnerRanges(subid.KindSubGID, user)),
+		}
+		if len(ranges.SubUID) == 0 && len(ranges.SubGID) == 0 {
+			writeAPIError(w, "user has no subid ranges", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, struct {
+			User string `json:"user"`
+			apiRanges
+		}{user, ranges})
+	})
+	mux.HandleFunc("GET /api/v1/owner/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil || id < 0 {
+			writeAPIError(w, "id must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		ranges := apiRanges{
+			SubUID: toAPIRanges(allocation.Owners(subid.KindSubUID, id)),
+			SubGID: toAPIRanges(allocation.Owners(subid.KindSubGID, id)),
+		}
+		if len(ranges.SubUID) == 0 && len(ranges.SubGID) == 0 {
+			writeAPIError(w, "id is not in any subid range", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, struct {
+			ID int `json:"id"`
+			apiRanges
+		}{id, ranges})
+	})
+	mux.HandleFunc("POST /api/v1/sync", func(w http.ResponseWriter, r *http.Request) {
+		if currentConfig().APIReadOnly {
+			writeAPIError(w, "API is read-only", http.StatusForbidden)
+			return
+		}
+		logger.Info("Run requested through API")
+		writeJSON(w, http.StatusAccepted, struct {
+			Triggered bool `json:"triggered"`
+		}{triggerRun()})
+	})
+	mux.HandleFunc("GET /api/v1/runs", func(w http.ResponseWriter, r *http.Request) {
+		runHistoryLock.Lock()
+		runs := make([]runRecord, 0, len(runHistory))
+		for i := len(runHistory) - 1; i >= 0; i-- {
+			runs = append(runs, runHistory[i])
+		}
+		runHistoryLock.Unlock()
+		writeJSON(w, http.StatusOK, struct {
+			Runs []runRecord `json:"runs"`
+		}{runs})
+	})
+	return apiAuth(mux, logger)
+}
+
+// apiAuth requires the bearer token read from the API token file when one is configured.
+// The file is read for every request so a rotated token is used without a reload.
+func apiAuth(next http.Handler, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := currentConfig().APITokenFile
+		if path == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		content, err := os.ReadFile(path)
+		token := strings.TrimSpace(string(content))
+		if err != nil || token == "" {
+			logger.Error("Unable to read API token file", "path", path, "err", err)
+			writeAPIError(w, "unable to read API token", http.StatusInternalServerError)
+			return
+		}
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAPIError(w, "invalid or missing token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// socketAllowed reports if a query socket peer running as uid is allowed to query.
+func socketAllowed(uid int) bool {
+	return slices.Contains(currentConfig().SocketAllowedUIDs, strconv.Itoa(uid))
+}
+
+func toAPIRanges(entries []subid.SubIDEntry) []apiRange {
+	ranges := make([]apiRange, 0, len(entries))
+	for _, e := range entries {
+		ranges = append(ranges, apiRange{Owner: e.UID, Start: e.ID, Count: e.Count})
+	}
+	return ranges
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, message string, code int) {
+	writeJSON(w, code, struct {
+		Error string `json:"error"`
+	}{message})
+}
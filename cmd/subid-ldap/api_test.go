@@ -0,0 +1,240 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/promslog"
+	"github.com/treydock/subid-ldap/internal/config"
+	"github.com/treydock/subid-ldap/internal/metrics"
+	"github.com/treydock/subid-ldap/internal/subid"
+	"github.com/treydock/subid-ldap/internal/test"
+)
+
+func TestAPI(t *testing.T) {
+	logger := promslog.NewNopLogger()
+	dir := t.TempDir()
+	subuid := filepath.Join(dir, "subuid")
+	subgid := filepath.Join(dir, "subgid")
+	args := append([]string{
+		fmt.Sprintf("--subid.subuid=%s", subuid),
+		fmt.Sprintf("--subid.subgid=%s", subgid),
+		fmt.Sprintf("--ldap.user-filter=%s", test.UserFilter),
+		"--metrics.path=",
+		"--api.token-file=",
+	}, baseArgs...)
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if err := run(context.Background(), logger); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	handler := apiHandler(logger)
+	request := func(method string, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		return w
+	}
+
+	w := request(http.MethodGet, "/api/v1/allocations")
+	if w.Code != http.StatusOK {
+		t.Errorf("Unexpected status, got: %d", w.Code)
+	}
+	var allocations apiRanges
+	if err := json.Unmarshal(w.Body.Bytes(), &allocations); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if len(allocations.SubUID) != 4 || len(allocations.SubGID) != 4 {
+		t.Errorf("Unexpected allocations: %s", w.Body.String())
+	}
+	if allocations.SubUID[0] != (apiRange{Owner: "1000", Start: 65537, Count: 65536}) {
+		t.Errorf("Unexpected first range: %+v", allocations.SubUID[0])
+	}
+
+	w = request(http.MethodGet, "/api/v1/allocations/1001")
+	if w.Code != http.StatusOK {
+		t.Errorf("Unexpected status, got: %d", w.Code)
+	}
+	expected := `{"user":"1001","subuid":[{"owner":"1001","start":131074,"count":65536}],"subgid":[{"owner":"1001","start":131074,"count":65536}]}`
+	if strings.TrimSpace(w.Body.String()) != expected {
+		t.Errorf("Unexpected body\nGot:\n%s\nExpected:\n%s", w.Body.String(), expected)
+	}
+	if w := request(http.MethodGet, "/api/v1/allocations/dne"); w.Code != http.StatusNotFound {
+		t.Errorf("Unexpected status, got: %d", w.Code)
+	}
+
+	w = request(http.MethodGet, "/api/v1/owner/131075")
+	if w.Code != http.StatusOK {
+		t.Errorf("Unexpected status, got: %d", w.Code)
+	}
+	expected = `{"id":131075,"subuid":[{"owner":"1001","start":131074,"count":65536}],"subgid":[{"owner":"1001","start":131074,"count":65536}]}`
+	if strings.TrimSpace(w.Body.String()) != expected {
+		t.Errorf("Unexpected body\nGot:\n%s\nExpected:\n%s", w.Body.String(), expected)
+	}
+	if w := request(http.MethodGet, "/api/v1/owner/100"); w.Code != http.StatusNotFound {
+		t.Errorf("Unexpected status, got: %d", w.Code)
+	}
+	if w := request(http.MethodGet, "/api/v1/owner/foo"); w.Code != http.StatusBadRequest {
+		t.Errorf("Unexpected status, got: %d", w.Code)
+	}
+
+	w = request(http.MethodGet, "/api/v1/runs")
+	var runs struct {
+		Runs []runRecord `json:"runs"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &runs); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if len(runs.Runs) == 0 || runs.Runs[0].Type != runTypeRun || runs.Runs[0].Error != "" {
+		t.Errorf("Unexpected runs: %s", w.Body.String())
+	}
+
+	if w := request(http.MethodGet, "/api/v1/sync"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Unexpected status, got: %d", w.Code)
+	}
+	w = request(http.MethodPost, "/api/v1/sync")
+	if w.Code != http.StatusAccepted {
+		t.Errorf("Unexpected status, got: %d", w.Code)
+	}
+	if strings.TrimSpace(w.Body.String()) != `{"triggered":true}` {
+		t.Errorf("Unexpected body: %s", w.Body.String())
+	}
+	<-runTrigger
+
+	if _, err := kingpin.CommandLine.Parse(append(args, "--api.read-only")); err != nil {
+		t.Fatal(err)
+	}
+	if w := request(http.MethodPost, "/api/v1/sync"); w.Code != http.StatusForbidden {
+		t.Errorf("Unexpected status, got: %d", w.Code)
+	}
+	if w := request(http.MethodGet, "/api/v1/runs"); w.Code != http.StatusOK {
+		t.Errorf("Unexpected status, got: %d", w.Code)
+	}
+}
+
+func TestLoadExistingAllocation(t *testing.T) {
+	logger := promslog.NewNopLogger()
+	defer func(a *subid.Allocation) { allocation = a }(allocation)
+	allocation = &subid.Allocation{}
+	dir := t.TempDir()
+	c := &config.Config{SubUIDPath: filepath.Join(dir, "subuid"), SubGIDPath: filepath.Join(dir, "subgid")}
+	// Nothing is loaded before the first run writes the files
+	if err := loadExistingAllocation(c, logger); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if !allocation.Loaded().IsZero() {
+		t.Errorf("Expected no allocation to be loaded")
+	}
+	for _, path := range []string{c.SubUIDPath, c.SubGIDPath} {
+		if err := os.WriteFile(path, []byte("1000:65537:65536\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := loadExistingAllocation(c, logger); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if ranges := allocation.OwnerRanges(subid.KindSubUID, "1000"); len(ranges) != 1 {
+		t.Errorf("Unexpected ranges, got: %+v", ranges)
+	}
+	if val := testutil.ToFloat64(metrics.MetricAllocationLoadSuccess); val != 1 {
+		t.Errorf("Unexpected load success, got: %v", val)
+	}
+	// A file that cannot be read keeps the ranges loaded before
+	if err := os.Remove(c.SubGIDPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(c.SubGIDPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadExistingAllocation(c, logger); err == nil {
+		t.Errorf("Expected error loading a directory")
+	}
+	if val := testutil.ToFloat64(metrics.MetricAllocationLoadSuccess); val != 0 {
+		t.Errorf("Unexpected load success, got: %v", val)
+	}
+	if ranges := allocation.OwnerRanges(subid.KindSubUID, "1000"); len(ranges) != 1 {
+		t.Errorf("Expected ranges to be kept, got: %+v", ranges)
+	}
+}
+
+func TestAPIAuth(t *testing.T) {
+	logger := promslog.NewNopLogger()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	args := append([]string{"--api.token-file=" + tokenFile, "--metrics.path="}, baseArgs...)
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if _, err := kingpin.CommandLine.Parse(append([]string{"--api.token-file="}, baseArgs...)); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	handler := apiHandler(logger)
+	tests := map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"secret":        http.StatusUnauthorized,
+		"Bearer secret": http.StatusOK,
+	}
+	for authorization, code := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/runs", nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != code {
+			t.Errorf("Unexpected status with %q, got: %d", authorization, w.Code)
+		}
+	}
+	if err := os.Remove(tokenFile); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/runs", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Unexpected status, got: %d", w.Code)
+	}
+}
+
+func TestSocketAllowed(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse(append([]string{"--socket.allowed-uids=0, 1000"}, baseArgs...)); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if _, err := kingpin.CommandLine.Parse(baseArgs); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	for uid, want := range map[int]bool{0: true, 1000: true, 1001: false} {
+		if got := socketAllowed(uid); got != want {
+			t.Errorf("Unexpected socketAllowed for %d, got %t", uid, got)
+		}
+	}
+}
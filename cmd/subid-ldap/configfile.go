@@ -0,0 +1,66 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/treydock/subid-ldap/internal/config"
+)
+
+// configFileLists holds the searches, pools and outputs of the configuration file, which
+// have no flags, nil when no configuration file is used.
+var configFileLists *config.File
+
+// loadConfigFile applies the settings of the configuration file to the flags that were
+// not given on the command line or set by their environment variable, so the precedence
+// is command line, environment, configuration file then the flag default.
+func loadConfigFile(args []string) error {
+	configFileLists = nil
+	if *configFile == "" {
+		return nil
+	}
+	file, err := config.LoadFile(*configFile)
+	if err != nil {
+		return fmt.Errorf("unable to load configuration file %s: %w", *configFile, err)
+	}
+	context, err := kingpin.CommandLine.ParseContext(args)
+	if err != nil {
+		return err
+	}
+	cli := make(map[string]bool)
+	for _, element := range context.Elements {
+		if clause, ok := element.Clause.(*kingpin.FlagClause); ok {
+			cli[clause.Model().Name] = true
+		}
+	}
+	for _, value := range file.Values() {
+		clause := kingpin.CommandLine.GetFlag(value.Flag)
+		if clause == nil {
+			return fmt.Errorf("configuration file setting %s has no flag", value)
+		}
+		model := clause.Model()
+		if cli[model.Name] || (model.Envar != "" && os.Getenv(model.Envar) != "") {
+			continue
+		}
+		for _, v := range value.Values {
+			if err := model.Value.Set(v); err != nil {
+				return fmt.Errorf("invalid configuration file setting %s: %w", value, err)
+			}
+		}
+	}
+	configFileLists = &config.File{Searches: file.Searches, Pools: file.Pools, Outputs: file.Outputs}
+	return nil
+}
@@ -0,0 +1,223 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/common/promslog"
+	"github.com/treydock/subid-ldap/internal/config"
+	"github.com/treydock/subid-ldap/internal/test"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	content := `
+ldap:
+  user:
+    filter: (uid=file)
+    uid_attr: fileUID
+  search:
+    size_limit: 10
+subid:
+  start: 1000
+`
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	t.Setenv("LDAP_USER_FILTER", "(uid=env)")
+	args := []string{"--config.file=" + path, "--ldap.user-uid-attr=cliUID"}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfigFile(args); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if *ldapUserUIDAttr != "cliUID" {
+		t.Errorf("Expected command line to take precedence, got: %s", *ldapUserUIDAttr)
+	}
+	if *ldapUserFilter != "(uid=env)" {
+		t.Errorf("Expected environment to take precedence, got: %s", *ldapUserFilter)
+	}
+	if *ldapSizeLimit != 10 || *subIDStart != 1000 {
+		t.Errorf("Unexpected values from file, size limit: %d start: %d", *ldapSizeLimit, *subIDStart)
+	}
+
+	if err := os.WriteFile(path, []byte("subid:\n  start: abc\n"), 0644); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	err := loadConfigFile(args)
+	if err == nil || !strings.Contains(err.Error(), "subid.start") {
+		t.Errorf("Expected error about invalid start, got: %v", err)
+	}
+	if err := os.WriteFile(path, []byte("subid:\n  begin: 1000\n"), 0644); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	err = loadConfigFile(args)
+	if err == nil || !strings.Contains(err.Error(), "field begin not found") {
+		t.Errorf("Expected error about unknown key, got: %v", err)
+	}
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadConfigFileKeepAlive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("ldap:\n  connection:\n    keepalive: 90s\n"), 0644); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer func() {
+		if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	args := []string{"--config.file=" + path}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfigFile(args); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if keepAlive := getConfig().LdapKeepAlive; keepAlive != 90*time.Second {
+		t.Errorf("Unexpected keepalive from file, got: %s", keepAlive)
+	}
+	args = []string{"--ldap.keepalive=45s"}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if keepAlive := getConfig().LdapKeepAlive; keepAlive != 45*time.Second {
+		t.Errorf("Unexpected keepalive from flag, got: %s", keepAlive)
+	}
+}
+
+func TestRunConfigFileLists(t *testing.T) {
+	dir := t.TempDir()
+	content := fmt.Sprintf(`
+searches:
+  - base_dn: %s
+  - base_dn: %s
+    scope: one
+pools:
+  - name: high
+    start: 1000000
+    range: 1000
+outputs:
+  - subuid: %s
+    subgid: %s
+  - subuid: %s
+    subgid: %s
+    pool: high
+`, test.UserBaseDN, test.WritebackBaseDN,
+		filepath.Join(dir, "subuid"), filepath.Join(dir, "subgid"),
+		filepath.Join(dir, "high-subuid"), filepath.Join(dir, "high-subgid"))
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer func() {
+		configFileLists = nil
+		if _, err := kingpin.CommandLine.Parse(baseArgs); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	args := append([]string{"--config.file=" + path, fmt.Sprintf("--ldap.user-filter=%s", test.UserFilter)}, baseArgs...)
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfigFile(args); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	c := getConfig()
+	if len(c.Searches) != 2 || len(c.Pools) != 1 || len(c.Outputs) != 2 {
+		t.Fatalf("Unexpected lists from file, searches: %v pools: %v outputs: %v", c.Searches, c.Pools, c.Outputs)
+	}
+	if err := validateConfig(c, promslog.NewNopLogger()); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := run(context.Background(), promslog.NewNopLogger()); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := map[string]string{
+		"subid": `# Managed by subid-ldap: start=65537 range=65536
+1000:65537:65536
+1001:131074:65536
+1002:196611:65536
+1003:262148:65536
+20000:327685:65536
+20001:393222:65536
+20002:458759:65536`,
+		"high-subid": `# Managed by subid-ldap: start=1000000 range=1000
+1000:1000000:1000
+1001:1001001:1000
+1002:1002002:1000
+1003:1003003:1000
+20000:1004004:1000
+20001:1005005:1000
+20002:1006006:1000`,
+	}
+	for prefix, want := range expected {
+		for _, name := range []string{"uid", "gid"} {
+			file := filepath.Join(dir, strings.Replace(prefix, "subid", "sub"+name, 1))
+			got, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if string(got) != want {
+				t.Errorf("Unexpected %s content:\nGot:\n%s\nExpected:\n%s", file, string(got), want)
+			}
+		}
+	}
+}
+
+func TestValidateLists(t *testing.T) {
+	c := getConfig()
+	c.Searches = []config.Search{{}, {BaseDN: test.UserBaseDN, Scope: "tree"}}
+	c.SubIDOwnerAttr = "ipaOwner"
+	c.SubIDBaseDN = ""
+	c.Pools = []config.Pool{{Name: "a", Start: 1, Range: 1}, {Name: "a"}, {Name: "unused", Start: 1, Range: 1}}
+	c.Outputs = []config.Output{
+		{SubUID: "/tmp/subuid", SubGID: "/tmp/subgid", Pool: "a"},
+		{SubUID: "/tmp/subuid", Pool: "missing"},
+	}
+	errs := strings.Join(validateLists(c), "\n")
+	for _, want := range []string{
+		"Search 1 requires a base DN",
+		"Search 2: ",
+		"subid-ldap-base-dn",
+		"Pool 2 requires a unique name",
+		"Pool a requires a start and range",
+		"Output 2 requires a subuid and subgid file",
+		"File /tmp/subuid is used by more than one output",
+		"Output 2 uses unknown pool missing",
+		"Pool unused is not used by an output",
+	} {
+		if !strings.Contains(errs, want) {
+			t.Errorf("Expected error %q, got:\n%s", want, errs)
+		}
+	}
+	c = getConfig()
+	c.Searches = []config.Search{{BaseDN: test.UserBaseDN}, {BaseDN: test.WritebackBaseDN, Scope: "one"}}
+	c.Pools = []config.Pool{{Name: "a", Start: 1, Range: 1}}
+	c.Outputs = []config.Output{{SubUID: "/tmp/subuid", SubGID: "/tmp/subgid", Pool: "a"}}
+	if errs := validateLists(c); len(errs) != 0 {
+		t.Errorf("Unexpected errors: %v", errs)
+	}
+}
@@ -14,44 +14,136 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	kingpin "github.com/alecthomas/kingpin/v2"
+	ldap "github.com/go-ldap/ldap/v3"
 	"github.com/prometheus/common/promslog"
 	"github.com/prometheus/common/promslog/flag"
 	"github.com/prometheus/common/version"
+	"github.com/treydock/subid-ldap/internal/cache"
 	"github.com/treydock/subid-ldap/internal/config"
+	"github.com/treydock/subid-ldap/internal/filter"
 	localldap "github.com/treydock/subid-ldap/internal/ldap"
 	"github.com/treydock/subid-ldap/internal/metrics"
+	"github.com/treydock/subid-ldap/internal/socket"
+	"github.com/treydock/subid-ldap/internal/source"
 	"github.com/treydock/subid-ldap/internal/subid"
+	"github.com/treydock/subid-ldap/internal/transform"
 	"github.com/treydock/subid-ldap/internal/utils"
 )
 
 var (
+	_                    = kingpin.Command("run", "Update the subid files, the default command").Default()
+	checkConfigCmd       = kingpin.Command("check-config", "Validate the configuration and exit")
+	configFile           = kingpin.Flag("config.file", "Path to YAML configuration file, flags and environment variables take precedence").Default("").Envar("CONFIG_FILE").String()
 	subUIDPath           = kingpin.Flag("subid.subuid", "Path to subuid file").Default(subid.SubUIDPath).Envar("SUBID_SUBUID").String()
 	subGIDPath           = kingpin.Flag("subid.subgid", "Path to subgid file").Default(subid.SubGIDPath).Envar("SUBID_SUBGID").String()
 	subIDStart           = kingpin.Flag("subid.start", "Start ID of subuid/subgid").Default("65537").Envar("SUBID_START").Int()
 	subIDRange           = kingpin.Flag("subid.range", "Range for each entry").Default("65536").Envar("SUBID_RANGE").Int()
-	ldapURL              = kingpin.Flag("ldap.url", "LDAP URL").Required().Envar("LDAP_URL").String()
+	subIDSource          = kingpin.Flag("subid.source", "Allocate subid ranges or read the ranges assigned in LDAP (allocate, ldap)").Default(subid.SourceAllocate).Envar("SUBID_SOURCE").Enum(subid.Sources...)
+	subIDLDAPBaseDN      = kingpin.Flag("subid.ldap-base-dn", "LDAP Base DN of subid entries when using an owner attribute, defaults to the user Base DN").Envar("SUBID_LDAP_BASE_DN").String()
+	subIDLDAPFilter      = kingpin.Flag("subid.ldap-filter", "LDAP filter of subid entries when using an owner attribute").Default(localldap.SubIDFilter).Envar("SUBID_LDAP_FILTER").String()
+	subIDLDAPOwnerAttr   = kingpin.Flag("subid.ldap-owner-attr", "Attribute of subid entries holding the user DN, ranges are read from user entries when empty").Envar("SUBID_LDAP_OWNER_ATTR").String()
+	subUIDStartAttr      = kingpin.Flag("subid.ldap-subuid-start-attr", "LDAP attribute holding the start of the subuid range").Default(localldap.SubUIDStartAttr).Envar("SUBID_LDAP_SUBUID_START_ATTR").String()
+	subUIDCountAttr      = kingpin.Flag("subid.ldap-subuid-count-attr", "LDAP attribute holding the size of the subuid range").Default(localldap.SubUIDCountAttr).Envar("SUBID_LDAP_SUBUID_COUNT_ATTR").String()
+	subGIDStartAttr      = kingpin.Flag("subid.ldap-subgid-start-attr", "LDAP attribute holding the start of the subgid range").Default(localldap.SubGIDStartAttr).Envar("SUBID_LDAP_SUBGID_START_ATTR").String()
+	subGIDCountAttr      = kingpin.Flag("subid.ldap-subgid-count-attr", "LDAP attribute holding the size of the subgid range").Default(localldap.SubGIDCountAttr).Envar("SUBID_LDAP_SUBGID_COUNT_ATTR").String()
+	subIDLDAPAllocate    = kingpin.Flag("subid.ldap-allocate", "Allocate ranges for users without one and write them to the user entry in LDAP").Default("false").Envar("SUBID_LDAP_ALLOCATE").Bool()
+	subIDLedgerDN        = kingpin.Flag("subid.ldap-ledger-dn", "DN of the LDAP entry holding the next free subid when allocating ranges in LDAP").Envar("SUBID_LDAP_LEDGER_DN").String()
+	subIDLedgerAttr      = kingpin.Flag("subid.ldap-ledger-attr", "Attribute of the ledger entry holding the next free subid").Default(localldap.LedgerAttr).Envar("SUBID_LDAP_LEDGER_ATTR").String()
+	subIDOverlapCheck    = kingpin.Flag("subid.overlap-check", "Check the subid pool against the highest UID and GID in LDAP (off, warn, error, auto)").Default(subid.OverlapOff).Envar("SUBID_OVERLAP_CHECK").Enum(subid.OverlapModes...)
+	subIDOverlapBaseDN   = kingpin.Flag("subid.overlap-base-dn", "LDAP Base DN searched for the highest UID and GID, defaults to the user Base DN").Envar("SUBID_OVERLAP_BASE_DN").String()
+	subIDOverlapHeadroom = kingpin.Flag("subid.overlap-headroom", "IDs left free above the highest UID and GID when the subid pool is placed automatically").Default("100000").Envar("SUBID_OVERLAP_HEADROOM").Int()
+	subIDStartAlign      = kingpin.Flag("subid.start-align", "Alignment of the subid pool start when placed automatically").Default("65536").Envar("SUBID_START_ALIGN").Int()
+	userSources          = kingpin.Flag("source", "Comma separated sources of users (ldap, ldif, passwd, json, csv, scim)").Default(source.LDAP).Envar("SOURCE").String()
+	sourceCombine        = kingpin.Flag("source.combine", "How users of multiple sources are combined (union, intersection)").Default(source.CombineUnion).Envar("SOURCE_COMBINE").Enum(source.CombineModes...)
+	ldifFile             = kingpin.Flag("ldif.file", "LDIF export searched when the source is ldif").Envar("LDIF_FILE").String()
+	passwdFile           = kingpin.Flag("passwd.file", "File in passwd format read when the source is passwd").Envar("PASSWD_FILE").String()
+	jsonFile             = kingpin.Flag("json.file", "JSON file read when the source is json").Envar("JSON_FILE").String()
+	csvFile              = kingpin.Flag("csv.file", "CSV file read when the source is csv").Envar("CSV_FILE").String()
+	scimURL              = kingpin.Flag("scim.url", "Base URL of the SCIM 2.0 service read when the source is scim, example: https://idp.example.com/scim/v2").Envar("SCIM_URL").String()
+	scimToken            = kingpin.Flag("scim.token", "Bearer token for the SCIM service").Envar("SCIM_TOKEN").String()
+	scimTokenFile        = kingpin.Flag("scim.token-file", "Path to file containing the bearer token for the SCIM service").Envar("SCIM_TOKEN_FILE").String()
+	scimKeyAttr          = kingpin.Flag("scim.key-attr", "SCIM attribute used as the subid key").Default(source.SCIMKeyAttr).Envar("SCIM_KEY_ATTR").String()
+	scimPageSize         = kingpin.Flag("scim.page-size", "Number of SCIM users requested per page").Default(strconv.Itoa(source.SCIMPageSize)).Envar("SCIM_PAGE_SIZE").Int()
+	scimTimeout          = kingpin.Flag("scim.timeout", "Timeout of each SCIM request").Default("30s").Envar("SCIM_TIMEOUT").Duration()
+	cachePath            = kingpin.Flag("cache.path", "Path to cache of the last successful user list used when the source is unavailable, disabled when empty").Envar("CACHE_PATH").String()
+	cacheMaxAge          = kingpin.Flag("cache.max-age", "Maximum age of the user cache, 0 for no limit").Default("168h").Envar("CACHE_MAX_AGE").Duration()
+	ldapURL              = kingpin.Flag("ldap.url", "LDAP URL, required when the source is ldap").Envar("LDAP_URL").String()
 	ldapTLS              = kingpin.Flag("ldap.tls", "Enable TLS connection to LDAP server").Default("false").Envar("LDAP_TLS").Bool()
 	ldapTLSVerify        = kingpin.Flag("ldap.tls-verify", "Verify TLS certificate with LDAP server").Default("true").Envar("LDAP_TLS_VERIFY").Bool()
 	ldapTLSCACert        = kingpin.Flag("ldap.tls-ca-cert", "TLS CA Cert for LDAP server").Envar("LDAP_TLS_CA_CERT").String()
-	ldapUserBaseDN       = kingpin.Flag("ldap.user-base-dn", "LDAP User Base DN").Required().Envar("LDAP_USER_BASE_DN").String()
+	ldapTLSCAFile        = kingpin.Flag("ldap.tls-ca-file", "Path to TLS CA Cert file for LDAP server, extends system CAs").Envar("LDAP_TLS_CA_FILE").String()
+	ldapTLSCADir         = kingpin.Flag("ldap.tls-ca-dir", "Path to directory of TLS CA Cert files for LDAP server, extends system CAs").Envar("LDAP_TLS_CA_DIR").String()
+	ldapTLSMinVersion    = kingpin.Flag("ldap.tls-min-version", "Minimum TLS version for LDAP server (1.0, 1.1, 1.2, 1.3)").Default("1.2").Envar("LDAP_TLS_MIN_VERSION").Enum("1.0", "1.1", "1.2", "1.3")
+	ldapTLSCipherSuites  = kingpin.Flag("ldap.tls-cipher-suites", "Comma separated list of allowed TLS cipher suites for LDAP server").Envar("LDAP_TLS_CIPHER_SUITES").String()
+	ldapTLSServerName    = kingpin.Flag("ldap.tls-server-name", "Server name used for SNI and certificate verification of LDAP server").Envar("LDAP_TLS_SERVER_NAME").String()
+	ldapTLSPinSHA256     = kingpin.Flag("ldap.tls-pin-sha256", "Comma separated list of base64 SHA-256 hashes of the LDAP server certificate SPKI").Envar("LDAP_TLS_PIN_SHA256").String()
+	ldapUserBaseDN       = kingpin.Flag("ldap.user-base-dn", "LDAP User Base DN, required when the source is ldap").Envar("LDAP_USER_BASE_DN").String()
 	ldapUserFilter       = kingpin.Flag("ldap.user-filter", "LDAP user filter").Default("(objectClass=posixAccount)").Envar("LDAP_USER_FILTER").String()
 	ldapUserUIDAttr      = kingpin.Flag("ldap.user-uid-attr", "LDAP user UID attribute").Default("uidNumber").Envar("LDAP_USER_UID_ATTR").String()
+	ldapUserKeyMode      = kingpin.Flag("ldap.user-key-mode", "How the subid key of users is determined, the UID attribute or the UID SSSD maps from objectSid (attribute, objectsid)").Default(localldap.UserKeyAttribute).Envar("LDAP_USER_KEY_MODE").Enum(localldap.UserKeyModes...)
+	ldapUserKeyTransform = kingpin.Flag("ldap.user-key-transform", "Transform applied to the user key, repeat for a pipeline (lowercase, strip-realm, regex:/pattern/replacement/, template:{{.attr}})").Envar("LDAP_USER_KEY_TRANSFORM").Strings()
+	ldapSIDRangeMin      = kingpin.Flag("ldap.idmap-range-min", "SSSD ldap_idmap_range_min used to map objectSid to UID").Default(strconv.Itoa(localldap.SIDRangeMin)).Envar("LDAP_IDMAP_RANGE_MIN").Int()
+	ldapSIDRangeMax      = kingpin.Flag("ldap.idmap-range-max", "SSSD ldap_idmap_range_max used to map objectSid to UID").Default(strconv.Itoa(localldap.SIDRangeMax)).Envar("LDAP_IDMAP_RANGE_MAX").Int()
+	ldapSIDRangeSize     = kingpin.Flag("ldap.idmap-range-size", "SSSD ldap_idmap_range_size used to map objectSid to UID").Default(strconv.Itoa(localldap.SIDRangeSize)).Envar("LDAP_IDMAP_RANGE_SIZE").Int()
+	ldapSIDDefaultDomain = kingpin.Flag("ldap.idmap-default-domain-sid", "SSSD ldap_idmap_default_domain_sid, the domain assigned the first slice").Envar("LDAP_IDMAP_DEFAULT_DOMAIN_SID").String()
+	ldapSIDAutorid       = kingpin.Flag("ldap.idmap-autorid-compat", "SSSD ldap_idmap_autorid_compat, the domain is assigned the first slice").Default("false").Envar("LDAP_IDMAP_AUTORID_COMPAT").Bool()
+	ldapUserScope        = kingpin.Flag("ldap.user-scope", "LDAP user search scope (base, one, sub)").Default(localldap.ScopeSub).Envar("LDAP_USER_SCOPE").Enum(localldap.SearchScopes...)
+	ldapUserDeref        = kingpin.Flag("ldap.user-deref", "LDAP user search alias dereferencing (never, search, find, always)").Default(localldap.DerefNever).Envar("LDAP_USER_DEREF").Enum(localldap.DerefAliases...)
+	ldapSizeLimit        = kingpin.Flag("ldap.size-limit", "Maximum number of entries returned by the user search, 0 is unlimited").Default("0").Envar("LDAP_SIZE_LIMIT").Int()
+	ldapTimeLimit        = kingpin.Flag("ldap.time-limit", "Maximum duration of the user search, 0 is unlimited").Default("0s").Envar("LDAP_TIME_LIMIT").Duration()
+	ldapSort             = kingpin.Flag("ldap.sort", "Attribute used to request server-side sorting of the user search, prefix with - to reverse").Envar("LDAP_SORT").String()
+	ldapMinUID           = kingpin.Flag("ldap.min-uid", "Exclude users with a UID below this value, 0 disables").Default("0").Envar("LDAP_MIN_UID").Int()
+	ldapMaxUID           = kingpin.Flag("ldap.max-uid", "Exclude users with a UID above this value, 0 disables").Default("0").Envar("LDAP_MAX_UID").Int()
+	ldapIncludeUsersFile = kingpin.Flag("ldap.include-users-file", "Path to file listing users to include even when outside the UID range, one per line").Envar("LDAP_INCLUDE_USERS_FILE").String()
+	ldapExcludeUsersFile = kingpin.Flag("ldap.exclude-users-file", "Path to file listing users to exclude, one per line").Envar("LDAP_EXCLUDE_USERS_FILE").String()
+	ldapAccountState     = kingpin.Flag("ldap.account-state", "How to handle disabled, locked and expired accounts (off, exclude, grace)").Default(localldap.AccountStateOff).Envar("LDAP_ACCOUNT_STATE").Enum(localldap.AccountStateModes...)
+	ldapAccountGrace     = kingpin.Flag("ldap.account-state-grace", "How long inactive accounts keep their subids when account state is grace").Default("168h").Envar("LDAP_ACCOUNT_STATE_GRACE").Duration()
+	ldapAccountStateFile = kingpin.Flag("ldap.account-state-file", "Path to file recording when accounts were first seen inactive, kept in memory only when empty").Envar("LDAP_ACCOUNT_STATE_FILE").String()
+	ldapIncremental      = kingpin.Flag("ldap.incremental", "Only search for users changed since the last daemon run using the modification attribute (off, auto, modifyTimestamp, uSNChanged)").Default(localldap.IncrementalOff).Envar("LDAP_INCREMENTAL").Enum(localldap.IncrementalModes...)
+	ldapIncrementalFull  = kingpin.Flag("ldap.incremental-full-interval", "How often incremental mode runs a full search to catch deleted users").Default("24h").Envar("LDAP_INCREMENTAL_FULL_INTERVAL").Duration()
 	ldapBindDN           = kingpin.Flag("ldap.bind-dn", "LDAP Bind DN").Envar("LDAP_BIND_DN").String()
 	ldapBindPassword     = kingpin.Flag("ldap.bind-password", "LDAP Bind Password").Envar("LDAP_BIND_PASSWORD").String()
+	ldapBindPasswordFile = kingpin.Flag("ldap.bind-password-file", "Path to file containing LDAP Bind Password").Envar("LDAP_BIND_PASSWORD_FILE").String()
+	ldapBindPasswordCred = kingpin.Flag("ldap.bind-password-credential", "Name of systemd credential in $CREDENTIALS_DIRECTORY containing LDAP Bind Password").Envar("LDAP_BIND_PASSWORD_CREDENTIAL").String()
+	ldapBindPasswordCmd  = kingpin.Flag("ldap.bind-password-command", "Shell command that prints LDAP Bind Password, run with /bin/sh -c and re-run when bind fails").Envar("LDAP_BIND_PASSWORD_COMMAND").String()
+	ldapPersistent       = kingpin.Flag("ldap.persistent", "Keep the LDAP connection open between runs in daemon mode").Default("true").Envar("LDAP_PERSISTENT").Bool()
+	ldapKeepAlive        = kingpin.Flag("ldap.keepalive", "TCP keepalive interval for LDAP connections").Default("30s").Envar("LDAP_KEEPALIVE").Duration()
+	ldapIdleTimeout      = kingpin.Flag("ldap.idle-timeout", "Close a persistent LDAP connection after being idle this long, 0 disables").Default("15m").Envar("LDAP_IDLE_TIMEOUT").Duration()
+	ldapAutoDetect       = kingpin.Flag("ldap.auto-detect", "Detect LDAP server from RootDSE and enable paged searches when supported").Default("true").Envar("LDAP_AUTO_DETECT").Bool()
 	ldapPagedSearch      = kingpin.Flag("ldap.paged-search", "Enable LDAP paged searching").Default("false").Envar("LDAP_PAGED_SEARCH").Bool()
 	ldapPagedSearchSize  = kingpin.Flag("ldap.paged-search-size", "LDAP paged search size").Default("1000").Envar("LDAP_PAGED_SEARCH_SIZE").Int()
+	runTimeout           = kingpin.Flag("run.timeout", "Maximum duration of reading users for a run, writes are always completed, 0 disables").Default("0s").Envar("RUN_TIMEOUT").Duration()
 	daemon               = kingpin.Flag("daemon", "Run application as a daemon").Default("false").Envar("DAEMON").Bool()
 	daemonUpdateInterval = kingpin.Flag("daemon.update-interval", "How often to update in daemon mode").Default("5m").Envar("DAEMON_UPDATE_INTERVAL").Duration()
+	daemonSync           = kingpin.Flag("daemon.sync", "Receive LDAP changes as they happen in daemon mode (none, auto, syncrepl, psearch)").Default(localldap.SyncModeNone).Envar("DAEMON_SYNC").Enum(localldap.SyncModeNone, localldap.SyncModeAuto, localldap.SyncModeSyncrepl, localldap.SyncModePersistentSearch)
+	daemonSyncDelay      = kingpin.Flag("daemon.sync-delay", "How long to wait for more LDAP changes before updating subids").Default("2s").Envar("DAEMON_SYNC_DELAY").Duration()
+	apiTokenFile         = kingpin.Flag("api.token-file", "Path to file containing the bearer token required by the HTTP API, no token is required when empty").Envar("API_TOKEN_FILE").String()
+	apiReadOnly          = kingpin.Flag("api.read-only", "Only allow HTTP API requests that do not start runs").Default("false").Envar("API_READ_ONLY").Bool()
+	socketPath           = kingpin.Flag("socket.path", "Path of the Unix socket answering subid queries in daemon mode, disabled when empty").Envar("SOCKET_PATH").String()
+	socketAllowedUIDs    = kingpin.Flag("socket.allowed-uids", "Comma separated UIDs allowed to query the subid socket").Default("0").Envar("SOCKET_ALLOWED_UIDS").String()
 	listenAddress        = kingpin.Flag("metrics.listen-address", "Address to listen on for daemon metrics").Default(":8085").Envar("METRICS_LISTEN_ADDRESS").String()
 	metricsPath          = kingpin.Flag("metrics.path", "Path to save Prometheus metrics when not daemon").Default("").Envar("METRICS_PATH").String()
+	ldapClient           = &localldap.Client{}
+	// runTrigger starts a daemon run before the update interval has passed
+	runTrigger = make(chan struct{}, 1)
+	runLock    sync.Mutex
+	// poolStarts are the subid pool starts chosen by the last run for each subuid file, guarded by runLock
+	poolStarts = make(map[string]int)
 )
 
 func main() {
@@ -59,11 +151,22 @@ func main() {
 	flag.AddFlags(kingpin.CommandLine, promslogConfig)
 	kingpin.Version(version.Print(config.AppName))
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+	command := kingpin.Parse()
+	if err := loadConfigFile(os.Args[1:]); err != nil {
+		kingpin.Fatalf("%s", err)
+	}
 
 	logger := promslog.New(promslogConfig)
 
-	err := validateArgs(logger)
+	c := getConfig()
+	err := validateConfig(c, logger)
+	if command == checkConfigCmd.FullCommand() {
+		if err != nil {
+			os.Exit(1)
+		}
+		fmt.Println("Configuration is valid")
+		os.Exit(0)
+	}
 	if err != nil {
 		os.Exit(1)
 	}
@@ -71,64 +174,272 @@ func main() {
 	logger.Info(fmt.Sprintf("Starting %s", config.AppName), "version", version.Info())
 	logger.Info("Build context", "build_context", version.BuildContext())
 
-	if *daemon {
+	// SIGTERM and interrupts stop the daemon between runs rather than during a write
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	// Settings read by the daemon loop outside of runs are fixed at start so a reload cannot change them
+	daemonMode, updateInterval := c.Daemon, c.DaemonUpdateInterval
+	if daemonMode {
+		restartSettings = daemonSettings(c)
+		activeConfig.Store(c)
+		_ = loadExistingAllocation(c, logger)
+		ldapClient.Persistent = c.LdapPersistent
+		ldapClient.IdleTimeout = c.LdapIdleTimeout
+		http.Handle("/-/reload", reloadHandler(logger))
+		http.Handle("/api/v1/", apiHandler(logger))
 		go func() {
-			if err := metrics.MetricsServer(*listenAddress); err != nil {
+			if err := metrics.MetricsServer(c.ListenAddress); err != nil {
 				logger.Error("Error starting HTTP server", "err", err)
 				os.Exit(1)
 			}
 		}()
+		if c.SocketPath != "" {
+			l, err := socket.Listen(c.SocketPath)
+			if err != nil {
+				logger.Error("Error listening on query socket", "path", c.SocketPath, "err", err)
+				os.Exit(1)
+			}
+			defer l.Close()
+			server := &socket.Server{Allocation: allocation, Allowed: socketAllowed, Logger: logger.With("socket", c.SocketPath)}
+			go func() {
+				if err := server.Serve(l); err != nil {
+					logger.Error("Error serving query socket", "path", c.SocketPath, "err", err)
+					os.Exit(1)
+				}
+			}()
+		}
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				_ = reload(os.Args[1:], logger)
+			}
+		}()
+		usr1 := make(chan os.Signal, 1)
+		signal.Notify(usr1, syscall.SIGUSR1)
+		go func() {
+			for range usr1 {
+				logger.Info("Received SIGUSR1, starting a run")
+				triggerRun()
+			}
+		}()
+		if c.DaemonSync != localldap.SyncModeNone {
+			go syncLoop(ctx, c.DaemonSync, c.DaemonSyncDelay, logger)
+		}
 	}
 
 	for {
 		var exitCode int
-		err = run(logger)
+		err = run(ctx, logger)
 		if err != nil {
 			logger.Error(err.Error())
 		}
-		if *daemon {
-			time.Sleep(*daemonUpdateInterval)
-		} else {
+		if !daemonMode {
 			os.Exit(exitCode)
 		}
+		timer := time.NewTimer(updateInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			// Restore the default signal handling so a second signal exits immediately
+			stop()
+			logger.Info("Shutting down")
+			// Wait for any update applying LDAP sync changes to finish writing
+			runLock.Lock()
+			return
+		case <-runTrigger:
+			timer.Stop()
+		case <-timer.C:
+		}
 	}
 }
 
-func run(logger *slog.Logger) error {
+// triggerRun starts a daemon run without waiting for the update interval. A run already
+// pending is not queued again.
+func triggerRun() bool {
+	select {
+	case runTrigger <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// run updates the subid files once. The users are read within the run timeout and once
+// ctx is cancelled no files are written, but writes that have started are always completed.
+func run(ctx context.Context, logger *slog.Logger) error {
 	var err error
+	runLock.Lock()
+	defer runLock.Unlock()
 	metrics.MetricLastRun.Set(float64(time.Now().Unix()))
-	if !*daemon && *metricsPath != "" {
-		defer metrics.MetricsWrite(*metricsPath, metrics.MetricGathers(false), logger)
+	c := currentConfig()
+	if !c.Daemon && c.MetricsPath != "" {
+		defer metrics.MetricsWrite(c.MetricsPath, metrics.MetricGathers(false), logger)
 	}
 	defer metrics.Duration()()
 	defer metrics.Error()(&err)
-	c := &config.Config{
-		LdapURL:         *ldapURL,
-		LdapTLS:         *ldapTLS,
-		LdapTLSVerify:   *ldapTLSVerify,
-		LdapTLSCACert:   *ldapTLSCACert,
-		BindDN:          *ldapBindDN,
-		BindPassword:    *ldapBindPassword,
-		UserBaseDN:      *ldapUserBaseDN,
-		UserFilter:      *ldapUserFilter,
-		UserUIDAttr:     *ldapUserUIDAttr,
-		PagedSearch:     *ldapPagedSearch,
-		PagedSearchSize: *ldapPagedSearchSize,
-		SubIDStart:      *subIDStart,
-		SubIDRange:      *subIDRange,
-	}
-	l, err := localldap.LDAPConnect(c, logger)
+	defer func(start time.Time) { recordRun(runTypeRun, start, c, err, logger) }(time.Now())
+	readCtx, cancel := context.WithCancel(ctx)
+	if c.RunTimeout > 0 {
+		readCtx, cancel = context.WithTimeoutCause(ctx, c.RunTimeout, fmt.Errorf("run exceeded timeout of %s", c.RunTimeout))
+	}
+	defer cancel()
+	if c.SubIDSource == subid.SourceLDAP {
+		err = runSource(ctx, readCtx, c, logger)
+		return err
+	}
+	src, err := source.New(c, ldapClient)
+	if err != nil {
+		logger.Error("Unable to configure user source", "err", err)
+		return err
+	}
+	result, err := sourceUsers(readCtx, src, c, logger)
 	if err != nil {
 		return err
 	}
-	defer l.Close()
-	users, err := localldap.LDAPUsers(l, c, logger)
+	if err = ctx.Err(); err != nil {
+		logger.Info("Run cancelled, subid files not updated")
+		return err
+	}
+	users, maxID := result.Users, result.MaxID
+	for _, output := range c.OutputConfigs() {
+		if c.OverlapCheck != subid.OverlapOff {
+			output.SubIDStart, err = subIDPoolStart(output, maxID, logger)
+			if err != nil {
+				return err
+			}
+			poolStarts[output.SubUIDPath] = output.SubIDStart
+		}
+		if err = update(users, output, logger); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sourceUsers returns the users of the source and caches them. When the source fails
+// the cached users are returned so the subid files can still be built.
+func sourceUsers(ctx context.Context, src source.Source, c *config.Config, logger *slog.Logger) (source.Result, error) {
+	result, err := src.Users(ctx, logger)
+	if c.CachePath == "" {
+		return result, err
+	}
+	if err == nil {
+		// A failure to write the cache does not fail the run
+		_ = cache.Save(c.CachePath, c.UserSources, source.Signature(c), result.Users, result.MaxID, logger)
+		return result, nil
+	}
+	cached, cacheErr := cache.Load(c.CachePath, c.UserSources, source.Signature(c), c.CacheMaxAge, logger)
+	if cacheErr != nil {
+		return result, err
+	}
+	logger.Warn("Source unavailable, using cached users", "source", src.Name(), "err", err,
+		"cached", cached.Created.Format(time.RFC3339), "users", len(cached.Users))
+	return source.Result{Users: cached.Users, MaxID: cached.MaxID}, nil
+}
+
+// runSource writes the subid ranges assigned in LDAP to the subuid and subgid files.
+// The ranges are read and allocated within readCtx and the files are not written once ctx is cancelled.
+func runSource(ctx context.Context, readCtx context.Context, c *config.Config, logger *slog.Logger) error {
+	f, err := filter.Load(c)
+	if err != nil {
+		logger.Error("Failed to load user filter", "err", err)
+		return err
+	}
+	var subuids, subgids []subid.SubIDEntry
+	err = ldapClient.Do(readCtx, c, logger, func(l *ldap.Conn, info *localldap.ServerInfo) error {
+		var err error
+		subuids, subgids, err = localldap.LDAPSubIDs(readCtx, l, info, c, logger)
+		if err != nil || !c.SubIDAllocate {
+			return err
+		}
+		missing, err := localldap.LDAPSubIDMissing(readCtx, l, info, c, logger)
+		if err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(missing))
+		for _, user := range missing {
+			keys = append(keys, user.Key)
+		}
+		allowed := make(map[string]bool)
+		for _, key := range f.Apply(keys, logger) {
+			allowed[key] = true
+		}
+		missing = slices.DeleteFunc(missing, func(user localldap.SubIDUser) bool { return !allowed[user.Key] })
+		assigned, err := localldap.LDAPSubIDAllocate(readCtx, l, info, c, missing, append(subuids, subgids...), logger)
+		if err != nil || assigned == 0 {
+			return err
+		}
+		// Render what LDAP holds rather than what was written in case another host won
+		subuids, subgids, err = localldap.LDAPSubIDs(readCtx, l, info, c, logger)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err = ctx.Err(); err != nil {
+		logger.Info("Run cancelled, subid files not updated")
+		return err
+	}
+	users := []string{}
+	for _, e := range subuids {
+		if !slices.Contains(users, e.UID) {
+			users = append(users, e.UID)
+		}
+	}
+	allowed := make(map[string]bool)
+	for _, user := range f.Apply(users, logger) {
+		allowed[user] = true
+	}
+	subuids = slices.DeleteFunc(subuids, func(e subid.SubIDEntry) bool { return !allowed[e.UID] })
+	subgids = slices.DeleteFunc(subgids, func(e subid.SubIDEntry) bool { return !allowed[e.UID] })
+	logger.Debug("LDAP returned subid ranges", "count", len(subuids))
+	// Validate both files before writing either so they are not left inconsistent
+	if err := subid.SubIDValidate(subuids); err != nil {
+		logger.Error("Invalid subuid ranges in LDAP", "err", err)
+		return err
+	}
+	if err := subid.SubIDValidate(subgids); err != nil {
+		logger.Error("Invalid subgid ranges in LDAP", "err", err)
+		return err
+	}
+	for _, output := range c.OutputConfigs() {
+		if err := subid.SubIDSaveRanges(subuids, output.SubUIDPath, logger.With("subuid", output.SubUIDPath)); err != nil {
+			return err
+		}
+		if err := subid.SubIDSaveRanges(subgids, output.SubGIDPath, logger.With("subgid", output.SubGIDPath)); err != nil {
+			return err
+		}
+		logger.Info("Successfully rendered subids from LDAP", "subuid", output.SubUIDPath, "subgid", output.SubGIDPath)
+	}
+	return nil
+}
+
+// subIDPoolStart checks the subid pool against the highest ID in LDAP. In auto mode the
+// start of an existing managed file is kept as long as it does not overlap so subids are
+// not reassigned on every run.
+func subIDPoolStart(c *config.Config, maxID int, logger *slog.Logger) (int, error) {
+	start := c.SubIDStart
+	if c.OverlapCheck == subid.OverlapAuto {
+		if managedStart, ok := subid.SubIDManagedStart(c.SubUIDPath, c); ok {
+			start = managedStart
+		}
+	}
+	return subid.SubIDPoolStart(start, maxID, c, logger)
+}
+
+// update merges users into the subuid and subgid files.
+func update(users []string, c *config.Config, logger *slog.Logger) error {
+	f, err := filter.Load(c)
 	if err != nil {
+		logger.Error("Failed to load user filter", "err", err)
 		return err
 	}
+	users = f.Apply(users, logger)
 	utils.SortSliceStringInts(&users)
-	subid.SubUIDPath = *subUIDPath
-	subid.SubGIDPath = *subGIDPath
+	subid.SubUIDPath = c.SubUIDPath
+	subid.SubGIDPath = c.SubGIDPath
 	logger.Debug("LDAP returned users count", "count", len(users))
 	runLogger := logger.With("subuid", subid.SubUIDPath)
 	managed, err := subid.SubIDManaged(subid.SubUIDPath, c, runLogger)
@@ -166,12 +477,249 @@ func run(logger *slog.Logger) error {
 	return nil
 }
 
-func validateArgs(logger *slog.Logger) error {
+func getConfig() *config.Config {
+	c := &config.Config{
+		SubUIDPath:             *subUIDPath,
+		SubGIDPath:             *subGIDPath,
+		RunTimeout:             *runTimeout,
+		Daemon:                 *daemon,
+		DaemonUpdateInterval:   *daemonUpdateInterval,
+		DaemonSync:             *daemonSync,
+		DaemonSyncDelay:        *daemonSyncDelay,
+		ListenAddress:          *listenAddress,
+		MetricsPath:            *metricsPath,
+		APITokenFile:           *apiTokenFile,
+		APIReadOnly:            *apiReadOnly,
+		SocketPath:             *socketPath,
+		SocketAllowedUIDs:      utils.SplitList(*socketAllowedUIDs),
+		UserSources:            strings.Split(*userSources, ","),
+		SourceCombine:          *sourceCombine,
+		LDIFFile:               *ldifFile,
+		PasswdFile:             *passwdFile,
+		JSONFile:               *jsonFile,
+		CSVFile:                *csvFile,
+		SCIMURL:                *scimURL,
+		SCIMToken:              *scimToken,
+		SCIMTokenFile:          *scimTokenFile,
+		SCIMKeyAttr:            *scimKeyAttr,
+		SCIMPageSize:           *scimPageSize,
+		SCIMTimeout:            *scimTimeout,
+		CachePath:              *cachePath,
+		CacheMaxAge:            *cacheMaxAge,
+		LdapURL:                *ldapURL,
+		LdapTLS:                *ldapTLS,
+		LdapTLSVerify:          *ldapTLSVerify,
+		LdapTLSCACert:          *ldapTLSCACert,
+		LdapTLSCAFile:          *ldapTLSCAFile,
+		LdapTLSCADir:           *ldapTLSCADir,
+		LdapTLSMinVersion:      *ldapTLSMinVersion,
+		LdapTLSCipherSuites:    utils.SplitList(*ldapTLSCipherSuites),
+		LdapTLSServerName:      *ldapTLSServerName,
+		LdapTLSPinSHA256:       utils.SplitList(*ldapTLSPinSHA256),
+		LdapKeepAlive:          *ldapKeepAlive,
+		LdapPersistent:         *ldapPersistent,
+		LdapIdleTimeout:        *ldapIdleTimeout,
+		BindDN:                 *ldapBindDN,
+		BindPassword:           *ldapBindPassword,
+		BindPasswordFile:       *ldapBindPasswordFile,
+		BindPasswordCredential: *ldapBindPasswordCred,
+		BindPasswordCommand:    *ldapBindPasswordCmd,
+		UserBaseDN:             *ldapUserBaseDN,
+		UserFilter:             *ldapUserFilter,
+		UserUIDAttr:            *ldapUserUIDAttr,
+		UserKeyMode:            *ldapUserKeyMode,
+		UserKeyTransforms:      *ldapUserKeyTransform,
+		SIDRangeMin:            *ldapSIDRangeMin,
+		SIDRangeMax:            *ldapSIDRangeMax,
+		SIDRangeSize:           *ldapSIDRangeSize,
+		SIDAutoridCompat:       *ldapSIDAutorid,
+		SIDDefaultDomainSID:    *ldapSIDDefaultDomain,
+		UserScope:              *ldapUserScope,
+		UserDerefAliases:       *ldapUserDeref,
+		SearchSizeLimit:        *ldapSizeLimit,
+		SearchTimeLimit:        *ldapTimeLimit,
+		SearchSort:             *ldapSort,
+		MinUID:                 *ldapMinUID,
+		MaxUID:                 *ldapMaxUID,
+		IncludeUsersFile:       *ldapIncludeUsersFile,
+		ExcludeUsersFile:       *ldapExcludeUsersFile,
+		AccountState:           *ldapAccountState,
+		AccountStateGrace:      *ldapAccountGrace,
+		AccountStateFile:       *ldapAccountStateFile,
+		LdapIncremental:        *ldapIncremental,
+		LdapIncrementalFull:    *ldapIncrementalFull,
+		LdapAutoDetect:         *ldapAutoDetect,
+		PagedSearch:            *ldapPagedSearch,
+		PagedSearchSize:        *ldapPagedSearchSize,
+		SubIDStart:             *subIDStart,
+		SubIDRange:             *subIDRange,
+		SubIDStartAlign:        *subIDStartAlign,
+		SubIDSource:            *subIDSource,
+		SubIDBaseDN:            *subIDLDAPBaseDN,
+		SubIDFilter:            *subIDLDAPFilter,
+		SubIDOwnerAttr:         *subIDLDAPOwnerAttr,
+		SubUIDStartAttr:        *subUIDStartAttr,
+		SubUIDCountAttr:        *subUIDCountAttr,
+		SubGIDStartAttr:        *subGIDStartAttr,
+		SubGIDCountAttr:        *subGIDCountAttr,
+		SubIDAllocate:          *subIDLDAPAllocate,
+		SubIDLedgerDN:          *subIDLedgerDN,
+		SubIDLedgerAttr:        *subIDLedgerAttr,
+		OverlapCheck:           *subIDOverlapCheck,
+		OverlapBaseDN:          *subIDOverlapBaseDN,
+		OverlapHeadroom:        *subIDOverlapHeadroom,
+	}
+	if configFileLists != nil {
+		c.Searches = configFileLists.Searches
+		c.Pools = configFileLists.Pools
+		c.Outputs = configFileLists.Outputs
+	}
+	return c
+}
+
+// validateLists checks the searches, pools and outputs of the configuration file.
+func validateLists(c *config.Config) []string {
+	errs := []string{}
+	for i, search := range c.Searches {
+		if search.BaseDN == "" {
+			errs = append(errs, fmt.Sprintf("searches=\"Search %d requires a base DN\"", i+1))
+		}
+		if search.Scope != "" {
+			if _, err := localldap.SearchScope(search.Scope); err != nil {
+				errs = append(errs, fmt.Sprintf("searches=\"Search %d: %s\"", i+1, err.Error()))
+			}
+		}
+	}
+	if len(c.Searches) > 0 && c.SubIDOwnerAttr != "" && c.SubIDBaseDN == "" {
+		errs = append(errs, "subid-ldap-base-dn=\"Required with searches when subid ranges are stored in separate entries\"")
+	}
+	pools := make(map[string]bool)
+	for i, pool := range c.Pools {
+		if _, ok := pools[pool.Name]; ok || pool.Name == "" {
+			errs = append(errs, fmt.Sprintf("pools=\"Pool %d requires a unique name\"", i+1))
+		}
+		pools[pool.Name] = false
+		if pool.Start < 1 || pool.Range < 1 || pool.StartAlign < 0 {
+			errs = append(errs, fmt.Sprintf("pools=\"Pool %s requires a start and range of at least 1 and a start alignment that is not negative\"", pool.Name))
+		}
+	}
+	if len(c.Pools) > 0 && c.SubIDSource == subid.SourceLDAP {
+		errs = append(errs, "pools=\"Not used when reading subid ranges from LDAP\"")
+	}
+	paths := make(map[string]bool)
+	for i, output := range c.Outputs {
+		if output.SubUID == "" || output.SubGID == "" {
+			errs = append(errs, fmt.Sprintf("outputs=\"Output %d requires a subuid and subgid file\"", i+1))
+		}
+		for _, path := range []string{output.SubUID, output.SubGID} {
+			if path != "" && paths[path] {
+				errs = append(errs, fmt.Sprintf("outputs=\"File %s is used by more than one output\"", path))
+			}
+			paths[path] = true
+		}
+		if output.Pool == "" {
+			continue
+		}
+		if _, ok := pools[output.Pool]; !ok {
+			errs = append(errs, fmt.Sprintf("outputs=\"Output %d uses unknown pool %s\"", i+1, output.Pool))
+		}
+		pools[output.Pool] = true
+	}
+	for _, pool := range c.Pools {
+		if pool.Name != "" && !pools[pool.Name] {
+			errs = append(errs, fmt.Sprintf("pools=\"Pool %s is not used by an output\"", pool.Name))
+		}
+	}
+	return errs
+}
+
+// numericUserKeys reports if the user keys are UIDs so they can be compared with the UID range.
+func numericUserKeys(c *config.Config) bool {
+	if slices.Contains(c.UserSources, source.SCIM) || len(c.UserKeyTransforms) > 0 {
+		return false
+	}
+	return c.UserKeyMode == localldap.UserKeyObjectSID || strings.EqualFold(c.UserUIDAttr, "uidNumber")
+}
+
+// validateConfig checks a configuration before it is used, logging and returning all problems found.
+func validateConfig(c *config.Config, logger *slog.Logger) error {
 	errs := []string{}
 	var err error
-	if (*ldapBindDN != "" && *ldapBindPassword == "") || (*ldapBindDN == "" && *ldapBindPassword != "") {
+	if err := source.Validate(c); err != nil {
+		errs = append(errs, fmt.Sprintf("source=%q", err.Error()))
+	}
+	if c.RunTimeout < 0 {
+		errs = append(errs, "run-timeout=\"Must not be negative\"")
+	}
+	for _, uid := range c.SocketAllowedUIDs {
+		if id, err := strconv.Atoi(uid); err != nil || id < 0 {
+			errs = append(errs, fmt.Sprintf("socket-allowed-uids=\"Invalid UID %s\"", uid))
+		}
+	}
+	if c.CacheMaxAge < 0 {
+		errs = append(errs, "cache-max-age=\"Must not be negative\"")
+	}
+	if slices.Contains(c.UserSources, source.LDAP) && c.UserBaseDN == "" && len(c.Searches) == 0 {
+		errs = append(errs, "ldap-user-base-dn=\"Required when the source is ldap without searches\"")
+	}
+	if len(c.Searches) > 1 && c.DaemonSync != localldap.SyncModeNone {
+		errs = append(errs, "daemon-sync=\"Real-time updates follow a single search\"")
+	}
+	errs = append(errs, validateLists(c)...)
+	if !slices.Equal(c.UserSources, []string{source.LDAP}) && c.DaemonSync != localldap.SyncModeNone {
+		errs = append(errs, "daemon-sync=\"Real-time updates require only the ldap source\"")
+	}
+	hasBindPassword := localldap.HasBindPassword(c)
+	if (c.BindDN != "" && !hasBindPassword) || (c.BindDN == "" && hasBindPassword) {
 		errs = append(errs, "ldap-bind=\"Must provide both LDAP Bind DN and Bind Password if either is provided\"")
 	}
+	if err := localldap.ValidateBindPassword(c); err != nil {
+		errs = append(errs, fmt.Sprintf("ldap-bind-password=%q", err.Error()))
+	}
+	if _, err := localldap.TLSCipherSuites(c.LdapTLSCipherSuites); err != nil {
+		errs = append(errs, fmt.Sprintf("ldap-tls-cipher-suites=%q", err.Error()))
+	}
+	if _, err := localldap.TLSPins(c.LdapTLSPinSHA256); err != nil {
+		errs = append(errs, fmt.Sprintf("ldap-tls-pin-sha256=%q", err.Error()))
+	}
+	if c.SearchSizeLimit < 0 {
+		errs = append(errs, "ldap-size-limit=\"Must not be negative\"")
+	}
+	if c.SearchTimeLimit < 0 {
+		errs = append(errs, "ldap-time-limit=\"Must not be negative\"")
+	}
+	if _, err := transform.Compile(c.UserKeyTransforms); err != nil {
+		errs = append(errs, fmt.Sprintf("ldap-user-key-transform=%q", err.Error()))
+	}
+	if c.UserKeyMode == localldap.UserKeyObjectSID && (c.SIDRangeSize <= 0 || c.SIDRangeMin < 0 || c.SIDRangeMax-c.SIDRangeMin < c.SIDRangeSize) {
+		errs = append(errs, "ldap-idmap-range=\"Range max must exceed range min by at least the range size\"")
+	}
+	if c.SubIDSource == subid.SourceLDAP && c.DaemonSync != localldap.SyncModeNone {
+		errs = append(errs, "daemon-sync=\"Real-time updates are not supported when reading subid ranges from LDAP\"")
+	}
+	if c.LdapIncremental != localldap.IncrementalOff && (c.SubIDSource == subid.SourceLDAP || c.LdapIncrementalFull <= 0) {
+		errs = append(errs, "ldap-incremental=\"Not supported when reading subid ranges from LDAP and requires a full search interval greater than 0\"")
+	}
+	if c.SubIDAllocate && (c.SubIDSource != subid.SourceLDAP || c.SubIDOwnerAttr != "" || c.SubIDLedgerDN == "") {
+		errs = append(errs, "subid-ldap-allocate=\"Requires the ldap subid source, a ledger DN and ranges stored in user entries\"")
+	}
+	if c.OverlapHeadroom < 0 || c.SubIDStartAlign < 1 {
+		errs = append(errs, "subid-overlap=\"Headroom must not be negative and start alignment must be at least 1\"")
+	}
+	if c.MinUID < 0 || c.MaxUID < 0 || (c.MaxUID > 0 && c.MaxUID < c.MinUID) {
+		errs = append(errs, "ldap-uid-range=\"Min and max UID must not be negative and max UID must not be below min UID\"")
+	}
+	if (c.MinUID > 0 || c.MaxUID > 0) && !numericUserKeys(c) {
+		errs = append(errs, "ldap-uid-range=\"Requires user keys that are UIDs, from uidNumber or objectSid without key transforms and without the scim source\"")
+	}
+	if c.AccountState == localldap.AccountStateGrace && c.AccountStateGrace <= 0 {
+		errs = append(errs, "ldap-account-state-grace=\"Must be greater than 0 when account state is grace\"")
+	}
+	if c.SearchSort != "" {
+		if _, err := localldap.SortControl(c.SearchSort); err != nil {
+			errs = append(errs, fmt.Sprintf("ldap-sort=%q", err.Error()))
+		}
+	}
 	if len(errs) > 0 {
 		err = errors.New(strings.Join(errs, ", "))
 		logger.Error(err.Error())
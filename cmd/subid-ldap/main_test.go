@@ -14,11 +14,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -89,7 +91,7 @@ func TestRun(t *testing.T) {
 		t.Fatal(err)
 	}
 	metrics.ResetMetrics()
-	err = run(logger)
+	err = run(context.Background(), logger)
 	if err != nil {
 		t.Errorf("Unexpected error: %s", err)
 	}
@@ -150,7 +152,7 @@ subid_ldap_subid_total 4`
 	if _, err := kingpin.CommandLine.Parse(args); err != nil {
 		t.Fatal(err)
 	}
-	err = run(logger)
+	err = run(context.Background(), logger)
 	if err != nil {
 		t.Errorf("Unexpected error: %s", err)
 	}
@@ -195,7 +197,7 @@ func TestRunExisting(t *testing.T) {
 		t.Fatal(err)
 	}
 	metrics.ResetMetrics()
-	err = run(logger)
+	err = run(context.Background(), logger)
 	if err != nil {
 		t.Errorf("Unexpected error: %s", err)
 	}
@@ -248,7 +250,7 @@ func TestRunExisting(t *testing.T) {
 	if _, err := kingpin.CommandLine.Parse(args); err != nil {
 		t.Fatal(err)
 	}
-	err = run(logger)
+	err = run(context.Background(), logger)
 	if err != nil {
 		t.Errorf("Unexpected error: %s", err)
 	}
@@ -319,7 +321,7 @@ func TestRunDaemonMetrics(t *testing.T) {
 			logger.Error(err.Error())
 		}
 	}()
-	err = run(logger)
+	err = run(context.Background(), logger)
 	if err != nil {
 		t.Errorf("Unexpected error: %s", err)
 	}
@@ -348,6 +350,315 @@ subid_ldap_subid_total 4`
 	}
 }
 
+func TestRunSource(t *testing.T) {
+	logger := promslog.NewNopLogger()
+	dir := t.TempDir()
+	subuid := filepath.Join(dir, "subuid")
+	subgid := filepath.Join(dir, "subgid")
+	args := []string{
+		fmt.Sprintf("--ldap.url=ldap://%s", ldapserver),
+		fmt.Sprintf("--ldap.user-base-dn=%s", test.BulkBaseDN),
+		fmt.Sprintf("--ldap.bind-dn=%s", test.BindDN),
+		"--ldap.bind-password=password",
+		fmt.Sprintf("--subid.subuid=%s", subuid),
+		fmt.Sprintf("--subid.subgid=%s", subgid),
+		"--subid.source=ldap",
+		fmt.Sprintf("--subid.ldap-base-dn=%s", test.SubIDBaseDN),
+		"--subid.ldap-owner-attr=ipaOwner",
+		"--ldap.min-uid=10001",
+	}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	metrics.ResetMetrics()
+	if err := run(context.Background(), logger); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	subuidContent, err := os.ReadFile(subuid)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	subgidContent, err := os.ReadFile(subgid)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expectedSubUID := `# Managed by subid-ldap: source=ldap
+10001:2147549184:65536
+10002:2147614720:65536
+10003:2147680256:65536
+10004:2147745792:65536`
+	if string(subuidContent) != expectedSubUID {
+		t.Errorf("Unexpected subuid content:\nGot:\n%s\nExpected:\n%s", string(subuidContent), expectedSubUID)
+	}
+	expectedSubGID := `# Managed by subid-ldap: source=ldap
+10001:3147549184:65536
+10002:3147614720:65536
+10003:3147680256:65536
+10004:3147745792:65536`
+	if string(subgidContent) != expectedSubGID {
+		t.Errorf("Unexpected subgid content:\nGot:\n%s\nExpected:\n%s", string(subgidContent), expectedSubGID)
+	}
+	expectedMetrics := `# HELP subid_ldap_subid_total Total number of subid entries
+# TYPE subid_ldap_subid_total gauge
+subid_ldap_subid_total 4
+`
+	if err := testutil.GatherAndCompare(metrics.MetricGathers(false), strings.NewReader(expectedMetrics), "subid_ldap_subid_total"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestRunSourceAllocate(t *testing.T) {
+	logger := promslog.NewNopLogger()
+	test.ResetWriteback()
+	dir := t.TempDir()
+	subuid := filepath.Join(dir, "subuid")
+	subgid := filepath.Join(dir, "subgid")
+	args := []string{
+		fmt.Sprintf("--ldap.url=ldap://%s", ldapserver),
+		fmt.Sprintf("--ldap.user-base-dn=%s", test.WritebackBaseDN),
+		fmt.Sprintf("--ldap.bind-dn=%s", test.BindDN),
+		"--ldap.bind-password=password",
+		fmt.Sprintf("--subid.subuid=%s", subuid),
+		fmt.Sprintf("--subid.subgid=%s", subgid),
+		"--subid.source=ldap",
+		"--subid.ldap-allocate",
+		fmt.Sprintf("--subid.ldap-ledger-dn=%s", test.LedgerDN),
+		"--subid.ldap-owner-attr=",
+	}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateConfig(getConfig(), logger); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	metrics.ResetMetrics()
+	if err := run(context.Background(), logger); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	subuidContent, err := os.ReadFile(subuid)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := `# Managed by subid-ldap: source=ldap
+20000:2147483648:65536
+20001:2147549184:65536
+20002:2147614720:65536`
+	if string(subuidContent) != expected {
+		t.Errorf("Unexpected subuid content:\nGot:\n%s\nExpected:\n%s", string(subuidContent), expected)
+	}
+	// A second run finds every user has a range and writes nothing
+	ledger := test.WritebackEntry(test.LedgerDN)[test.LedgerAttr]
+	if err := run(context.Background(), logger); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if after := test.WritebackEntry(test.LedgerDN)[test.LedgerAttr]; after[0] != ledger[0] {
+		t.Errorf("Unexpected ledger change, got: %v expected: %v", after, ledger)
+	}
+
+	args[len(args)-1] = "--subid.ldap-owner-attr=ipaOwner"
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	err = validateConfig(getConfig(), logger)
+	if err == nil || !strings.Contains(err.Error(), "subid-ldap-allocate") {
+		t.Errorf("Expected error about allocating with an owner attribute, got: %v", err)
+	}
+}
+
+func TestRunIncremental(t *testing.T) {
+	logger := promslog.NewNopLogger()
+	test.ResetWriteback()
+	defer test.ResetWriteback()
+	dir := t.TempDir()
+	subuid := filepath.Join(dir, "subuid")
+	subgid := filepath.Join(dir, "subgid")
+	args := []string{
+		fmt.Sprintf("--ldap.url=ldap://%s", ldapserver),
+		fmt.Sprintf("--ldap.user-base-dn=%s", test.WritebackBaseDN),
+		fmt.Sprintf("--ldap.bind-dn=%s", test.BindDN),
+		"--ldap.bind-password=password",
+		fmt.Sprintf("--subid.subuid=%s", subuid),
+		fmt.Sprintf("--subid.subgid=%s", subgid),
+		"--subid.source=allocate",
+		"--ldap.incremental=uSNChanged",
+	}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateConfig(getConfig(), logger); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer ldapClient.Incremental.Reset()
+	metrics.ResetMetrics()
+	if err := run(context.Background(), logger); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	test.AddWriteback(fmt.Sprintf("uid=writebackuser3,%s", test.WritebackBaseDN), map[string][]string{
+		"objectClass": {"posixAccount"},
+		"uid":         {"writebackuser3"},
+		"uidNumber":   {"20003"},
+	})
+	if err := run(context.Background(), logger); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	subuidContent, err := os.ReadFile(subuid)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := `# Managed by subid-ldap: start=65537 range=65536
+20000:65537:65536
+20001:131074:65536
+20002:196611:65536
+20003:262148:65536`
+	if string(subuidContent) != expected {
+		t.Errorf("Unexpected subuid content:\nGot:\n%s\nExpected:\n%s", string(subuidContent), expected)
+	}
+	expectedMetrics := `# HELP subid_ldap_ldap_incremental_changes Number of changed users returned by the last incremental LDAP search
+# TYPE subid_ldap_ldap_incremental_changes gauge
+subid_ldap_ldap_incremental_changes 1
+`
+	if err := testutil.GatherAndCompare(metrics.MetricGathers(false), strings.NewReader(expectedMetrics), "subid_ldap_ldap_incremental_changes"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+
+	args[len(args)-2] = "--subid.source=ldap"
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	err = validateConfig(getConfig(), logger)
+	if err == nil || !strings.Contains(err.Error(), "ldap-incremental") {
+		t.Errorf("Expected error about incremental with the ldap subid source, got: %v", err)
+	}
+}
+
+func TestRunLDIF(t *testing.T) {
+	logger := promslog.NewNopLogger()
+	dir := t.TempDir()
+	subuid := filepath.Join(dir, "subuid")
+	subgid := filepath.Join(dir, "subgid")
+	args := []string{
+		"--source=ldif",
+		fmt.Sprintf("--ldif.file=%s", test.GetFixture("users.ldif")),
+		"--ldap.url=",
+		"--ldap.bind-dn=",
+		"--ldap.bind-password=",
+		fmt.Sprintf("--ldap.user-base-dn=%s", test.UserBaseDN),
+		fmt.Sprintf("--ldap.user-filter=%s", test.UserFilterStatus),
+		fmt.Sprintf("--subid.subuid=%s", subuid),
+		fmt.Sprintf("--subid.subgid=%s", subgid),
+	}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateConfig(getConfig(), logger); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	metrics.ResetMetrics()
+	if err := run(context.Background(), logger); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	subuidContent, err := os.ReadFile(subuid)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := `# Managed by subid-ldap: start=65537 range=65536
+1000:65537:65536
+1001:131074:65536
+1002:196611:65536`
+	if string(subuidContent) != expected {
+		t.Errorf("Unexpected subuid content:\nGot:\n%s\nExpected:\n%s", string(subuidContent), expected)
+	}
+
+	args[1] = "--ldif.file="
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	err = validateConfig(getConfig(), logger)
+	if err == nil || !strings.Contains(err.Error(), "required by the ldif source") {
+		t.Errorf("Expected error about missing LDIF file, got: %v", err)
+	}
+	args[0] = "--source=ldap"
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	err = validateConfig(getConfig(), logger)
+	if err == nil || !strings.Contains(err.Error(), "LDAP URL is required") {
+		t.Errorf("Expected error about missing LDAP URL, got: %v", err)
+	}
+}
+
+func TestRunCache(t *testing.T) {
+	logger := promslog.NewNopLogger()
+	dir := t.TempDir()
+	subuid := filepath.Join(dir, "subuid")
+	subgid := filepath.Join(dir, "subgid")
+	ldif := filepath.Join(dir, "users.ldif")
+	content, err := os.ReadFile(test.GetFixture("users.ldif"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := os.WriteFile(ldif, content, 0644); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	args := []string{
+		"--source=ldif",
+		fmt.Sprintf("--ldif.file=%s", ldif),
+		fmt.Sprintf("--cache.path=%s", filepath.Join(dir, "cache.json")),
+		fmt.Sprintf("--ldap.user-base-dn=%s", test.UserBaseDN),
+		fmt.Sprintf("--ldap.user-filter=%s", test.UserFilterStatus),
+		fmt.Sprintf("--subid.subuid=%s", subuid),
+		fmt.Sprintf("--subid.subgid=%s", subgid),
+	}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	metrics.ResetMetrics()
+	if err := run(context.Background(), logger); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// The node lost its subid files and the source is unavailable
+	for _, path := range []string{subuid, subgid, ldif} {
+		if err := os.Remove(path); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	if err := run(context.Background(), logger); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	subuidContent, err := os.ReadFile(subuid)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := `# Managed by subid-ldap: start=65537 range=65536
+1000:65537:65536
+1001:131074:65536
+1002:196611:65536`
+	if string(subuidContent) != expected {
+		t.Errorf("Unexpected subuid content:\nGot:\n%s\nExpected:\n%s", string(subuidContent), expected)
+	}
+	expectedMetrics := `# HELP subid_ldap_served_from_cache Indicates the last run used the cached user list because the source was unavailable
+# TYPE subid_ldap_served_from_cache gauge
+subid_ldap_served_from_cache 1
+`
+	if err := testutil.GatherAndCompare(metrics.MetricGathers(false), strings.NewReader(expectedMetrics), "subid_ldap_served_from_cache"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+
+	if _, err := kingpin.CommandLine.Parse(append(args, "--cache.max-age=1ns")); err != nil {
+		t.Fatal(err)
+	}
+	if err := run(context.Background(), logger); err == nil {
+		t.Errorf("Expected error with expired cache")
+	}
+	if _, err := kingpin.CommandLine.Parse(append(args, "--ldap.user-uid-attr=uid")); err != nil {
+		t.Fatal(err)
+	}
+	if err := run(context.Background(), logger); err == nil {
+		t.Errorf("Expected error with cache of another user attribute")
+	}
+	*cachePath = ""
+}
+
 func TestRunErrors(t *testing.T) {
 	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
 	subuid, err := test.CreateTmpFile("subuid", logger)
@@ -379,7 +690,7 @@ func TestRunErrors(t *testing.T) {
 		t.Fatal(err)
 	}
 	metrics.ResetMetrics()
-	err = run(logger)
+	err = run(context.Background(), logger)
 	if err == nil {
 		t.Errorf("Expected an error")
 	}
@@ -412,9 +723,61 @@ subid_ldap_subid_total 0`
 	}
 }
 
+func TestRunCancelled(t *testing.T) {
+	logger := promslog.NewNopLogger()
+	subuid, err := test.CreateTmpFile("subuid", logger)
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	defer os.Remove(subuid)
+	subgid, err := test.CreateTmpFile("subgid", logger)
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	defer os.Remove(subgid)
+	for _, source := range []string{"allocate", "ldap"} {
+		args := append([]string{
+			fmt.Sprintf("--subid.subuid=%s", subuid),
+			fmt.Sprintf("--subid.subgid=%s", subgid),
+			fmt.Sprintf("--ldap.user-filter=%s", test.UserFilter),
+			fmt.Sprintf("--subid.source=%s", source),
+			"--metrics.path=",
+		}, baseArgs...)
+		if _, err := kingpin.CommandLine.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err = run(ctx, logger)
+		if err == nil {
+			t.Errorf("Expected error with source %s", source)
+		}
+		subuidContent, err := os.ReadFile(subuid)
+		if err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+		if len(subuidContent) != 0 {
+			t.Errorf("Unexpected subuid content with source %s:\n%s", source, string(subuidContent))
+		}
+	}
+}
+
+func TestTriggerRun(t *testing.T) {
+	if !triggerRun() {
+		t.Errorf("Expected run to be triggered")
+	}
+	if triggerRun() {
+		t.Errorf("Expected pending run to not be triggered again")
+	}
+	<-runTrigger
+}
+
 func TestValidateArgs(t *testing.T) {
-	if _, err := kingpin.CommandLine.Parse([]string{}); err == nil {
-		t.Errorf("Expected error parsing lack of args")
+	if _, err := kingpin.CommandLine.Parse([]string{"--ldap.url=", "--ldap.user-base-dn="}); err != nil {
+		t.Errorf("Error parsing args %s", err.Error())
+	}
+	if err := validateConfig(getConfig(), promslog.NewNopLogger()); err == nil || !strings.Contains(err.Error(), "ldap-user-base-dn") {
+		t.Errorf("Expected error about lack of LDAP args, got: %v", err)
 	}
 	baseArgs = []string{
 		fmt.Sprintf("--ldap.url=ldap://%s", ldapserver),
@@ -427,13 +790,51 @@ func TestValidateArgs(t *testing.T) {
 	if _, err := kingpin.CommandLine.Parse(args); err != nil {
 		t.Errorf("Error parsing args %s", err.Error())
 	}
-	err := validateArgs(promslog.NewNopLogger())
+	err := validateConfig(getConfig(), promslog.NewNopLogger())
 	if err == nil {
 		t.Fatal("Expected errors")
 	}
 	if !strings.Contains(err.Error(), "both LDAP Bind DN and Bind Password") {
 		t.Errorf("Expected error about missing bind args")
 	}
+	if _, err := kingpin.CommandLine.Parse(append(baseArgs, "--run.timeout=-1s")); err != nil {
+		t.Errorf("Error parsing args %s", err.Error())
+	}
+	if err := validateConfig(getConfig(), promslog.NewNopLogger()); err == nil || !strings.Contains(err.Error(), "run-timeout") {
+		t.Errorf("Expected error about negative run timeout, got: %v", err)
+	}
+	if _, err := kingpin.CommandLine.Parse(append(baseArgs, "--socket.allowed-uids=0,root")); err != nil {
+		t.Errorf("Error parsing args %s", err.Error())
+	}
+	if err := validateConfig(getConfig(), promslog.NewNopLogger()); err == nil || !strings.Contains(err.Error(), "Invalid UID root") {
+		t.Errorf("Expected error about invalid socket UID, got: %v", err)
+	}
+	if _, err := kingpin.CommandLine.Parse(append(baseArgs, "--socket.allowed-uids=")); err != nil {
+		t.Errorf("Error parsing args %s", err.Error())
+	}
+	if c := getConfig(); len(c.SocketAllowedUIDs) != 0 {
+		t.Errorf("Expected no socket UIDs, got: %q", c.SocketAllowedUIDs)
+	}
+	for _, extra := range [][]string{
+		{"--ldap.user-uid-attr=uid"},
+		{"--ldap.user-key-transform=lowercase"},
+		{"--source=ldap,scim", "--scim.url=https://example.com/scim/v2", "--scim.token=token"},
+	} {
+		args := append(append([]string{"--ldap.min-uid=1000"}, baseArgs...), extra...)
+		if _, err := kingpin.CommandLine.Parse(args); err != nil {
+			t.Errorf("Error parsing args %s", err.Error())
+		}
+		if err := validateConfig(getConfig(), promslog.NewNopLogger()); err == nil || !strings.Contains(err.Error(), "Requires user keys that are UIDs") {
+			t.Errorf("Expected error about non numeric user keys with %v, got: %v", extra, err)
+		}
+	}
+	*ldapUserKeyTransform = nil
+	if _, err := kingpin.CommandLine.Parse(append([]string{"--ldap.min-uid=1000", "--ldap.user-uid-attr=uidnumber", "--ldap.bind-dn="}, baseArgs...)); err != nil {
+		t.Errorf("Error parsing args %s", err.Error())
+	}
+	if err := validateConfig(getConfig(), promslog.NewNopLogger()); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
 }
 
 func queryExporter(path string, want int) (string, error) {
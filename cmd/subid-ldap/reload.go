@@ -0,0 +1,140 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/treydock/subid-ldap/internal/config"
+	"github.com/treydock/subid-ldap/internal/metrics"
+)
+
+var (
+	// activeConfig is the configuration used by the daemon, replaced by a successful reload
+	activeConfig atomic.Pointer[config.Config]
+	// restartSettings are the settings read once at start that a reload cannot change
+	restartSettings string
+)
+
+// currentConfig returns a copy of the configuration in use, built from the flags
+// when no configuration has been activated.
+func currentConfig() *config.Config {
+	if c := activeConfig.Load(); c != nil {
+		copied := *c
+		return &copied
+	}
+	return getConfig()
+}
+
+// daemonSettings describes the settings used to start the daemon.
+func daemonSettings(c *config.Config) string {
+	return fmt.Sprintf("daemon=%t daemon.update-interval=%s daemon.sync=%s daemon.sync-delay=%s metrics.listen-address=%s ldap.persistent=%t ldap.idle-timeout=%s socket.path=%s",
+		c.Daemon, c.DaemonUpdateInterval, c.DaemonSync, c.DaemonSyncDelay, c.ListenAddress, c.LdapPersistent, c.LdapIdleTimeout, c.SocketPath)
+}
+
+// keepDaemonSettings copies the settings only applied at start from the configuration in use.
+func keepDaemonSettings(c *config.Config, running *config.Config) {
+	c.Daemon = running.Daemon
+	c.DaemonUpdateInterval = running.DaemonUpdateInterval
+	c.DaemonSync = running.DaemonSync
+	c.DaemonSyncDelay = running.DaemonSyncDelay
+	c.ListenAddress = running.ListenAddress
+	c.LdapPersistent = running.LdapPersistent
+	c.LdapIdleTimeout = running.LdapIdleTimeout
+	c.SocketPath = running.SocketPath
+}
+
+// reload parses the flags and configuration file again and activates the new configuration
+// between runs. The flags are parsed into a new configuration which replaces the configuration
+// in use only when it is valid, runs never read the flags directly.
+func reload(args []string, logger *slog.Logger) error {
+	runLock.Lock()
+	defer runLock.Unlock()
+	logger.Info("Reloading configuration")
+	var c *config.Config
+	err := reloadFlags(args)
+	if err == nil {
+		c = getConfig()
+		err = validateConfig(c, logger)
+	}
+	if err != nil {
+		logger.Error("Error reloading configuration, keeping the current configuration", "err", err)
+		metrics.MetricConfigReloadSuccess.Set(0)
+		return err
+	}
+	if settings := daemonSettings(c); settings != restartSettings {
+		logger.Warn("Some changed settings only apply after a restart", "running", restartSettings, "configured", settings)
+	}
+	if running := activeConfig.Load(); running != nil {
+		keepDaemonSettings(c, running)
+	}
+	activeConfig.Store(c)
+	// Reconnect so changed credentials are read and used for the next bind
+	ldapClient.Close()
+	select {
+	case syncRestart <- struct{}{}:
+	default:
+	}
+	logger.Info("Reloaded configuration")
+	metrics.MetricConfigReloadSuccess.Set(1)
+	metrics.MetricConfigReloadTimestamp.Set(float64(time.Now().Unix()))
+	return nil
+}
+
+// reloadFlags parses the flags, environment and configuration file again. Flags without
+// a default are cleared first so settings removed from the configuration file are not kept.
+func reloadFlags(args []string) error {
+	for _, flag := range kingpin.CommandLine.Model().Flags {
+		if len(flag.Default) > 0 || flag.IsBoolFlag() {
+			continue
+		}
+		if v, ok := flag.Value.(interface{ IsCumulative() bool }); ok && v.IsCumulative() {
+			continue
+		}
+		if err := flag.Value.Set(""); err != nil {
+			return err
+		}
+	}
+	*ldapUserKeyTransform = nil
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		return err
+	}
+	return loadConfigFile(args)
+}
+
+// reloadHandler reloads the configuration for POST requests to /-/reload. Requests need
+// the API token when one is configured and are refused when the API is read-only.
+func reloadHandler(logger *slog.Logger) http.Handler {
+	return apiAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			w.Header().Set("Allow", "POST, PUT")
+			http.Error(w, "Only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if currentConfig().APIReadOnly {
+			http.Error(w, "API is read-only", http.StatusForbidden)
+			return
+		}
+		if err := reload(os.Args[1:], logger); err != nil {
+			http.Error(w, fmt.Sprintf("failed to reload config: %s", err), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}), logger)
+}
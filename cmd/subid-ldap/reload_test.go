@@ -0,0 +1,175 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/promslog"
+	"github.com/treydock/subid-ldap/internal/metrics"
+	"github.com/treydock/subid-ldap/internal/test"
+)
+
+func TestReload(t *testing.T) {
+	logger := promslog.NewNopLogger()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	writeConfig("ldap:\n  user:\n    filter: (uid=old)\ncache:\n  path: /tmp/users.json\n")
+	args := append([]string{"--config.file=" + path}, baseArgs...)
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfigFile(args); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	activeConfig.Store(getConfig())
+	defer func() {
+		activeConfig.Store(nil)
+		if _, err := kingpin.CommandLine.Parse(baseArgs); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	if c := currentConfig(); c.UserFilter != "(uid=old)" || c.CachePath != "/tmp/users.json" {
+		t.Fatalf("Unexpected initial config, filter: %s cache: %s", c.UserFilter, c.CachePath)
+	}
+
+	writeConfig("ldap:\n  user:\n    filter: (uid=new)\n")
+	if err := reload(args, logger); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	c := currentConfig()
+	if c.UserFilter != "(uid=new)" {
+		t.Errorf("Unexpected filter, got: %s", c.UserFilter)
+	}
+	if c.CachePath != "" {
+		t.Errorf("Expected cache path removed from file to be cleared, got: %s", c.CachePath)
+	}
+	if val := testutil.ToFloat64(metrics.MetricConfigReloadSuccess); val != 1 {
+		t.Errorf("Unexpected reload success, got: %v", val)
+	}
+
+	for _, content := range []string{
+		"ldap:\n  user:\n    filter: (uid=invalid)\n  search:\n    size_limit: -1\n",
+		"ldap:\n  user:\n    filer: (uid=invalid)\n",
+	} {
+		writeConfig(content)
+		if err := reload(args, logger); err == nil {
+			t.Errorf("Expected error reloading %q", content)
+		}
+		if c := currentConfig(); c.UserFilter != "(uid=new)" || c.SearchSizeLimit != 0 {
+			t.Errorf("Expected previous config to be kept, filter: %s size limit: %d", c.UserFilter, c.SearchSizeLimit)
+		}
+		if val := testutil.ToFloat64(metrics.MetricConfigReloadSuccess); val != 0 {
+			t.Errorf("Unexpected reload success, got: %v", val)
+		}
+	}
+}
+
+func TestReloadFailedRun(t *testing.T) {
+	logger := promslog.NewNopLogger()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	writeConfig := func(name string, extra string) {
+		content := fmt.Sprintf("subid:\n  subuid: %s\n  subgid: %s\nmetrics:\n  path: %s\nldap:\n  user:\n    filter: %q\n%s",
+			filepath.Join(dir, name+".subuid"), filepath.Join(dir, name+".subgid"), filepath.Join(dir, name+".prom"), test.UserFilter, extra)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	writeConfig("old", "")
+	args := append([]string{"--config.file=" + path}, baseArgs...)
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfigFile(args); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	activeConfig.Store(getConfig())
+	defer func() {
+		activeConfig.Store(nil)
+		if _, err := kingpin.CommandLine.Parse(append([]string{"--metrics.path="}, baseArgs...)); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// The rejected configuration is parsed into the flags but must not be used by runs
+	writeConfig("new", "  search:\n    size_limit: -1\n")
+	if err := reload(args, logger); err == nil {
+		t.Fatalf("Expected error reloading invalid configuration")
+	}
+	if err := run(context.Background(), logger); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, name := range []string{"old.subuid", "old.subgid", "old.prom"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Expected %s to be written: %s", name, err)
+		}
+	}
+	for _, name := range []string{"new.subuid", "new.subgid", "new.prom"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			t.Errorf("Expected %s from the rejected configuration not to be written", name)
+		}
+	}
+}
+
+func TestReloadHandler(t *testing.T) {
+	handler := reloadHandler(promslog.NewNopLogger())
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/-/reload", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Unexpected status, got: %d", w.Code)
+	}
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	args := append([]string{"--api.token-file=" + tokenFile, "--api.read-only", "--metrics.path="}, baseArgs...)
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if _, err := kingpin.CommandLine.Parse(append([]string{"--api.token-file=", "--no-api.read-only"}, baseArgs...)); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	tests := map[string]int{
+		"":             http.StatusUnauthorized,
+		"Bearer wrong": http.StatusUnauthorized,
+		// Reloads are refused for a read-only API even with the token
+		"Bearer secret": http.StatusForbidden,
+	}
+	for authorization, code := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/-/reload", nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != code {
+			t.Errorf("Unexpected status with %q, got: %d", authorization, w.Code)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	localldap "github.com/treydock/subid-ldap/internal/ldap"
+	"github.com/treydock/subid-ldap/internal/metrics"
+)
+
+const (
+	syncRetryInterval = 30 * time.Second
+)
+
+var (
+	// syncRestart restarts the sync search so it uses a reloaded configuration
+	syncRestart   = make(chan struct{}, 1)
+	errSyncReload = errors.New("configuration reloaded")
+)
+
+// syncLoop follows LDAP changes and applies them to the subid files, reconnecting
+// after errors. The regular update interval continues to run as a full refresh.
+func syncLoop(ctx context.Context, syncMode string, delay time.Duration, logger *slog.Logger) {
+	syncLogger := logger.With("sync", syncMode)
+	for {
+		err := syncOnce(ctx, syncMode, delay, syncLogger)
+		metrics.MetricSyncConnected.Set(0)
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, errSyncReload) {
+			syncLogger.Info("Restarting LDAP sync with reloaded configuration")
+			continue
+		}
+		if err != nil {
+			syncLogger.Error("LDAP sync stopped", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(syncRetryInterval):
+		}
+	}
+}
+
+func syncOnce(ctx context.Context, syncMode string, delay time.Duration, logger *slog.Logger) error {
+	c := currentConfig()
+	l, err := localldap.LDAPConnect(c, logger)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	mode, err := localldap.LDAPSyncMode(l, syncMode, logger)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-syncRestart:
+			cancel(errSyncReload)
+		}
+	}()
+	users := &localldap.UserSet{}
+	changes := make(chan struct{}, 1)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-changes:
+			}
+			// Wait for further changes so a burst results in a single update
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			select {
+			case <-changes:
+			default:
+			}
+			syncUpdate(users.Keys(), logger)
+		}
+	}()
+	notify := func() {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	}
+	metrics.MetricSyncConnected.Set(1)
+	err = localldap.LDAPSync(ctx, l, c, mode, users, notify, logger)
+	if errors.Is(context.Cause(ctx), errSyncReload) {
+		return errSyncReload
+	}
+	return err
+}
+
+func syncUpdate(users []string, logger *slog.Logger) {
+	var err error
+	runLock.Lock()
+	defer runLock.Unlock()
+	defer metrics.Error()(&err)
+	logger.Debug("Applying LDAP sync changes", "count", len(users))
+	c := currentConfig()
+	start := time.Now()
+	for _, output := range c.OutputConfigs() {
+		if poolStart, ok := poolStarts[output.SubUIDPath]; ok {
+			output.SubIDStart = poolStart
+		}
+		if err = update(users, output, logger); err != nil {
+			logger.Error("Failed to apply LDAP sync changes", "err", err)
+			break
+		}
+	}
+	recordRun(runTypeSync, start, c, err, logger)
+}
@@ -0,0 +1,115 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/treydock/subid-ldap/internal/metrics"
+	"github.com/treydock/subid-ldap/internal/utils"
+)
+
+const (
+	version = 1
+	mode    = 0600
+)
+
+// Cache is the last successful user list, used to build the subid files when the
+// source is unavailable.
+type Cache struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	Sources []string  `json:"sources"`
+	// Signature identifies the source settings the users were read with
+	Signature string   `json:"signature"`
+	Users     []string `json:"users"`
+	MaxID     int      `json:"max_id"`
+	Checksum  string   `json:"checksum"`
+}
+
+func (c *Cache) checksum() string {
+	content := *c
+	content.Checksum = ""
+	data, _ := json.Marshal(content)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Save writes the users returned by the sources to the cache with the signature of the
+// source settings. The file is replaced atomically so a crash never leaves a partial cache.
+func Save(path string, sources []string, signature string, users []string, maxID int, logger *slog.Logger) error {
+	c := &Cache{
+		Version:   version,
+		Created:   time.Now().UTC(),
+		Sources:   sources,
+		Signature: signature,
+		Users:     users,
+		MaxID:     maxID,
+	}
+	c.Checksum = c.checksum()
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	err = utils.WriteFileAtomic(path, data, mode)
+	if err != nil {
+		logger.Error("Unable to write user cache", "path", path, "err", err)
+		return err
+	}
+	logger.Debug("Saved user cache", "path", path, "users", len(users))
+	metrics.MetricServedFromCache.Set(0)
+	metrics.MetricCacheTimestamp.Set(float64(c.Created.Unix()))
+	return nil
+}
+
+// Load reads the cache, which is only valid when the checksum matches, it was written
+// for the same sources and source settings and it is not older than maxAge. A maxAge of 0
+// disables the age check.
+func Load(path string, sources []string, signature string, maxAge time.Duration, logger *slog.Logger) (*Cache, error) {
+	var c Cache
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err = json.Unmarshal(data, &c); err != nil {
+			err = fmt.Errorf("invalid user cache %s: %w", path, err)
+		}
+	}
+	switch {
+	case err != nil:
+	case c.Version != version:
+		err = fmt.Errorf("user cache %s has unsupported version %d", path, c.Version)
+	case c.Checksum != c.checksum():
+		err = fmt.Errorf("user cache %s checksum does not match", path)
+	case !slices.Equal(c.Sources, sources):
+		err = fmt.Errorf("user cache %s was written for sources %v", path, c.Sources)
+	case c.Signature != signature:
+		err = fmt.Errorf("user cache %s was written with other source settings", path)
+	case maxAge > 0 && time.Since(c.Created) > maxAge:
+		err = fmt.Errorf("user cache %s from %s is older than %s", path, c.Created.Format(time.RFC3339), maxAge)
+	}
+	if err != nil {
+		logger.Error(err.Error())
+		metrics.MetricServedFromCache.Set(0)
+		return nil, err
+	}
+	metrics.MetricServedFromCache.Set(1)
+	metrics.MetricCacheTimestamp.Set(float64(c.Created.Unix()))
+	return &c, nil
+}
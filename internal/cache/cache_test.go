@@ -0,0 +1,113 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/promslog"
+	"github.com/treydock/subid-ldap/internal/metrics"
+)
+
+func TestSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	logger := promslog.NewNopLogger()
+	if err := Save(path, []string{"ldap"}, "signature", []string{"1000", "1001"}, 5000, logger); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if val := testutil.ToFloat64(metrics.MetricServedFromCache); val != 0 {
+		t.Errorf("Unexpected served from cache, got: %v", val)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if info.Mode().Perm() != mode {
+		t.Errorf("Unexpected mode, got: %v", info.Mode().Perm())
+	}
+	c, err := Load(path, []string{"ldap"}, "signature", time.Hour, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if strings.Join(c.Users, ",") != "1000,1001" || c.MaxID != 5000 {
+		t.Errorf("Unexpected cache, got: %+v", c)
+	}
+	if val := testutil.ToFloat64(metrics.MetricServedFromCache); val != 1 {
+		t.Errorf("Unexpected served from cache, got: %v", val)
+	}
+	if val := testutil.ToFloat64(metrics.MetricCacheTimestamp); int64(val) != c.Created.Unix() {
+		t.Errorf("Unexpected cache timestamp, got: %v", val)
+	}
+	if _, err := Load(path, []string{"ldap", "csv"}, "signature", time.Hour, logger); err == nil {
+		t.Errorf("Expected error loading cache of other sources")
+	}
+	if _, err := Load(path, []string{"ldap"}, "other", time.Hour, logger); err == nil {
+		t.Errorf("Expected error loading cache of other source settings")
+	}
+	if val := testutil.ToFloat64(metrics.MetricServedFromCache); val != 0 {
+		t.Errorf("Unexpected served from cache, got: %v", val)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	dir := t.TempDir()
+	logger := promslog.NewNopLogger()
+	write := func(c *Cache, checksum bool) string {
+		if checksum {
+			c.Checksum = c.checksum()
+		}
+		data, _ := json.Marshal(c)
+		path := filepath.Join(dir, "cache")
+		if err := os.WriteFile(path, data, mode); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		return path
+	}
+	valid := func() *Cache {
+		return &Cache{Version: version, Created: time.Now().UTC(), Sources: []string{"ldap"}, Signature: "signature", Users: []string{"1000"}}
+	}
+	old := valid()
+	old.Created = time.Now().Add(-2 * time.Hour)
+	tampered := valid()
+	tampered.Checksum = tampered.checksum()
+	tampered.Users = append(tampered.Users, "0")
+	unsupported := valid()
+	unsupported.Version = 2
+	for name, c := range map[string]*Cache{"old": old, "tampered": tampered, "unsupported": unsupported} {
+		path := write(c, name != "tampered")
+		if _, err := Load(path, []string{"ldap"}, "signature", time.Hour, logger); err == nil {
+			t.Errorf("Expected error loading %s cache", name)
+		}
+	}
+	if _, err := Load(write(old, true), []string{"ldap"}, "signature", 0, logger); err != nil {
+		t.Errorf("Unexpected error without max age: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "invalid"), []byte("{"), mode); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, path := range []string{filepath.Join(dir, "invalid"), filepath.Join(dir, "dne")} {
+		if _, err := Load(path, []string{"ldap"}, "signature", 0, logger); err == nil {
+			t.Errorf("Expected error loading %s", path)
+		}
+	}
+	if err := Save(filepath.Join(dir, "dne", "cache"), []string{"ldap"}, "signature", nil, 0, logger); err == nil {
+		t.Errorf("Expected error saving to missing directory")
+	}
+}
@@ -13,22 +13,181 @@
 
 package config
 
+import (
+	"time"
+)
+
 const (
 	AppName = "subid-ldap"
 )
 
 type Config struct {
-	LdapURL         string
-	LdapTLS         bool
-	LdapTLSVerify   bool
-	LdapTLSCACert   string
-	BindDN          string
-	BindPassword    string
-	UserBaseDN      string
-	UserFilter      string
-	UserUIDAttr     string
-	PagedSearch     bool
-	PagedSearchSize int
-	SubIDStart      int
-	SubIDRange      int
+	SubUIDPath             string
+	SubGIDPath             string
+	RunTimeout             time.Duration
+	Daemon                 bool
+	DaemonUpdateInterval   time.Duration
+	DaemonSync             string
+	DaemonSyncDelay        time.Duration
+	ListenAddress          string
+	MetricsPath            string
+	APITokenFile           string
+	APIReadOnly            bool
+	SocketPath             string
+	SocketAllowedUIDs      []string
+	UserSources            []string
+	SourceCombine          string
+	LDIFFile               string
+	PasswdFile             string
+	JSONFile               string
+	CSVFile                string
+	SCIMURL                string
+	SCIMToken              string
+	SCIMTokenFile          string
+	SCIMKeyAttr            string
+	SCIMPageSize           int
+	SCIMTimeout            time.Duration
+	CachePath              string
+	CacheMaxAge            time.Duration
+	LdapURL                string
+	LdapTLS                bool
+	LdapTLSVerify          bool
+	LdapTLSCACert          string
+	LdapTLSCAFile          string
+	LdapTLSCADir           string
+	LdapTLSMinVersion      string
+	LdapTLSCipherSuites    []string
+	LdapTLSServerName      string
+	LdapTLSPinSHA256       []string
+	LdapKeepAlive          time.Duration
+	LdapPersistent         bool
+	LdapIdleTimeout        time.Duration
+	BindDN                 string
+	BindPassword           string
+	BindPasswordFile       string
+	BindPasswordCredential string
+	BindPasswordCommand    string
+	UserBaseDN             string
+	UserFilter             string
+	UserUIDAttr            string
+	UserKeyMode            string
+	UserKeyTransforms      []string
+	SIDRangeMin            int
+	SIDRangeMax            int
+	SIDRangeSize           int
+	SIDAutoridCompat       bool
+	SIDDefaultDomainSID    string
+	UserScope              string
+	UserDerefAliases       string
+	SearchSizeLimit        int
+	SearchTimeLimit        time.Duration
+	SearchSort             string
+	MinUID                 int
+	MaxUID                 int
+	IncludeUsersFile       string
+	ExcludeUsersFile       string
+	AccountState           string
+	AccountStateGrace      time.Duration
+	AccountStateFile       string
+	LdapIncremental        string
+	LdapIncrementalFull    time.Duration
+	LdapAutoDetect         bool
+	PagedSearch            bool
+	PagedSearchSize        int
+	SubIDStart             int
+	SubIDRange             int
+	SubIDStartAlign        int
+	SubIDSource            string
+	SubIDBaseDN            string
+	SubIDFilter            string
+	SubIDOwnerAttr         string
+	SubUIDStartAttr        string
+	SubUIDCountAttr        string
+	SubGIDStartAttr        string
+	SubGIDCountAttr        string
+	SubIDAllocate          bool
+	SubIDLedgerDN          string
+	SubIDLedgerAttr        string
+	OverlapCheck           string
+	OverlapBaseDN          string
+	OverlapHeadroom        int
+	// Searches replace the user search, the users of every search are merged
+	Searches []Search
+	// Pools are subid ranges used by Outputs
+	Pools []Pool
+	// Outputs replace the subuid and subgid files, each pair is written from its pool
+	Outputs []Output
+}
+
+// Search is a user search, the filter and scope default to the user filter and scope.
+type Search struct {
+	BaseDN string `yaml:"base_dn"`
+	Filter string `yaml:"filter"`
+	Scope  string `yaml:"scope"`
+}
+
+// Pool is a named subid range, the start alignment defaults to the subid start alignment.
+type Pool struct {
+	Name       string `yaml:"name"`
+	Start      int    `yaml:"start"`
+	Range      int    `yaml:"range"`
+	StartAlign int    `yaml:"start_align"`
+}
+
+// Output is a pair of subuid and subgid files with ranges from the named pool,
+// or from the subid start and range when no pool is named.
+type Output struct {
+	SubUID string `yaml:"subuid"`
+	SubGID string `yaml:"subgid"`
+	Pool   string `yaml:"pool"`
+}
+
+// UserSearches returns a copy of the configuration for each of the searches with the search
+// base DN, filter and scope as the user search, or a single copy without searches.
+func (c *Config) UserSearches() []*Config {
+	if len(c.Searches) == 0 {
+		copied := *c
+		return []*Config{&copied}
+	}
+	configs := make([]*Config, 0, len(c.Searches))
+	for _, search := range c.Searches {
+		searchConfig := *c
+		searchConfig.Searches = nil
+		searchConfig.UserBaseDN = search.BaseDN
+		if search.Filter != "" {
+			searchConfig.UserFilter = search.Filter
+		}
+		if search.Scope != "" {
+			searchConfig.UserScope = search.Scope
+		}
+		configs = append(configs, &searchConfig)
+	}
+	return configs
+}
+
+// OutputConfigs returns a copy of the configuration for each of the outputs with the subid
+// files of the output and the range of its pool, or a single copy without outputs.
+func (c *Config) OutputConfigs() []*Config {
+	if len(c.Outputs) == 0 {
+		copied := *c
+		return []*Config{&copied}
+	}
+	configs := make([]*Config, 0, len(c.Outputs))
+	for _, output := range c.Outputs {
+		outputConfig := *c
+		outputConfig.SubUIDPath = output.SubUID
+		outputConfig.SubGIDPath = output.SubGID
+		for _, pool := range c.Pools {
+			if pool.Name != output.Pool {
+				continue
+			}
+			outputConfig.SubIDStart = pool.Start
+			outputConfig.SubIDRange = pool.Range
+			if pool.StartAlign > 0 {
+				outputConfig.SubIDStartAlign = pool.StartAlign
+			}
+		}
+		configs = append(configs, &outputConfig)
+	}
+	return configs
 }
@@ -0,0 +1,62 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package config
+
+import (
+	"testing"
+)
+
+func TestUserSearches(t *testing.T) {
+	c := &Config{UserBaseDN: "ou=People,dc=test", UserFilter: "(objectClass=posixAccount)", UserScope: "sub"}
+	searches := c.UserSearches()
+	if len(searches) != 1 || searches[0] == c || searches[0].UserBaseDN != c.UserBaseDN {
+		t.Errorf("Expected a copy of the user search, got: %v", searches)
+	}
+	c.Searches = []Search{
+		{BaseDN: "ou=Staff,dc=test"},
+		{BaseDN: "ou=Students,dc=test", Filter: "(status=active)", Scope: "one"},
+	}
+	searches = c.UserSearches()
+	if len(searches) != 2 {
+		t.Fatalf("Unexpected searches, got: %v", searches)
+	}
+	if s := searches[0]; s.UserBaseDN != "ou=Staff,dc=test" || s.UserFilter != c.UserFilter || s.UserScope != "sub" || s.Searches != nil {
+		t.Errorf("Unexpected first search, got: %s %s %s", s.UserBaseDN, s.UserFilter, s.UserScope)
+	}
+	if s := searches[1]; s.UserBaseDN != "ou=Students,dc=test" || s.UserFilter != "(status=active)" || s.UserScope != "one" {
+		t.Errorf("Unexpected second search, got: %s %s %s", s.UserBaseDN, s.UserFilter, s.UserScope)
+	}
+}
+
+func TestOutputConfigs(t *testing.T) {
+	c := &Config{SubUIDPath: "/etc/subuid", SubGIDPath: "/etc/subgid", SubIDStart: 65537, SubIDRange: 65536, SubIDStartAlign: 1}
+	outputs := c.OutputConfigs()
+	if len(outputs) != 1 || outputs[0] == c || outputs[0].SubUIDPath != "/etc/subuid" {
+		t.Errorf("Expected a copy of the configuration, got: %v", outputs)
+	}
+	c.Pools = []Pool{{Name: "compute", Start: 1000000, Range: 100000, StartAlign: 65536}}
+	c.Outputs = []Output{
+		{SubUID: "/srv/a/subuid", SubGID: "/srv/a/subgid"},
+		{SubUID: "/srv/b/subuid", SubGID: "/srv/b/subgid", Pool: "compute"},
+	}
+	outputs = c.OutputConfigs()
+	if len(outputs) != 2 {
+		t.Fatalf("Unexpected outputs, got: %v", outputs)
+	}
+	if o := outputs[0]; o.SubUIDPath != "/srv/a/subuid" || o.SubGIDPath != "/srv/a/subgid" || o.SubIDStart != 65537 || o.SubIDRange != 65536 {
+		t.Errorf("Unexpected first output, got: %s %s %d %d", o.SubUIDPath, o.SubGIDPath, o.SubIDStart, o.SubIDRange)
+	}
+	if o := outputs[1]; o.SubUIDPath != "/srv/b/subuid" || o.SubIDStart != 1000000 || o.SubIDRange != 100000 || o.SubIDStartAlign != 65536 {
+		t.Errorf("Unexpected second output, got: %s %d %d %d", o.SubUIDPath, o.SubIDStart, o.SubIDRange, o.SubIDStartAlign)
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// File is the YAML configuration file. Every setting corresponds to the command line
+// flag named by its flag tag, lists of a flag tagged comma are joined into one value
+// while other lists repeat the flag. The searches, pools and outputs have no flags.
+type File struct {
+	Sources  *FileSources `yaml:"sources"`
+	LDAP     *FileLDAP    `yaml:"ldap"`
+	SubID    *FileSubID   `yaml:"subid"`
+	Cache    *FileCache   `yaml:"cache"`
+	Run      *FileRun     `yaml:"run"`
+	Daemon   *FileDaemon  `yaml:"daemon"`
+	Metrics  *FileMetrics `yaml:"metrics"`
+	API      *FileAPI     `yaml:"api"`
+	Socket   *FileSocket  `yaml:"socket"`
+	Log      *FileLog     `yaml:"log"`
+	Searches []Search     `yaml:"searches"`
+	Pools    []Pool       `yaml:"pools"`
+	Outputs  []Output     `yaml:"outputs"`
+}
+
+type FileSources struct {
+	Names   []string    `yaml:"names" flag:"source,comma"`
+	Combine *string     `yaml:"combine" flag:"source.combine"`
+	LDIF    *FileSource `yaml:"ldif"`
+	Passwd  *FileSource `yaml:"passwd"`
+	JSON    *FileSource `yaml:"json"`
+	CSV     *FileSource `yaml:"csv"`
+	SCIM    *FileSCIM   `yaml:"scim"`
+}
+
+// FileSource is a file based user source, the flag is the source name followed by .file.
+type FileSource struct {
+	File *string `yaml:"file" flag:".file"`
+}
+
+type FileSCIM struct {
+	URL       *string `yaml:"url" flag:"scim.url"`
+	Token     *string `yaml:"token" flag:"scim.token"`
+	TokenFile *string `yaml:"token_file" flag:"scim.token-file"`
+	KeyAttr   *string `yaml:"key_attr" flag:"scim.key-attr"`
+	PageSize  *string `yaml:"page_size" flag:"scim.page-size"`
+	Timeout   *string `yaml:"timeout" flag:"scim.timeout"`
+}
+
+type FileLDAP struct {
+	URL        *string             `yaml:"url" flag:"ldap.url"`
+	TLS        *FileLDAPTLS        `yaml:"tls"`
+	Bind       *FileLDAPBind       `yaml:"bind"`
+	User       *FileLDAPUser       `yaml:"user"`
+	IDMap      *FileLDAPIDMap      `yaml:"idmap"`
+	Search     *FileLDAPSearch     `yaml:"search"`
+	Connection *FileLDAPConnection `yaml:"connection"`
+}
+
+type FileLDAPTLS struct {
+	Enabled      *string  `yaml:"enabled" flag:"ldap.tls"`
+	Verify       *string  `yaml:"verify" flag:"ldap.tls-verify"`
+	CACert       *string  `yaml:"ca_cert" flag:"ldap.tls-ca-cert"`
+	CAFile       *string  `yaml:"ca_file" flag:"ldap.tls-ca-file"`
+	CADir        *string  `yaml:"ca_dir" flag:"ldap.tls-ca-dir"`
+	MinVersion   *string  `yaml:"min_version" flag:"ldap.tls-min-version"`
+	CipherSuites []string `yaml:"cipher_suites" flag:"ldap.tls-cipher-suites,comma"`
+	ServerName   *string  `yaml:"server_name" flag:"ldap.tls-server-name"`
+	PinSHA256    []string `yaml:"pin_sha256" flag:"ldap.tls-pin-sha256,comma"`
+}
+
+type FileLDAPBind struct {
+	DN                 *string `yaml:"dn" flag:"ldap.bind-dn"`
+	Password           *string `yaml:"password" flag:"ldap.bind-password"`
+	PasswordFile       *string `yaml:"password_file" flag:"ldap.bind-password-file"`
+	PasswordCredential *string `yaml:"password_credential" flag:"ldap.bind-password-credential"`
+	PasswordCommand    *string `yaml:"password_command" flag:"ldap.bind-password-command"`
+}
+
+type FileLDAPUser struct {
+	BaseDN            *string  `yaml:"base_dn" flag:"ldap.user-base-dn"`
+	Filter            *string  `yaml:"filter" flag:"ldap.user-filter"`
+	UIDAttr           *string  `yaml:"uid_attr" flag:"ldap.user-uid-attr"`
+	KeyMode           *string  `yaml:"key_mode" flag:"ldap.user-key-mode"`
+	KeyTransforms     []string `yaml:"key_transforms" flag:"ldap.user-key-transform"`
+	Scope             *string  `yaml:"scope" flag:"ldap.user-scope"`
+	Deref             *string  `yaml:"deref" flag:"ldap.user-deref"`
+	MinUID            *string  `yaml:"min_uid" flag:"ldap.min-uid"`
+	MaxUID            *string  `yaml:"max_uid" flag:"ldap.max-uid"`
+	IncludeUsersFile  *string  `yaml:"include_users_file" flag:"ldap.include-users-file"`
+	ExcludeUsersFile  *string  `yaml:"exclude_users_file" flag:"ldap.exclude-users-file"`
+	AccountState      *string  `yaml:"account_state" flag:"ldap.account-state"`
+	AccountStateGrace *string  `yaml:"account_state_grace" flag:"ldap.account-state-grace"`
+	AccountStateFile  *string  `yaml:"account_state_file" flag:"ldap.account-state-file"`
+}
+
+type FileLDAPIDMap struct {
+	RangeMin         *string `yaml:"range_min" flag:"ldap.idmap-range-min"`
+	RangeMax         *string `yaml:"range_max" flag:"ldap.idmap-range-max"`
+	RangeSize        *string `yaml:"range_size" flag:"ldap.idmap-range-size"`
+	DefaultDomainSID *string `yaml:"default_domain_sid" flag:"ldap.idmap-default-domain-sid"`
+	AutoridCompat    *string `yaml:"autorid_compat" flag:"ldap.idmap-autorid-compat"`
+}
+
+type FileLDAPSearch struct {
+	SizeLimit               *string `yaml:"size_limit" flag:"ldap.size-limit"`
+	TimeLimit               *string `yaml:"time_limit" flag:"ldap.time-limit"`
+	Sort                    *string `yaml:"sort" flag:"ldap.sort"`
+	AutoDetect              *string `yaml:"auto_detect" flag:"ldap.auto-detect"`
+	Paged                   *string `yaml:"paged" flag:"ldap.paged-search"`
+	PagedSize               *string `yaml:"paged_size" flag:"ldap.paged-search-size"`
+	Incremental             *string `yaml:"incremental" flag:"ldap.incremental"`
+	IncrementalFullInterval *string `yaml:"incremental_full_interval" flag:"ldap.incremental-full-interval"`
+}
+
+type FileLDAPConnection struct {
+	Persistent  *string `yaml:"persistent" flag:"ldap.persistent"`
+	KeepAlive   *string `yaml:"keepalive" flag:"ldap.keepalive"`
+	IdleTimeout *string `yaml:"idle_timeout" flag:"ldap.idle-timeout"`
+}
+
+type FileSubID struct {
+	SubUID     *string           `yaml:"subuid" flag:"subid.subuid"`
+	SubGID     *string           `yaml:"subgid" flag:"subid.subgid"`
+	Start      *string           `yaml:"start" flag:"subid.start"`
+	Range      *string           `yaml:"range" flag:"subid.range"`
+	StartAlign *string           `yaml:"start_align" flag:"subid.start-align"`
+	Source     *string           `yaml:"source" flag:"subid.source"`
+	LDAP       *FileSubIDLDAP    `yaml:"ldap"`
+	Overlap    *FileSubIDOverlap `yaml:"overlap"`
+}
+
+type FileSubIDLDAP struct {
+	BaseDN          *string `yaml:"base_dn" flag:"subid.ldap-base-dn"`
+	Filter          *string `yaml:"filter" flag:"subid.ldap-filter"`
+	OwnerAttr       *string `yaml:"owner_attr" flag:"subid.ldap-owner-attr"`
+	SubUIDStartAttr *string `yaml:"subuid_start_attr" flag:"subid.ldap-subuid-start-attr"`
+	SubUIDCountAttr *string `yaml:"subuid_count_attr" flag:"subid.ldap-subuid-count-attr"`
+	SubGIDStartAttr *string `yaml:"subgid_start_attr" flag:"subid.ldap-subgid-start-attr"`
+	SubGIDCountAttr *string `yaml:"subgid_count_attr" flag:"subid.ldap-subgid-count-attr"`
+	Allocate        *string `yaml:"allocate" flag:"subid.ldap-allocate"`
+	LedgerDN        *string `yaml:"ledger_dn" flag:"subid.ldap-ledger-dn"`
+	LedgerAttr      *string `yaml:"ledger_attr" flag:"subid.ldap-ledger-attr"`
+}
+
+type FileSubIDOverlap struct {
+	Check    *string `yaml:"check" flag:"subid.overlap-check"`
+	BaseDN   *string `yaml:"base_dn" flag:"subid.overlap-base-dn"`
+	Headroom *string `yaml:"headroom" flag:"subid.overlap-headroom"`
+}
+
+type FileCache struct {
+	Path   *string `yaml:"path" flag:"cache.path"`
+	MaxAge *string `yaml:"max_age" flag:"cache.max-age"`
+}
+
+type FileRun struct {
+	Timeout *string `yaml:"timeout" flag:"run.timeout"`
+}
+
+type FileDaemon struct {
+	Enabled        *string `yaml:"enabled" flag:"daemon"`
+	UpdateInterval *string `yaml:"update_interval" flag:"daemon.update-interval"`
+	Sync           *string `yaml:"sync" flag:"daemon.sync"`
+	SyncDelay      *string `yaml:"sync_delay" flag:"daemon.sync-delay"`
+}
+
+type FileMetrics struct {
+	ListenAddress *string `yaml:"listen_address" flag:"metrics.listen-address"`
+	Path          *string `yaml:"path" flag:"metrics.path"`
+}
+
+type FileAPI struct {
+	TokenFile *string `yaml:"token_file" flag:"api.token-file"`
+	ReadOnly  *string `yaml:"read_only" flag:"api.read-only"`
+}
+
+type FileSocket struct {
+	Path        *string  `yaml:"path" flag:"socket.path"`
+	AllowedUIDs []string `yaml:"allowed_uids" flag:"socket.allowed-uids,comma"`
+}
+
+type FileLog struct {
+	Level  *string `yaml:"level" flag:"log.level"`
+	Format *string `yaml:"format" flag:"log.format"`
+}
+
+// FileValue is a flag value set by the configuration file.
+type FileValue struct {
+	// Key is the dotted path of the setting in the file
+	Key    string
+	Flag   string
+	Values []string
+}
+
+// LoadFile reads the YAML configuration file, rejecting unknown keys.
+func LoadFile(path string) (*File, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseFile(content)
+}
+
+func ParseFile(content []byte) (*File, error) {
+	file := &File{}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(file); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	var extra interface{}
+	if err := decoder.Decode(&extra); !errors.Is(err, io.EOF) {
+		return nil, errors.New("configuration file must contain a single YAML document")
+	}
+	return file, nil
+}
+
+// Values returns the flag values of every setting in the file.
+func (f *File) Values() []FileValue {
+	values := []FileValue{}
+	fileValues(reflect.ValueOf(f).Elem(), "", "", &values)
+	return values
+}
+
+func fileValues(v reflect.Value, key string, flagPrefix string, values *[]FileValue) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		value := v.Field(i)
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		fieldKey := name
+		if key != "" {
+			fieldKey = key + "." + name
+		}
+		flag, option, _ := strings.Cut(field.Tag.Get("flag"), ",")
+		if strings.HasPrefix(flag, ".") {
+			flag = flagPrefix + flag
+		}
+		switch {
+		case value.IsNil() || field.Tag.Get("flag") == "" && value.Kind() == reflect.Slice:
+			continue
+		case value.Kind() == reflect.Slice && option == "comma":
+			*values = append(*values, FileValue{Key: fieldKey, Flag: flag, Values: []string{strings.Join(value.Interface().([]string), ",")}})
+		case value.Kind() == reflect.Slice:
+			*values = append(*values, FileValue{Key: fieldKey, Flag: flag, Values: value.Interface().([]string)})
+		case value.Elem().Kind() == reflect.Struct:
+			fileValues(value.Elem(), fieldKey, name, values)
+		default:
+			*values = append(*values, FileValue{Key: fieldKey, Flag: flag, Values: []string{value.Elem().String()}})
+		}
+	}
+}
+
+// String describes where a setting is in the file for errors.
+func (v FileValue) String() string {
+	return fmt.Sprintf("%s (--%s)", v.Key, v.Flag)
+}
@@ -0,0 +1,143 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLoadFile(t *testing.T) {
+	content := `
+sources:
+  names: [ldap, passwd]
+  passwd:
+    file: /etc/passwd
+ldap:
+  url: ldap://ldap.example.com
+  tls:
+    enabled: true
+    cipher_suites:
+      - TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+      - TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384
+  user:
+    base_dn: ou=People,dc=example,dc=com
+    key_transforms: [lowercase, strip-realm]
+    min_uid: 1000
+daemon:
+  enabled: true
+  update_interval: 10m
+`
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	file, err := LoadFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	values := make(map[string][]string)
+	for _, value := range file.Values() {
+		values[value.Flag] = value.Values
+	}
+	expected := map[string][]string{
+		"source":                  {"ldap,passwd"},
+		"passwd.file":             {"/etc/passwd"},
+		"ldap.url":                {"ldap://ldap.example.com"},
+		"ldap.tls":                {"true"},
+		"ldap.tls-cipher-suites":  {"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"},
+		"ldap.user-base-dn":       {"ou=People,dc=example,dc=com"},
+		"ldap.user-key-transform": {"lowercase", "strip-realm"},
+		"ldap.min-uid":            {"1000"},
+		"daemon":                  {"true"},
+		"daemon.update-interval":  {"10m"},
+	}
+	if len(values) != len(expected) {
+		t.Errorf("Unexpected values, got: %v", values)
+	}
+	for flag, v := range expected {
+		if !slices.Equal(values[flag], v) {
+			t.Errorf("Unexpected value for %s, got: %v expected: %v", flag, values[flag], v)
+		}
+	}
+}
+
+func TestParseFileErrors(t *testing.T) {
+	tests := []struct {
+		content string
+		err     string
+	}{
+		{"ldap:\n  uri: ldap://ldap.example.com\n", "field uri not found"},
+		{"ldap:\n  user:\n    key_transforms: lowercase\n", "cannot unmarshal"},
+		{"ldap:\n  url: ldap://a\n---\nldap:\n  url: ldap://b\n", "single YAML document"},
+		{"searches:\n  - base: ou=People,dc=example,dc=com\n", "field base not found"},
+		{"pools:\n  - name: a\n    start: first\n", "cannot unmarshal"},
+		{"outputs:\n  subuid: /etc/subuid\n", "cannot unmarshal"},
+	}
+	for _, tt := range tests {
+		_, err := ParseFile([]byte(tt.content))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Expected error containing %q, got: %v", tt.err, err)
+		}
+	}
+	if file, err := ParseFile(nil); err != nil || len(file.Values()) != 0 {
+		t.Errorf("Unexpected result for empty file, got: %v %v", file, err)
+	}
+}
+
+func TestParseFileLists(t *testing.T) {
+	content := `
+ldap:
+  user:
+    filter: (objectClass=posixAccount)
+searches:
+  - base_dn: ou=Staff,dc=example,dc=com
+  - base_dn: ou=Students,dc=example,dc=com
+    filter: (&(objectClass=posixAccount)(status=active))
+    scope: one
+pools:
+  - name: compute
+    start: 100000
+    range: 65536
+outputs:
+  - subuid: /etc/subuid
+    subgid: /etc/subgid
+  - subuid: /srv/compute/subuid
+    subgid: /srv/compute/subgid
+    pool: compute
+`
+	file, err := ParseFile([]byte(content))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	searches := []Search{
+		{BaseDN: "ou=Staff,dc=example,dc=com"},
+		{BaseDN: "ou=Students,dc=example,dc=com", Filter: "(&(objectClass=posixAccount)(status=active))", Scope: "one"},
+	}
+	if !slices.Equal(file.Searches, searches) {
+		t.Errorf("Unexpected searches, got: %v", file.Searches)
+	}
+	if !slices.Equal(file.Pools, []Pool{{Name: "compute", Start: 100000, Range: 65536}}) {
+		t.Errorf("Unexpected pools, got: %v", file.Pools)
+	}
+	if len(file.Outputs) != 2 || file.Outputs[1] != (Output{SubUID: "/srv/compute/subuid", SubGID: "/srv/compute/subgid", Pool: "compute"}) {
+		t.Errorf("Unexpected outputs, got: %v", file.Outputs)
+	}
+	// The lists have no flags
+	if values := file.Values(); len(values) != 1 || values[0].Flag != "ldap.user-filter" {
+		t.Errorf("Unexpected values, got: %v", values)
+	}
+}
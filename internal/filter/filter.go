@@ -0,0 +1,123 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/treydock/subid-ldap/internal/config"
+	"github.com/treydock/subid-ldap/internal/metrics"
+)
+
+const (
+	ReasonMinUID      = "min_uid"
+	ReasonMaxUID      = "max_uid"
+	ReasonExcludeList = "exclude_list"
+)
+
+// Filter removes users that should not be allocated subids. Users in the exclude list are
+// always removed, users in the include list are kept even when outside the UID range.
+type Filter struct {
+	MinUID  int
+	MaxUID  int
+	Include map[string]bool
+	Exclude map[string]bool
+}
+
+// Load reads the include and exclude lists, the lists are read on every run so changes
+// apply without a restart.
+func Load(config *config.Config) (*Filter, error) {
+	f := &Filter{
+		MinUID: config.MinUID,
+		MaxUID: config.MaxUID,
+	}
+	var err error
+	if config.IncludeUsersFile != "" {
+		f.Include, err = loadList(config.IncludeUsersFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.ExcludeUsersFile != "" {
+		f.Exclude, err = loadList(config.ExcludeUsersFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// loadList reads one user per line ignoring blank lines and # comments.
+func loadList(path string) (map[string]bool, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read user list: %w", err)
+	}
+	users := make(map[string]bool)
+	for _, line := range strings.Split(string(content), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		users[line] = true
+	}
+	return users, nil
+}
+
+// Apply returns the users that pass the filter and sets the excluded users metric.
+func (f *Filter) Apply(users []string, logger *slog.Logger) []string {
+	for _, reason := range []string{ReasonMinUID, ReasonMaxUID, ReasonExcludeList} {
+		metrics.MetricUsersExcluded.WithLabelValues(reason).Set(0)
+	}
+	filtered := make([]string, 0, len(users))
+	for _, user := range users {
+		if reason := f.excluded(user); reason != "" {
+			logger.Debug("Excluding user", "user", user, "reason", reason)
+			metrics.MetricUsersExcluded.WithLabelValues(reason).Inc()
+			continue
+		}
+		filtered = append(filtered, user)
+	}
+	return filtered
+}
+
+// excluded returns why the user is excluded or an empty string when the user is kept.
+func (f *Filter) excluded(user string) string {
+	if f.Exclude[user] {
+		return ReasonExcludeList
+	}
+	if f.Include[user] {
+		return ""
+	}
+	// Configurations where the keys are not UIDs are rejected, a key that is not a number
+	// is an invalid attribute value so it is left to the subid files to report
+	uid, err := strconv.Atoi(user)
+	if err != nil {
+		return ""
+	}
+	if f.MinUID > 0 && uid < f.MinUID {
+		return ReasonMinUID
+	}
+	if f.MaxUID > 0 && uid > f.MaxUID {
+		return ReasonMaxUID
+	}
+	return ""
+}
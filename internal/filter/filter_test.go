@@ -0,0 +1,82 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/promslog"
+	"github.com/treydock/subid-ldap/internal/config"
+	"github.com/treydock/subid-ldap/internal/metrics"
+)
+
+func TestFilter(t *testing.T) {
+	dir := t.TempDir()
+	include := filepath.Join(dir, "include")
+	exclude := filepath.Join(dir, "exclude")
+	if err := os.WriteFile(include, []byte("# service account with containers\n500\n\n70000 # temporary\n"), 0644); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := os.WriteFile(exclude, []byte("1002\n500\n"), 0644); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	c := &config.Config{
+		MinUID:           1000,
+		MaxUID:           60000,
+		IncludeUsersFile: include,
+		ExcludeUsersFile: exclude,
+	}
+	f, err := Load(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	users := f.Apply([]string{"0", "500", "999", "1000", "1001", "1002", "60000", "60001", "70000", "user"}, promslog.NewNopLogger())
+	expected := []string{"1000", "1001", "60000", "70000", "user"}
+	if !reflect.DeepEqual(users, expected) {
+		t.Errorf("Unexpected users, got: %v", users)
+	}
+	expectedMetrics := `
+	# HELP subid_ldap_users_excluded Number of users excluded from subid allocation during the last update
+	# TYPE subid_ldap_users_excluded gauge
+	subid_ldap_users_excluded{reason="exclude_list"} 2
+	subid_ldap_users_excluded{reason="max_uid"} 1
+	subid_ldap_users_excluded{reason="min_uid"} 2
+	`
+	if err := testutil.CollectAndCompare(metrics.MetricUsersExcluded, strings.NewReader(expectedMetrics)); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestFilterDisabled(t *testing.T) {
+	f, err := Load(&config.Config{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	users := []string{"0", "1000", "4294967295"}
+	if filtered := f.Apply(users, promslog.NewNopLogger()); !reflect.DeepEqual(filtered, users) {
+		t.Errorf("Unexpected users, got: %v", filtered)
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	_, err := Load(&config.Config{ExcludeUsersFile: filepath.Join(t.TempDir(), "missing")})
+	if err == nil {
+		t.Errorf("Expected an error with missing exclude file")
+	}
+}
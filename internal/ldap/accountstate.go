@@ -0,0 +1,278 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldap
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/treydock/subid-ldap/internal/config"
+	"github.com/treydock/subid-ldap/internal/utils"
+)
+
+const (
+	AccountStateOff     = "off"
+	AccountStateExclude = "exclude"
+	AccountStateGrace   = "grace"
+
+	AccountReasonDisabled = "disabled"
+	AccountReasonLocked   = "locked"
+	AccountReasonExpired  = "expired"
+
+	// userAccountControl ACCOUNTDISABLE flag
+	adAccountDisable = 0x2
+	// accountExpires values that mean the account never expires
+	adNeverExpires = 9223372036854775807
+	// Number of 100 nanosecond intervals between 1601-01-01 and 1970-01-01
+	adEpochOffset = 116444736000000000
+	// pwdAccountLockedTime value of an account locked until an administrator unlocks it
+	ppolicyPermanentLock = "000001010000Z"
+
+	inactiveStateVersion = 1
+	inactiveStateMode    = 0600
+	// Accounts not returned by a search for this long are forgotten
+	inactiveRetention = 30 * 24 * time.Hour
+)
+
+var (
+	AccountStateModes = []string{AccountStateOff, AccountStateExclude, AccountStateGrace}
+	accountStateAttrs = []string{
+		"userAccountControl", "accountExpires", "whenChanged",
+		"nsAccountLock", "pwdAccountLockedTime", "modifyTimestamp",
+		"shadowExpire",
+	}
+)
+
+// AccountState is the result of evaluating the account state attributes of an entry.
+type AccountState struct {
+	Active bool
+	// Reason is why the account is inactive, one of disabled, locked or expired
+	Reason string
+	// Since is when the account became inactive, zero when it is not known
+	Since time.Time
+}
+
+// EntryAccountState evaluates Active Directory userAccountControl and accountExpires,
+// 389-DS and OpenLDAP nsAccountLock and pwdAccountLockedTime and RFC2307 shadowExpire.
+// When the account is inactive for several reasons the earliest is returned.
+func EntryAccountState(entry *ldap.Entry, now time.Time) AccountState {
+	state := AccountState{Active: true}
+	inactive := func(reason string, since time.Time) {
+		if state.Active || (!since.IsZero() && (state.Since.IsZero() || since.Before(state.Since))) {
+			state.Reason = reason
+			state.Since = since
+		}
+		state.Active = false
+	}
+	// Disabling or locking an account modifies the entry so use the modification time
+	// when the attribute does not record when it happened
+	changed := generalizedTime(entry.GetEqualFoldAttributeValue("whenChanged"))
+	if changed.IsZero() {
+		changed = generalizedTime(entry.GetEqualFoldAttributeValue("modifyTimestamp"))
+	}
+	if value := entry.GetEqualFoldAttributeValue("userAccountControl"); value != "" {
+		if flags, err := strconv.ParseInt(value, 10, 64); err == nil && flags&adAccountDisable != 0 {
+			inactive(AccountReasonDisabled, changed)
+		}
+	}
+	if value := entry.GetEqualFoldAttributeValue("accountExpires"); value != "" {
+		if expires, err := strconv.ParseInt(value, 10, 64); err == nil && expires > 0 && expires != adNeverExpires {
+			intervals := expires - adEpochOffset
+			expiry := time.Unix(intervals/10000000, (intervals%10000000)*100)
+			if !now.Before(expiry) {
+				inactive(AccountReasonExpired, expiry)
+			}
+		}
+	}
+	if strings.EqualFold(entry.GetEqualFoldAttributeValue("nsAccountLock"), "true") {
+		inactive(AccountReasonDisabled, changed)
+	}
+	if value := entry.GetEqualFoldAttributeValue("pwdAccountLockedTime"); value != "" {
+		since := changed
+		if value != ppolicyPermanentLock {
+			since = generalizedTime(value)
+		}
+		inactive(AccountReasonLocked, since)
+	}
+	if value := entry.GetEqualFoldAttributeValue("shadowExpire"); value != "" {
+		if days, err := strconv.ParseInt(value, 10, 64); err == nil && days >= 0 {
+			expiry := time.Unix(days*24*60*60, 0)
+			if !now.Before(expiry) {
+				inactive(AccountReasonExpired, expiry)
+			}
+		}
+	}
+	return state
+}
+
+func accountStateEnabled(config *config.Config) bool {
+	return config.AccountState != "" && config.AccountState != AccountStateOff
+}
+
+// activeUserKey returns the user key when the account should have subids at now along
+// with when a user in the grace period loses them. An empty key means the user is removed.
+// The grace period starts when the account was first seen inactive by seen.
+func activeUserKey(entry *ldap.Entry, config *config.Config, seen *InactiveAccounts, now time.Time) (string, AccountState, time.Time) {
+	key := userKey(entry, config)
+	if !accountStateEnabled(config) {
+		return key, AccountState{Active: true}, time.Time{}
+	}
+	state := seen.Observe(entry.DN, EntryAccountState(entry, now), now)
+	if state.Active {
+		return key, state, time.Time{}
+	}
+	if config.AccountState != AccountStateGrace {
+		return "", state, time.Time{}
+	}
+	until := state.Since.Add(config.AccountStateGrace)
+	if !now.Before(until) {
+		return "", state, time.Time{}
+	}
+	return key, state, until
+}
+
+// InactiveAccounts records when each account was first seen inactive so later changes to a
+// disabled entry, which update whenChanged and modifyTimestamp, do not restart its grace period.
+// The record is kept in memory and saved to a file when a path is set.
+type InactiveAccounts struct {
+	mu       sync.Mutex
+	path     string
+	loaded   bool
+	dirty    bool
+	accounts map[string]inactiveAccount
+}
+
+type inactiveAccount struct {
+	Since time.Time `json:"since"`
+	Seen  time.Time `json:"seen"`
+}
+
+type inactiveState struct {
+	Version  int                        `json:"version"`
+	Accounts map[string]inactiveAccount `json:"accounts"`
+}
+
+// inactiveAccounts is shared by searches so the record survives between daemon runs
+var inactiveAccounts = &InactiveAccounts{}
+
+// Load reads the record from path the first time it is used or when path changes.
+// A missing file starts an empty record.
+func (a *InactiveAccounts) Load(path string, logger *slog.Logger) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.loaded && a.path == path {
+		return nil
+	}
+	a.path = path
+	a.loaded = true
+	a.dirty = false
+	a.accounts = make(map[string]inactiveAccount)
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	var state inactiveState
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+	if err == nil && state.Version != inactiveStateVersion {
+		err = errors.New("unsupported version " + strconv.Itoa(state.Version))
+	}
+	if err != nil {
+		logger.Error("Unable to read account state file", "path", path, "err", err)
+		return err
+	}
+	for dn, account := range state.Accounts {
+		a.accounts[dn] = account
+	}
+	return nil
+}
+
+// Observe returns state with Since set to when the account was first seen inactive. The time
+// from the entry is used for an account seen for the first time, or now when it has none.
+// Accounts seen active again are forgotten.
+func (a *InactiveAccounts) Observe(dn string, state AccountState, now time.Time) AccountState {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.accounts == nil {
+		a.accounts = make(map[string]inactiveAccount)
+	}
+	dn = strings.ToLower(dn)
+	account, ok := a.accounts[dn]
+	if state.Active {
+		if ok {
+			delete(a.accounts, dn)
+			a.dirty = true
+		}
+		return state
+	}
+	if !ok {
+		account.Since = state.Since
+		if account.Since.IsZero() || account.Since.After(now) {
+			account.Since = now
+		}
+	}
+	account.Seen = now
+	a.accounts[dn] = account
+	a.dirty = true
+	state.Since = account.Since
+	return state
+}
+
+// Save forgets accounts not seen for a while and writes the record when a path is set.
+func (a *InactiveAccounts) Save(now time.Time, logger *slog.Logger) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for dn, account := range a.accounts {
+		if now.Sub(account.Seen) > inactiveRetention {
+			delete(a.accounts, dn)
+			a.dirty = true
+		}
+	}
+	if a.path == "" || !a.dirty {
+		return nil
+	}
+	data, err := json.Marshal(inactiveState{Version: inactiveStateVersion, Accounts: a.accounts})
+	if err == nil {
+		err = utils.WriteFileAtomic(a.path, data, inactiveStateMode)
+	}
+	if err != nil {
+		logger.Error("Unable to write account state file", "path", a.path, "err", err)
+		return err
+	}
+	a.dirty = false
+	return nil
+}
+
+func generalizedTime(value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	t, err := ber.ParseGeneralizedTime([]byte(value))
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
@@ -0,0 +1,262 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldap
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/promslog"
+	localmetrics "github.com/treydock/subid-ldap/internal/metrics"
+	"github.com/treydock/subid-ldap/internal/test"
+)
+
+func TestEntryAccountState(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		attrs  map[string][]string
+		active bool
+		reason string
+		since  time.Time
+	}{
+		{
+			name:   "ad-active",
+			attrs:  map[string][]string{"userAccountControl": {"512"}, "accountExpires": {"9223372036854775807"}},
+			active: true,
+		},
+		{
+			name:   "ad-never-expires-zero",
+			attrs:  map[string][]string{"userAccountControl": {"512"}, "accountExpires": {"0"}},
+			active: true,
+		},
+		{
+			name:   "ad-disabled",
+			attrs:  map[string][]string{"userAccountControl": {"514"}, "whenChanged": {"20240501120000.0Z"}},
+			reason: AccountReasonDisabled,
+			since:  time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			name:   "ad-expired",
+			attrs:  map[string][]string{"userAccountControl": {"512"}, "accountExpires": {"133569216000000000"}},
+			reason: AccountReasonExpired,
+			since:  time.Date(2024, 4, 7, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:   "ad-expires-future",
+			attrs:  map[string][]string{"accountExpires": {"134000000000000000"}},
+			active: true,
+		},
+		{
+			name:   "389ds-locked",
+			attrs:  map[string][]string{"nsAccountLock": {"True"}, "modifyTimestamp": {"20240502000000Z"}},
+			reason: AccountReasonDisabled,
+			since:  time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:   "389ds-unlocked",
+			attrs:  map[string][]string{"nsAccountLock": {"false"}},
+			active: true,
+		},
+		{
+			name:   "ppolicy-locked",
+			attrs:  map[string][]string{"pwdAccountLockedTime": {"20240503000000Z"}},
+			reason: AccountReasonLocked,
+			since:  time.Date(2024, 5, 3, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:   "ppolicy-permanent",
+			attrs:  map[string][]string{"pwdAccountLockedTime": {"000001010000Z"}},
+			reason: AccountReasonLocked,
+		},
+		{
+			name:   "shadow-expired",
+			attrs:  map[string][]string{"shadowExpire": {"19800"}},
+			reason: AccountReasonExpired,
+			since:  time.Date(2024, 3, 18, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:   "shadow-unset",
+			attrs:  map[string][]string{"shadowExpire": {"-1"}},
+			active: true,
+		},
+		{
+			name: "earliest",
+			attrs: map[string][]string{
+				"pwdAccountLockedTime": {"000001010000Z"},
+				"shadowExpire":         {"19800"},
+				"nsAccountLock":        {"true"},
+				"modifyTimestamp":      {"20240502000000Z"},
+			},
+			reason: AccountReasonExpired,
+			since:  time.Date(2024, 3, 18, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := EntryAccountState(ldap.NewEntry("cn=test", tt.attrs), now)
+			if state.Active != tt.active {
+				t.Errorf("Unexpected active, got: %t", state.Active)
+			}
+			if state.Reason != tt.reason {
+				t.Errorf("Unexpected reason, got: %s", state.Reason)
+			}
+			if !state.Since.Equal(tt.since) {
+				t.Errorf("Unexpected since, got: %s", state.Since)
+			}
+		})
+	}
+}
+
+func TestActiveUserKey(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	_config := getConfig()
+	seen := &InactiveAccounts{}
+	disabled := ldap.NewEntry("cn=test", map[string][]string{
+		"uidNumber":       {"1000"},
+		"nsAccountLock":   {"true"},
+		"modifyTimestamp": {"20240530000000Z"},
+	})
+	unknown := ldap.NewEntry("cn=unknown", map[string][]string{
+		"uidNumber":     {"1001"},
+		"nsAccountLock": {"true"},
+	})
+	if key, _, _ := activeUserKey(disabled, _config, seen, now); key != "1000" {
+		t.Errorf("Expected account state to be ignored when off, got: %q", key)
+	}
+	_config.AccountState = AccountStateExclude
+	if key, _, _ := activeUserKey(disabled, _config, seen, now); key != "" {
+		t.Errorf("Expected disabled user to be excluded, got: %q", key)
+	}
+	_config.AccountState = AccountStateGrace
+	_config.AccountStateGrace = 7 * 24 * time.Hour
+	key, state, until := activeUserKey(disabled, _config, seen, now)
+	if key != "1000" || state.Active {
+		t.Errorf("Expected disabled user in grace period, got: %q", key)
+	}
+	if expected := time.Date(2024, 6, 6, 0, 0, 0, 0, time.UTC); !until.Equal(expected) {
+		t.Errorf("Unexpected grace period end, got: %s", until)
+	}
+	if key, _, _ := activeUserKey(disabled, _config, seen, now.Add(7*24*time.Hour)); key != "" {
+		t.Errorf("Expected disabled user to be removed after grace period, got: %q", key)
+	}
+	key, _, until = activeUserKey(unknown, _config, seen, now)
+	if key != "1001" || !until.Equal(now.Add(7*24*time.Hour)) {
+		t.Errorf("Expected user without inactive time to start the grace period now, got: %q %s", key, until)
+	}
+}
+
+func TestActiveUserKeyLaterChange(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	_config := getConfig()
+	_config.AccountState = AccountStateGrace
+	_config.AccountStateGrace = 7 * 24 * time.Hour
+	seen := &InactiveAccounts{}
+	disabled := ldap.NewEntry("cn=test", map[string][]string{
+		"uidNumber":       {"1000"},
+		"nsAccountLock":   {"true"},
+		"modifyTimestamp": {"20240530000000Z"},
+	})
+	if key, _, _ := activeUserKey(disabled, _config, seen, now); key != "1000" {
+		t.Errorf("Expected disabled user in grace period, got: %q", key)
+	}
+	// An unrelated change to the disabled entry after the grace period ended
+	changed := ldap.NewEntry("cn=test", map[string][]string{
+		"uidNumber":       {"1000"},
+		"nsAccountLock":   {"true"},
+		"modifyTimestamp": {"20240610000000Z"},
+	})
+	later := time.Date(2024, 6, 11, 0, 0, 0, 0, time.UTC)
+	if key, state, _ := activeUserKey(changed, _config, seen, later); key != "" {
+		t.Errorf("Expected change to not restart the grace period, got: %q since %s", key, state.Since)
+	}
+	active := ldap.NewEntry("cn=test", map[string][]string{"uidNumber": {"1000"}})
+	if key, _, _ := activeUserKey(active, _config, seen, later); key != "1000" {
+		t.Errorf("Expected enabled user, got: %q", key)
+	}
+	if key, _, _ := activeUserKey(changed, _config, seen, later); key != "1000" {
+		t.Errorf("Expected grace period to restart after the user was enabled again, got: %q", key)
+	}
+}
+
+func TestInactiveAccountsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "account-state.json")
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	logger := promslog.NewNopLogger()
+	seen := &InactiveAccounts{}
+	if err := seen.Load(path, logger); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	seen.Observe("CN=Test", AccountState{Reason: AccountReasonDisabled}, now)
+	seen.Observe("cn=old", AccountState{Reason: AccountReasonDisabled}, now.Add(-inactiveRetention-time.Hour))
+	if err := seen.Save(now, logger); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	loaded := &InactiveAccounts{}
+	if err := loaded.Load(path, logger); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	state := loaded.Observe("cn=test", AccountState{Reason: AccountReasonDisabled, Since: now.Add(time.Hour)}, now.Add(2*time.Hour))
+	if !state.Since.Equal(now) {
+		t.Errorf("Expected first inactive time from file, got: %s", state.Since)
+	}
+	if _, ok := loaded.accounts["cn=old"]; ok {
+		t.Errorf("Expected account not seen for longer than the retention to be forgotten")
+	}
+	if err := os.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&InactiveAccounts{}).Load(path, logger); err == nil {
+		t.Errorf("Expected error loading invalid file")
+	}
+}
+
+func TestLDAPUsersAccountState(t *testing.T) {
+	_config := getConfig()
+	_config.UserBaseDN = test.BulkBaseDN
+	_config.AccountState = AccountStateExclude
+	l, err := LDAPConnect(_config, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer l.Close()
+	users, err := LDAPUsers(context.Background(), l, nil, _config, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	inactive := test.BulkUsers / 100
+	if len(users) != test.BulkUsers-2*inactive {
+		t.Errorf("Unexpected number of users, got: %d", len(users))
+	}
+	for _, user := range users {
+		if user == "10001" || user == "10002" {
+			t.Errorf("Unexpected inactive user %s", user)
+		}
+	}
+	expected := `
+	# HELP subid_ldap_users_inactive Number of inactive LDAP users from the last search, action is excluded or grace
+	# TYPE subid_ldap_users_inactive gauge
+	subid_ldap_users_inactive{action="excluded",reason="disabled"} 10
+	subid_ldap_users_inactive{action="excluded",reason="expired"} 10
+	`
+	if err := testutil.CollectAndCompare(localmetrics.MetricUsersInactive, strings.NewReader(expected)); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
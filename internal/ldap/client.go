@@ -0,0 +1,200 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldap
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/treydock/subid-ldap/internal/config"
+	"github.com/treydock/subid-ldap/internal/metrics"
+)
+
+// Client hands out LDAP connections. When Persistent is set the connection is kept
+// open between uses, health checked before it is handed out and transparently
+// re-established when the connection is lost or the connection settings change.
+// The zero value opens a new connection for every use.
+type Client struct {
+	Persistent  bool
+	IdleTimeout time.Duration
+	// Incremental holds the users of incremental searches between uses
+	Incremental Incremental
+
+	mu        sync.Mutex
+	conn      *ldap.Conn
+	info      *ServerInfo
+	signature string
+	idleTimer *time.Timer
+}
+
+// Do runs fn with an LDAP connection and the server detected for the connection, which is
+// nil when the RootDSE could not be read. With a persistent client a network error
+// causes a reconnect and fn is retried once. When ctx ends before fn returns the
+// connection is closed, abandoning the operation in progress, and the cause is returned.
+func (c *Client) Do(ctx context.Context, config *config.Config, logger *slog.Logger, fn func(*ldap.Conn, *ServerInfo) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	l, err := c.connect(config, logger)
+	if err != nil {
+		return err
+	}
+	err = doConn(ctx, l, c.serverInfo(l, logger), fn)
+	if err != nil && ctx.Err() == nil && c.Persistent && ldap.IsErrorWithCode(err, ldap.ErrorNetwork) {
+		logger.Warn("Lost LDAP connection, reconnecting", "err", err)
+		c.closeConn()
+		l, err = c.connect(config, logger)
+		if err != nil {
+			return err
+		}
+		err = doConn(ctx, l, c.serverInfo(l, logger), fn)
+	}
+	c.release(err, logger)
+	return err
+}
+
+// doConn runs fn closing the connection if ctx ends first.
+func doConn(ctx context.Context, l *ldap.Conn, info *ServerInfo, fn func(*ldap.Conn, *ServerInfo) error) error {
+	stop := context.AfterFunc(ctx, func() {
+		l.Close()
+	})
+	err := fn(l, info)
+	if !stop() {
+		return context.Cause(ctx)
+	}
+	return err
+}
+
+// Close closes any open connection.
+func (c *Client) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeConn()
+}
+
+func (c *Client) connect(config *config.Config, logger *slog.Logger) (*ldap.Conn, error) {
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+	}
+	signature := connectionSignature(config)
+	if c.conn != nil && c.signature != signature {
+		logger.Info("LDAP connection settings changed, reconnecting")
+		c.closeConn()
+	}
+	if c.conn != nil {
+		err := LDAPHealthCheck(c.conn, logger)
+		if err == nil {
+			logger.Debug("Reusing LDAP connection", "url", config.LdapURL)
+			return c.conn, nil
+		}
+		logger.Info("LDAP connection failed health check, reconnecting", "err", err)
+		c.closeConn()
+	}
+	l, err := LDAPConnect(config, logger)
+	if err != nil {
+		if l != nil {
+			l.Close()
+		}
+		return nil, err
+	}
+	metrics.MetricLDAPConnects.Inc()
+	c.conn = l
+	c.signature = signature
+	return l, nil
+}
+
+// serverInfo detects the server the first time the connection is used.
+func (c *Client) serverInfo(l *ldap.Conn, logger *slog.Logger) *ServerInfo {
+	if c.info == nil {
+		info, err := LDAPServerInfo(l, logger)
+		if err != nil {
+			return nil
+		}
+		c.info = info
+	}
+	return c.info
+}
+
+func (c *Client) release(err error, logger *slog.Logger) {
+	if !c.Persistent || err != nil {
+		c.closeConn()
+		return
+	}
+	if c.IdleTimeout > 0 {
+		conn := c.conn
+		c.idleTimer = time.AfterFunc(c.IdleTimeout, func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.conn == conn {
+				logger.Debug("Closing idle LDAP connection")
+				c.closeConn()
+			}
+		})
+	}
+}
+
+func (c *Client) closeConn() {
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.conn = nil
+	c.info = nil
+	c.signature = ""
+}
+
+// LDAPHealthCheck verifies a connection is usable by reading the RootDSE.
+func LDAPHealthCheck(l *ldap.Conn, logger *slog.Logger) error {
+	if l.IsClosing() {
+		return fmt.Errorf("connection is closing")
+	}
+	request := ldap.NewSearchRequest("", ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{"supportedLDAPVersion"}, nil)
+	_, err := l.Search(request)
+	if err != nil {
+		logger.Debug("LDAP health check failed", "err", err)
+	}
+	return err
+}
+
+func connectionSignature(config *config.Config) string {
+	signature := []string{
+		config.LdapURL,
+		fmt.Sprintf("%t", config.LdapTLS),
+		fmt.Sprintf("%t", config.LdapTLSVerify),
+		config.LdapTLSMinVersion,
+		strings.Join(config.LdapTLSCipherSuites, ","),
+		config.LdapTLSServerName,
+		strings.Join(config.LdapTLSPinSHA256, ","),
+		config.BindDN,
+		config.BindPassword,
+		config.BindPasswordFile,
+		config.BindPasswordCredential,
+		config.BindPasswordCommand,
+		config.LdapKeepAlive.String(),
+	}
+	files, err := caCertFiles(config)
+	if err == nil {
+		if ca, err := caCertSignature(config.LdapTLSCACert, files); err == nil {
+			signature = append(signature, ca)
+		}
+	}
+	return strings.Join(signature, "\n")
+}
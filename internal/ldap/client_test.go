@@ -0,0 +1,256 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldap
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/prometheus/common/promslog"
+)
+
+func TestClientPersistent(t *testing.T) {
+	_config := getConfig()
+	_config.BindPassword = "test"
+	client := &Client{Persistent: true}
+	defer client.Close()
+	var first, second *ldap.Conn
+	err := client.Do(context.Background(), _config, promslog.NewNopLogger(), func(l *ldap.Conn, info *ServerInfo) error {
+		first = l
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	err = client.Do(context.Background(), _config, promslog.NewNopLogger(), func(l *ldap.Conn, info *ServerInfo) error {
+		second = l
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if first != second {
+		t.Errorf("Expected connection to be reused")
+	}
+	_config.UserFilter = "(uid=*)"
+	err = client.Do(context.Background(), _config, promslog.NewNopLogger(), func(l *ldap.Conn, info *ServerInfo) error {
+		second = l
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if first != second {
+		t.Errorf("Expected connection to be reused when search settings change")
+	}
+	_config.LdapTLS = true
+	err = client.Do(context.Background(), _config, promslog.NewNopLogger(), func(l *ldap.Conn, info *ServerInfo) error {
+		second = l
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if first == second {
+		t.Errorf("Expected new connection when connection settings change")
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	_config := getConfig()
+	_config.BindPassword = "test"
+	client := &Client{Persistent: true}
+	defer client.Close()
+	var first, second *ldap.Conn
+	err := client.Do(context.Background(), _config, promslog.NewNopLogger(), func(l *ldap.Conn, info *ServerInfo) error {
+		first = l
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	first.Close()
+	err = client.Do(context.Background(), _config, promslog.NewNopLogger(), func(l *ldap.Conn, info *ServerInfo) error {
+		second = l
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if first == second {
+		t.Errorf("Expected a new connection after the connection was closed")
+	}
+	calls := 0
+	err = client.Do(context.Background(), _config, promslog.NewNopLogger(), func(l *ldap.Conn, info *ServerInfo) error {
+		calls++
+		if calls == 1 {
+			return ldap.NewError(ldap.ErrorNetwork, errors.New("connection reset"))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if calls != 2 {
+		t.Errorf("Expected retry after network error, calls: %d", calls)
+	}
+}
+
+func TestClientIdleTimeout(t *testing.T) {
+	_config := getConfig()
+	_config.BindPassword = "test"
+	client := &Client{Persistent: true, IdleTimeout: 100 * time.Millisecond}
+	defer client.Close()
+	var conn *ldap.Conn
+	err := client.Do(context.Background(), _config, promslog.NewNopLogger(), func(l *ldap.Conn, info *ServerInfo) error {
+		conn = l
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if !conn.IsClosing() {
+		t.Errorf("Expected idle connection to be closed")
+	}
+}
+
+func TestClientNotPersistent(t *testing.T) {
+	_config := getConfig()
+	client := &Client{}
+	var conn *ldap.Conn
+	err := client.Do(context.Background(), _config, promslog.NewNopLogger(), func(l *ldap.Conn, info *ServerInfo) error {
+		conn = l
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !conn.IsClosing() {
+		t.Errorf("Expected connection to be closed")
+	}
+}
+
+func TestClientKeepAlive(t *testing.T) {
+	_config := getConfig()
+	_config.BindPassword = "test"
+	client := &Client{Persistent: true}
+	defer client.Close()
+	var first, second *ldap.Conn
+	err := client.Do(context.Background(), _config, promslog.NewNopLogger(), func(l *ldap.Conn, info *ServerInfo) error {
+		first = l
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	_config.LdapKeepAlive = 45 * time.Second
+	err = client.Do(context.Background(), _config, promslog.NewNopLogger(), func(l *ldap.Conn, info *ServerInfo) error {
+		second = l
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if first == second {
+		t.Errorf("Expected a new connection after the keepalive changed")
+	}
+}
+
+func TestClientDoContext(t *testing.T) {
+	_config := getConfig()
+	_config.BindPassword = "test"
+	client := &Client{Persistent: true}
+	defer client.Close()
+	cause := errors.New("run timed out")
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(cause)
+	called := false
+	err := client.Do(ctx, _config, promslog.NewNopLogger(), func(l *ldap.Conn, info *ServerInfo) error {
+		called = true
+		return nil
+	})
+	if !errors.Is(err, cause) {
+		t.Errorf("Expected cancel cause, got: %v", err)
+	}
+	if called {
+		t.Errorf("Expected canceled context to skip the connection")
+	}
+	ctx, cancel = context.WithCancelCause(context.Background())
+	var first *ldap.Conn
+	err = client.Do(ctx, _config, promslog.NewNopLogger(), func(l *ldap.Conn, info *ServerInfo) error {
+		first = l
+		cancel(cause)
+		<-ctx.Done()
+		_, err := l.Search(ldap.NewSearchRequest(_config.UserBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+			_config.UserFilter, []string{_config.UserUIDAttr}, nil))
+		return err
+	})
+	if !errors.Is(err, cause) {
+		t.Errorf("Expected cancel cause, got: %v", err)
+	}
+	var second *ldap.Conn
+	err = client.Do(context.Background(), _config, promslog.NewNopLogger(), func(l *ldap.Conn, info *ServerInfo) error {
+		second = l
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if first == second {
+		t.Errorf("Expected new connection after canceled run")
+	}
+}
+
+func TestClientServerInfo(t *testing.T) {
+	_config := getConfig()
+	_config.BindPassword = "test"
+	client := &Client{Persistent: true}
+	defer client.Close()
+	var first, second *ServerInfo
+	err := client.Do(context.Background(), _config, promslog.NewNopLogger(), func(l *ldap.Conn, info *ServerInfo) error {
+		first = info
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if first == nil || first.Vendor != VendorOpenLDAP {
+		t.Fatalf("Unexpected server info, got: %v", first)
+	}
+	err = client.Do(context.Background(), _config, promslog.NewNopLogger(), func(l *ldap.Conn, info *ServerInfo) error {
+		second = info
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if first != second {
+		t.Errorf("Expected server to be detected once per connection")
+	}
+	client.Close()
+	err = client.Do(context.Background(), _config, promslog.NewNopLogger(), func(l *ldap.Conn, info *ServerInfo) error {
+		second = info
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if first == second {
+		t.Errorf("Expected server to be detected again for a new connection")
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/treydock/subid-ldap/internal/config"
+)
+
+const (
+	credentialsDirectoryEnv = "CREDENTIALS_DIRECTORY"
+	passwordCommandTimeout  = 30 * time.Second
+	passwordCommandShell    = "/bin/sh"
+)
+
+var passwordCache = &bindPasswordCache{}
+
+type bindPasswordCache struct {
+	mu       sync.Mutex
+	command  string
+	password string
+}
+
+// HasBindPassword returns true if any source of the bind password is configured.
+func HasBindPassword(config *config.Config) bool {
+	return len(bindPasswordSources(config)) > 0
+}
+
+func bindPasswordSources(config *config.Config) []string {
+	sources := []string{}
+	if config.BindPassword != "" {
+		sources = append(sources, "ldap.bind-password")
+	}
+	if config.BindPasswordFile != "" {
+		sources = append(sources, "ldap.bind-password-file")
+	}
+	if config.BindPasswordCredential != "" {
+		sources = append(sources, "ldap.bind-password-credential")
+	}
+	if config.BindPasswordCommand != "" {
+		sources = append(sources, "ldap.bind-password-command")
+	}
+	return sources
+}
+
+// ValidateBindPassword checks that at most one bind password source is configured.
+func ValidateBindPassword(config *config.Config) error {
+	if sources := bindPasswordSources(config); len(sources) > 1 {
+		return fmt.Errorf("only one bind password source may be used, got: %s", strings.Join(sources, ", "))
+	}
+	return nil
+}
+
+// LDAPBindPassword returns the bind password from the configured source.
+// Files and systemd credentials are read on every call, the output of a password
+// command is cached until refresh is requested.
+func LDAPBindPassword(config *config.Config, refresh bool, logger *slog.Logger) (string, error) {
+	switch {
+	case config.BindPassword != "":
+		return config.BindPassword, nil
+	case config.BindPasswordFile != "":
+		return readPasswordFile(config.BindPasswordFile, logger)
+	case config.BindPasswordCredential != "":
+		dir := os.Getenv(credentialsDirectoryEnv)
+		if dir == "" {
+			err := fmt.Errorf("%s is not set, unable to load credential %s", credentialsDirectoryEnv, config.BindPasswordCredential)
+			logger.Error("Error loading bind password credential", "err", err)
+			return "", err
+		}
+		return readPasswordFile(filepath.Join(dir, config.BindPasswordCredential), logger)
+	case config.BindPasswordCommand != "":
+		return commandPassword(config.BindPasswordCommand, refresh, logger)
+	}
+	return "", nil
+}
+
+func readPasswordFile(path string, logger *slog.Logger) (string, error) {
+	logger.Debug("Reading bind password file", "path", path)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		logger.Error("Error reading bind password file", "path", path, "err", err)
+		return "", err
+	}
+	password := strings.TrimRight(string(content), "\r\n")
+	if password == "" {
+		err = fmt.Errorf("bind password file %s is empty", path)
+		logger.Error("Error reading bind password file", "path", path, "err", err)
+		return "", err
+	}
+	return password, nil
+}
+
+func commandPassword(command string, refresh bool, logger *slog.Logger) (string, error) {
+	passwordCache.mu.Lock()
+	defer passwordCache.mu.Unlock()
+	if !refresh && passwordCache.command == command && passwordCache.password != "" {
+		return passwordCache.password, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), passwordCommandTimeout)
+	defer cancel()
+	logger.Debug("Running bind password command")
+	// Run through the shell so quoted arguments and pipelines work as they would in a terminal
+	cmd := exec.CommandContext(ctx, passwordCommandShell, "-c", command)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		logger.Error("Error running bind password command", "err", err)
+		return "", err
+	}
+	password := strings.TrimRight(string(out), "\r\n")
+	if password == "" {
+		err = errors.New("bind password command returned an empty password")
+		logger.Error("Error running bind password command", "err", err)
+		return "", err
+	}
+	passwordCache.command = command
+	passwordCache.password = password
+	return password, nil
+}
+
+// LDAPBind binds using the configured bind DN and password source.
+// When the password comes from a command and the bind is rejected, the command is
+// run again and the bind retried once so that rotated passwords are picked up.
+func LDAPBind(l *ldap.Conn, config *config.Config, logger *slog.Logger) error {
+	password, err := LDAPBindPassword(config, false, logger)
+	if err != nil {
+		return err
+	}
+	logger.Debug("Binding to LDAP", "url", config.LdapURL, "binddn", config.BindDN)
+	err = l.Bind(config.BindDN, password)
+	if err != nil && config.BindPasswordCommand != "" && ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		logger.Info("Bind rejected, refreshing bind password from command", "binddn", config.BindDN)
+		password, err = LDAPBindPassword(config, true, logger)
+		if err != nil {
+			return err
+		}
+		err = l.Bind(config.BindDN, password)
+	}
+	if err != nil {
+		logger.Error("Error binding to LDAP", "binddn", config.BindDN, "err", err)
+	}
+	return err
+}
@@ -0,0 +1,122 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldap
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/common/promslog"
+	"github.com/treydock/subid-ldap/internal/test"
+)
+
+func TestLDAPBindPasswordFile(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_config := getConfig()
+	_config.BindPasswordFile = passwordFile
+	password, err := LDAPBindPassword(_config, false, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if password != "secret" {
+		t.Errorf("Unexpected password, got: %s", password)
+	}
+	_, err = LDAPConnect(_config, promslog.NewNopLogger())
+	if err != nil {
+		t.Errorf("Unexpected error during BIND: %s", err.Error())
+	}
+	if err := os.WriteFile(passwordFile, []byte(""), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LDAPBindPassword(_config, false, promslog.NewNopLogger()); err == nil {
+		t.Errorf("Expected an error with empty password file")
+	}
+}
+
+func TestLDAPBindPasswordCredential(t *testing.T) {
+	credentials := t.TempDir()
+	if err := os.WriteFile(filepath.Join(credentials, "ldap-bind-password"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_config := getConfig()
+	_config.BindPasswordCredential = "ldap-bind-password"
+	t.Setenv(credentialsDirectoryEnv, "")
+	if _, err := LDAPBindPassword(_config, false, promslog.NewNopLogger()); err == nil {
+		t.Errorf("Expected an error without %s", credentialsDirectoryEnv)
+	}
+	t.Setenv(credentialsDirectoryEnv, credentials)
+	password, err := LDAPBindPassword(_config, false, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if password != "secret" {
+		t.Errorf("Unexpected password, got: %s", password)
+	}
+}
+
+func TestLDAPBindPasswordCommandRefresh(t *testing.T) {
+	dir := t.TempDir()
+	counter := filepath.Join(dir, "counter")
+	script := filepath.Join(dir, "password.sh")
+	content := fmt.Sprintf(`#!/bin/sh
+if [ -f %[1]s ]; then
+  echo rotated
+else
+  touch %[1]s
+  echo %[2]s
+fi
+`, counter, test.InvalidPassword)
+	if err := os.WriteFile(script, []byte(content), 0700); err != nil {
+		t.Fatal(err)
+	}
+	_config := getConfig()
+	_config.BindPasswordCommand = script
+	_, err := LDAPConnect(_config, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error during BIND: %s", err.Error())
+	}
+	password, err := LDAPBindPassword(_config, false, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if password != "rotated" {
+		t.Errorf("Expected cached password to be refreshed, got: %s", password)
+	}
+}
+
+func TestLDAPBindPasswordCommandQuoted(t *testing.T) {
+	_config := getConfig()
+	_config.BindPasswordCommand = `printf '%s\n' "bind pw" | tr ' ' _`
+	password, err := LDAPBindPassword(_config, true, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if password != "bind_pw" {
+		t.Errorf("Unexpected password, got: %s", password)
+	}
+}
+
+func TestValidateBindPassword(t *testing.T) {
+	_config := getConfig()
+	_config.BindPassword = "secret"
+	_config.BindPasswordFile = "/dne"
+	if err := ValidateBindPassword(_config); err == nil {
+		t.Errorf("Expected an error with multiple password sources")
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldap
+
+import (
+	"log/slog"
+
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/treydock/subid-ldap/internal/config"
+	"github.com/treydock/subid-ldap/internal/ldif"
+)
+
+// EntryUsers returns the users in entries read from a file such as an LDIF export, applying
+// the user search locally so the base DN, scope, filter and size limit select the same
+// users as a search of the directory.
+func EntryUsers(entries []*ldap.Entry, config *config.Config, logger *slog.Logger) ([]string, error) {
+	users := []string{}
+	err := userSearch(entrySearch(entries, logger), config, nil, logger, func(entry *ldap.Entry, key string) error {
+		users = append(users, key)
+		return nil
+	})
+	return users, err
+}
+
+// EntryMaxID returns the highest uidNumber or gidNumber in entries like LDAPMaxID.
+func EntryMaxID(entries []*ldap.Entry, config *config.Config, logger *slog.Logger) (int, error) {
+	return searchMaxID(entrySearch(entries, logger), config, logger)
+}
+
+// entrySearch returns a searchFunc searching the entries. Controls such as sorting are
+// ignored so entries are returned in file order.
+func entrySearch(entries []*ldap.Entry, logger *slog.Logger) searchFunc {
+	return func(request *ldap.SearchRequest, queryType string, config *config.Config, fn func(*ldap.Entry) error) error {
+		count := 0
+		err := ldif.Search(entries, request, func(entry *ldap.Entry) error {
+			count++
+			return fn(entry)
+		})
+		if err != nil {
+			logger.Error("Error searching entries", "type", queryType, "err", err)
+			return err
+		}
+		logger.Debug("results", "type", queryType, "count", count)
+		return nil
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldap
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/prometheus/common/promslog"
+	"github.com/treydock/subid-ldap/internal/config"
+	"github.com/treydock/subid-ldap/internal/ldif"
+	"github.com/treydock/subid-ldap/internal/test"
+)
+
+func TestEntryUsers(t *testing.T) {
+	_config := getConfig()
+	entries, err := ldif.Load(test.GetFixture("users.ldif"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	users, err := EntryUsers(entries, _config, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := []string{"1000", "1001", "1002", "1003"}
+	if len(users) != len(expected) {
+		t.Fatalf("Unexpected users, got: %v", users)
+	}
+	for i, user := range users {
+		if user != expected[i] {
+			t.Errorf("Unexpected user at %d, got: %s expected: %s", i, user, expected[i])
+		}
+	}
+	_config.SearchSizeLimit = 2
+	if _, err := EntryUsers(entries, _config, promslog.NewNopLogger()); err == nil {
+		t.Errorf("Expected size limit error")
+	}
+}
+
+func TestEntryMaxID(t *testing.T) {
+	_config := getConfig()
+	entries, err := ldif.Load(test.GetFixture("users.ldif"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	maxID, err := EntryMaxID(entries, _config, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// The group is below the base DN, the user in ou=Other is not
+	if maxID != 5000 {
+		t.Errorf("Unexpected max ID, got: %d", maxID)
+	}
+}
+
+func TestEntryUsersSearches(t *testing.T) {
+	_config := getConfig()
+	_config.UserBaseDN = ""
+	_config.Searches = []config.Search{
+		{BaseDN: "ou=People,dc=test", Filter: "(uid=testuser1)"},
+		{BaseDN: "ou=Other,dc=test"},
+		{BaseDN: "dc=test", Filter: "(|(uid=testuser1)(uid=testuser2))"},
+	}
+	entries, err := ldif.Load(test.GetFixture("users.ldif"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	users, err := EntryUsers(entries, _config, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// A user returned by more than one search is only included once
+	if !slices.Equal(users, []string{"1000", "9000", "1001"}) {
+		t.Errorf("Unexpected users, got: %v", users)
+	}
+	_config.Searches = _config.Searches[:1]
+	maxID, err := EntryMaxID(entries, _config, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if maxID != 5000 {
+		t.Errorf("Unexpected max ID, got: %d", maxID)
+	}
+	_config.Searches = append(_config.Searches, config.Search{BaseDN: "ou=Other,dc=test"})
+	maxID, err = EntryMaxID(entries, _config, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if maxID != 9000 {
+		t.Errorf("Expected max ID below every search base, got: %d", maxID)
+	}
+}
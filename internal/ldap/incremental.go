@@ -0,0 +1,245 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package ldap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/treydock/subid-ldap/internal/config"
+	"github.com/treydock/subid-ldap/internal/metrics"
+)
+
+const (
+	IncrementalOff             = "off"
+	IncrementalAuto            = "auto"
+	IncrementalModifyTimestamp = "modifyTimestamp"
+	IncrementalUSNChanged      = "uSNChanged"
+
+	generalizedTimeFormat = "20060102150405Z"
+)
+
+var IncrementalModes = []string{IncrementalOff, IncrementalAuto, IncrementalModifyTimestamp, IncrementalUSNChanged}
+
+// Incremental holds the users found by earlier searches along with the highest value of the
+// modification attribute seen, so later searches only need to fetch entries changed since.
+// The zero value starts with a full search.
+type Incremental struct {
+	mu        sync.Mutex
+	users     UserSet
+	signature string
+	server    string
+	attr      string
+	mark      string
+	lastFull  time.Time
+}
+
+// Reset discards the users and high-water mark so the next search is a full search.
+func (i *Incremental) Reset() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.reset()
+}
+
+func (i *Incremental) reset() {
+	i.users.Replace(make(map[string]string))
+	i.signature = ""
+	i.server = ""
+	i.attr = ""
+	i.mark = ""
+	i.lastFull = time.Time{}
+}
+
+// LDAPIncrementalUsers returns the users like LDAPUsers but only searches for entries changed
+// since the previous search. Deleted entries and entries that stop matching the user filter are
+// not returned by such a search, so a full search replaces the users every LdapIncrementalFull.
+// The mark is only valid for the server that returned it, a search of another server is a full search.
+func LDAPIncrementalUsers(ctx context.Context, l *ldap.Conn, info *ServerInfo, config *config.Config, state *Incremental, logger *slog.Logger) ([]string, error) {
+	config = LDAPServerDefaults(info, config, logger)
+	if info == nil {
+		return nil, errors.New("unable to detect LDAP server for incremental search")
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if signature := incrementalSignature(config); signature != state.signature {
+		state.reset()
+		state.signature = signature
+	}
+	state.setServer(info, logger)
+	if state.attr == "" {
+		state.attr = incrementalAttr(info, config)
+	}
+	return incrementalUsers(connSearch(ctx, l, logger), config, state, time.Now(), logger)
+}
+
+// setServer discards the mark when the server differs from the one that returned it.
+func (i *Incremental) setServer(info *ServerInfo, logger *slog.Logger) {
+	server := info.Identity()
+	if server == i.server {
+		return
+	}
+	if i.mark != "" {
+		logger.Info("LDAP server changed, running a full user search", "host", info.DNSHostName, "service", info.DSServiceName)
+		i.mark = ""
+	}
+	i.server = server
+}
+
+// incrementalAttr resolves the auto mode to uSNChanged for Active Directory, where
+// modifyTimestamp is constructed and cannot be searched efficiently, and modifyTimestamp otherwise.
+func incrementalAttr(info *ServerInfo, config *config.Config) string {
+	if config.LdapIncremental != IncrementalAuto {
+		return config.LdapIncremental
+	}
+	if info.Vendor == VendorActiveDirectory {
+		return IncrementalUSNChanged
+	}
+	return IncrementalModifyTimestamp
+}
+
+func incrementalUsers(search searchFunc, config *config.Config, state *Incremental, now time.Time, logger *slog.Logger) ([]string, error) {
+	if state.mark == "" || now.Sub(state.lastFull) >= config.LdapIncrementalFull {
+		return incrementalFull(search, config, state, now, logger)
+	}
+	if accountStateEnabled(config) {
+		if err := inactiveAccounts.Load(config.AccountStateFile, logger); err != nil {
+			return nil, err
+		}
+	}
+	mark := state.mark
+	changes := 0
+	for _, searchConfig := range config.UserSearches() {
+		filter := incrementalFilter(searchConfig.UserFilter, state.attr, state.mark)
+		searchConfig.UserFilter = filter
+		logger.Debug("Running incremental user search", "basedn", searchConfig.UserBaseDN, "filter", filter)
+		request, err := userSearchRequest(searchConfig, append(userAttrs(config), state.attr))
+		if err != nil {
+			logger.Error("Error building user search", "err", err)
+			return nil, err
+		}
+		err = search(request, "user", config, func(entry *ldap.Entry) error {
+			changes++
+			mark = laterMark(state.attr, mark, entry.GetEqualFoldAttributeValue(state.attr))
+			if _, err := entryKey(entry, config); err != nil {
+				logger.Warn("Unable to determine user key", "dn", entry.DN, "err", err)
+				state.users.Delete(entry.DN)
+				return nil
+			}
+			key, _, until := activeUserKey(entry, config, inactiveAccounts, now)
+			if key == "" {
+				logger.Debug("Changed user is inactive", "dn", entry.DN)
+				state.users.Delete(entry.DN)
+				return nil
+			}
+			state.users.SetUntil(entry.DN, key, until)
+			return nil
+		})
+		if err != nil {
+			// The mark is not advanced so the changes are fetched again by the next search
+			return nil, err
+		}
+	}
+	if accountStateEnabled(config) {
+		if err := inactiveAccounts.Save(now, logger); err != nil {
+			return nil, err
+		}
+	}
+	logger.Info("Incremental user search complete", "changes", changes, "attr", state.attr, "mark", mark)
+	state.mark = mark
+	metrics.MetricLDAPIncrementalChanges.Set(float64(changes))
+	return state.users.Keys(), nil
+}
+
+// incrementalFull replaces the users with the result of a full search.
+func incrementalFull(search searchFunc, config *config.Config, state *Incremental, now time.Time, logger *slog.Logger) ([]string, error) {
+	users := make(map[string]string)
+	expires := make(map[string]time.Time)
+	mark := ""
+	err := userSearch(search, config, []string{state.attr}, logger, func(entry *ldap.Entry, key string) error {
+		_, _, until := activeUserKey(entry, config, inactiveAccounts, now)
+		users[entry.DN] = key
+		expires[entry.DN] = until
+		mark = laterMark(state.attr, mark, entry.GetEqualFoldAttributeValue(state.attr))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if mark == "" {
+		logger.Warn("No users returned the incremental attribute, the next search is a full search", "attr", state.attr)
+	}
+	logger.Info("Full user search complete", "users", len(users), "attr", state.attr, "mark", mark)
+	state.users.replace(users, expires)
+	state.mark = mark
+	state.lastFull = now
+	metrics.MetricLDAPFullSearch.Set(float64(now.Unix()))
+	return state.users.Keys(), nil
+}
+
+// incrementalFilter returns the user filter limited to entries changed since mark.
+// LDAP filters have no greater than so the uSNChanged mark is incremented, modifyTimestamp
+// only has a resolution of seconds so entries changed at the mark are fetched again.
+func incrementalFilter(filter string, attr string, mark string) string {
+	if !strings.HasPrefix(filter, "(") {
+		filter = "(" + filter + ")"
+	}
+	value := mark
+	if attr == IncrementalUSNChanged {
+		usn, _ := strconv.ParseInt(mark, 10, 64)
+		value = strconv.FormatInt(usn+1, 10)
+	}
+	return fmt.Sprintf("(&%s(%s>=%s))", filter, attr, ldap.EscapeFilter(value))
+}
+
+// laterMark returns the later of the current mark and value, values that cannot be parsed are ignored.
+func laterMark(attr string, current string, value string) string {
+	if attr == IncrementalUSNChanged {
+		usn, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return current
+		}
+		if currentUSN, err := strconv.ParseInt(current, 10, 64); err == nil && currentUSN >= usn {
+			return current
+		}
+		return value
+	}
+	t := generalizedTime(value)
+	if t.IsZero() {
+		return current
+	}
+	// Fractions of a second are dropped which only causes entries to be fetched again
+	if currentTime := generalizedTime(current); !currentTime.IsZero() && !t.After(currentTime) {
+		return current
+	}
+	return t.UTC().Format(generalizedTimeFormat)
+}
+
+// incrementalSignature identifies the settings that determine the users found, a change
+// discards the users of the previous search.
+func incrementalSignature(config *config.Config) string {
+	return strings.Join([]string{
+		config.LdapURL, config.UserBaseDN, config.UserFilter, config.UserScope, config.UserDerefAliases,
+		config.UserUIDAttr, config.UserKeyMode, strings.Join(config.UserKeyTransforms, "\x00"),
+		fmt.Sprintf("%d:%d:%d:%t:%s", config.SIDRangeMin, config.SIDRangeMax, config.SIDRangeSize,
+			config.SIDAutoridCompat, config.SIDDefaultDomainSID),
+		config.AccountState, config.AccountStateGrace.String(), config.LdapIncremental,
+		fmt.Sprintf("%v", config.Searches),
+	}, "\n")
+}
@@ -0,0 +1,268 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package ldap
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/promslog"
+	"github.com/treydock/subid-ldap/internal/config"
+	"github.com/treydock/subid-ldap/internal/metrics"
+	"github.com/treydock/subid-ldap/internal/test"
+)
+
+func TestLDAPIncrementalUsers(t *testing.T) {
+	test.ResetWriteback()
+	defer test.ResetWriteback()
+	_config := getWritebackConfig()
+	_config.LdapIncremental = IncrementalUSNChanged
+	_config.LdapIncrementalFull = time.Hour
+	logger := promslog.NewNopLogger()
+	l, err := LDAPConnect(_config, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer l.Close()
+	state := &Incremental{}
+	users, err := LDAPIncrementalUsers(context.Background(), l, testServerInfo(t, l), _config, state, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !slices.Equal(users, []string{"20000", "20001", "20002"}) {
+		t.Errorf("Unexpected users, got: %v", users)
+	}
+	if state.mark != "3" {
+		t.Errorf("Unexpected mark, got: %s", state.mark)
+	}
+	test.AddWriteback(writebackUserDN(3), map[string][]string{
+		"objectClass": {"posixAccount"},
+		"uid":         {"writebackuser3"},
+		"uidNumber":   {"20003"},
+	})
+	test.DeleteWriteback(writebackUserDN(0))
+	users, err = LDAPIncrementalUsers(context.Background(), l, testServerInfo(t, l), _config, state, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// The deleted user is only noticed by a full search
+	if !slices.Equal(users, []string{"20000", "20001", "20002", "20003"}) {
+		t.Errorf("Unexpected users, got: %v", users)
+	}
+	if val := testutil.ToFloat64(metrics.MetricLDAPIncrementalChanges); val != 1 {
+		t.Errorf("Unexpected changes, got: %v", val)
+	}
+	if state.mark != "4" {
+		t.Errorf("Unexpected mark, got: %s", state.mark)
+	}
+	state.lastFull = time.Now().Add(-2 * time.Hour)
+	users, err = LDAPIncrementalUsers(context.Background(), l, testServerInfo(t, l), _config, state, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !slices.Equal(users, []string{"20001", "20002", "20003"}) {
+		t.Errorf("Unexpected users, got: %v", users)
+	}
+	if time.Since(state.lastFull) > time.Minute {
+		t.Errorf("Expected full search, last full: %v", state.lastFull)
+	}
+	_config.UserFilter = "(uid=writebackuser1)"
+	users, err = LDAPIncrementalUsers(context.Background(), l, testServerInfo(t, l), _config, state, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !slices.Equal(users, []string{"20001"}) {
+		t.Errorf("Expected changed filter to reset users, got: %v", users)
+	}
+}
+
+func TestLDAPIncrementalUsersServerChange(t *testing.T) {
+	test.ResetWriteback()
+	defer test.ResetWriteback()
+	defer test.DNSHostName.Store("ldap.test")
+	_config := getWritebackConfig()
+	_config.LdapIncremental = IncrementalUSNChanged
+	_config.LdapIncrementalFull = time.Hour
+	logger := promslog.NewNopLogger()
+	l, err := LDAPConnect(_config, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer l.Close()
+	state := &Incremental{}
+	if _, err := LDAPIncrementalUsers(context.Background(), l, testServerInfo(t, l), _config, state, logger); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	lastFull := state.lastFull
+	test.DeleteWriteback(writebackUserDN(0))
+	// A new connection to the same server continues with incremental searches
+	l2, err := LDAPConnect(_config, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer l2.Close()
+	users, err := LDAPIncrementalUsers(context.Background(), l2, testServerInfo(t, l2), _config, state, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !state.lastFull.Equal(lastFull) || !slices.Equal(users, []string{"20000", "20001", "20002"}) {
+		t.Errorf("Expected incremental search, got: %v", users)
+	}
+	// Another server has its own uSNChanged values so the mark is discarded
+	test.DNSHostName.Store("ldap2.test")
+	l3, err := LDAPConnect(_config, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer l3.Close()
+	users, err = LDAPIncrementalUsers(context.Background(), l3, testServerInfo(t, l3), _config, state, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if state.lastFull.Equal(lastFull) || !slices.Equal(users, []string{"20001", "20002"}) {
+		t.Errorf("Expected full search, got: %v", users)
+	}
+}
+
+func TestLDAPIncrementalUsersSearches(t *testing.T) {
+	test.ResetWriteback()
+	defer test.ResetWriteback()
+	_config := getWritebackConfig()
+	_config.UserBaseDN = ""
+	_config.Searches = []config.Search{
+		{BaseDN: test.WritebackBaseDN, Filter: "(uid=writebackuser1)"},
+		{BaseDN: test.WritebackBaseDN, Filter: "(uid=writebackuser3)"},
+	}
+	_config.LdapIncremental = IncrementalUSNChanged
+	_config.LdapIncrementalFull = time.Hour
+	logger := promslog.NewNopLogger()
+	l, err := LDAPConnect(_config, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer l.Close()
+	state := &Incremental{}
+	users, err := LDAPIncrementalUsers(context.Background(), l, testServerInfo(t, l), _config, state, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !slices.Equal(users, []string{"20001"}) {
+		t.Errorf("Unexpected users, got: %v", users)
+	}
+	lastFull := state.lastFull
+	test.AddWriteback(writebackUserDN(3), map[string][]string{
+		"objectClass": {"posixAccount"},
+		"uid":         {"writebackuser3"},
+		"uidNumber":   {"20003"},
+	})
+	users, err = LDAPIncrementalUsers(context.Background(), l, testServerInfo(t, l), _config, state, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !slices.Equal(users, []string{"20001", "20003"}) {
+		t.Errorf("Expected the change of the second search, got: %v", users)
+	}
+	if !state.lastFull.Equal(lastFull) || state.mark != "4" {
+		t.Errorf("Expected incremental search, last full: %v mark: %s", state.lastFull, state.mark)
+	}
+}
+
+func TestLDAPIncrementalUsersModifyTimestamp(t *testing.T) {
+	test.ResetWriteback()
+	defer test.ResetWriteback()
+	_config := getWritebackConfig()
+	_config.LdapIncremental = IncrementalModifyTimestamp
+	_config.LdapIncrementalFull = time.Hour
+	logger := promslog.NewNopLogger()
+	l, err := LDAPConnect(_config, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer l.Close()
+	state := &Incremental{}
+	if _, err := LDAPIncrementalUsers(context.Background(), l, testServerInfo(t, l), _config, state, logger); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if state.mark != "20200101000000Z" {
+		t.Errorf("Unexpected mark, got: %s", state.mark)
+	}
+	test.AddWriteback(writebackUserDN(3), map[string][]string{
+		"objectClass": {"posixAccount"},
+		"uid":         {"writebackuser3"},
+		"uidNumber":   {"20003"},
+	})
+	users, err := LDAPIncrementalUsers(context.Background(), l, testServerInfo(t, l), _config, state, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !slices.Equal(users, []string{"20000", "20001", "20002", "20003"}) {
+		t.Errorf("Unexpected users, got: %v", users)
+	}
+	if state.mark <= "20200101000000Z" {
+		t.Errorf("Expected mark to advance, got: %s", state.mark)
+	}
+	users, err = LDAPIncrementalUsers(context.Background(), l, testServerInfo(t, l), _config, state, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if val := testutil.ToFloat64(metrics.MetricLDAPIncrementalChanges); val != 1 {
+		t.Errorf("Unexpected changes, got: %v", val)
+	}
+	if len(users) != 4 {
+		t.Errorf("Unexpected users, got: %v", users)
+	}
+}
+
+func TestIncrementalFilter(t *testing.T) {
+	tests := []struct {
+		filter   string
+		attr     string
+		mark     string
+		expected string
+	}{
+		{"(objectClass=posixAccount)", IncrementalUSNChanged, "41", "(&(objectClass=posixAccount)(uSNChanged>=42))"},
+		{"objectClass=user", IncrementalModifyTimestamp, "20240101000000Z", "(&(objectClass=user)(modifyTimestamp>=20240101000000Z))"},
+	}
+	for _, tt := range tests {
+		if got := incrementalFilter(tt.filter, tt.attr, tt.mark); got != tt.expected {
+			t.Errorf("Unexpected filter for %s, got: %s", tt.filter, got)
+		}
+	}
+}
+
+func TestLaterMark(t *testing.T) {
+	tests := []struct {
+		attr     string
+		current  string
+		value    string
+		expected string
+	}{
+		{IncrementalUSNChanged, "", "10", "10"},
+		{IncrementalUSNChanged, "10", "9", "10"},
+		{IncrementalUSNChanged, "9", "10", "10"},
+		{IncrementalUSNChanged, "10", "invalid", "10"},
+		{IncrementalModifyTimestamp, "", "20240101000000Z", "20240101000000Z"},
+		{IncrementalModifyTimestamp, "20240101000000Z", "20231231000000Z", "20240101000000Z"},
+		{IncrementalModifyTimestamp, "20240101000000Z", "20240102000000.5Z", "20240102000000Z"},
+		{IncrementalModifyTimestamp, "20240101000000Z", "20240101010000+0200", "20240101000000Z"},
+		{IncrementalModifyTimestamp, "20240101000000Z", "invalid", "20240101000000Z"},
+	}
+	for _, tt := range tests {
+		if got := laterMark(tt.attr, tt.current, tt.value); got != tt.expected {
+			t.Errorf("Unexpected mark for %s %s, got: %s", tt.current, tt.value, got)
+		}
+	}
+}
@@ -14,19 +14,42 @@
 package ldap
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	ldap "github.com/go-ldap/ldap/v3"
 	"github.com/treydock/subid-ldap/internal/config"
+	"github.com/treydock/subid-ldap/internal/metrics"
+	"github.com/treydock/subid-ldap/internal/transform"
+)
+
+const (
+	searchBufferSize = 100
 )
 
 func LDAPConnect(config *config.Config, logger *slog.Logger) (*ldap.Conn, error) {
 	logger.Debug("Connecting to LDAP", "url", config.LdapURL)
-	l, err := ldap.DialURL(config.LdapURL)
+	dialer := &net.Dialer{
+		Timeout:   ldap.DefaultTimeout,
+		KeepAlive: config.LdapKeepAlive,
+	}
+	l, err := ldap.DialURL(config.LdapURL, ldap.DialWithDialer(dialer))
 	if err != nil {
 		logger.Error("Error connecting to LDAP URL", "url", config.LdapURL, "err", err)
 		return l, err
@@ -37,11 +60,9 @@ func LDAPConnect(config *config.Config, logger *slog.Logger) (*ldap.Conn, error)
 			return l, err
 		}
 	}
-	if config.BindDN != "" && config.BindPassword != "" {
-		logger.Debug("Binding to LDAP", "url", config.LdapURL, "binddn", config.BindDN)
-		err = l.Bind(config.BindDN, config.BindPassword)
+	if config.BindDN != "" && HasBindPassword(config) {
+		err = LDAPBind(l, config, logger)
 		if err != nil {
-			logger.Error("Error binding to LDAP", "binddn", config.BindDN, "err", err)
 			return l, err
 		}
 	}
@@ -49,60 +70,553 @@ func LDAPConnect(config *config.Config, logger *slog.Logger) (*ldap.Conn, error)
 }
 
 func LDAPTLS(l *ldap.Conn, config *config.Config, logger *slog.Logger) error {
-	var err error
-	u, err := url.Parse(config.LdapURL)
+	tlsConfig, err := LDAPTLSConfig(config, logger)
 	if err != nil {
-		logger.Error("Error parsing LDAP URL", "url", config.LdapURL, "err", err)
 		return err
 	}
-	host, _, err := net.SplitHostPort(u.Host)
+	logger.Debug("Performing Start TLS with LDAP server")
+	err = l.StartTLS(tlsConfig)
 	if err != nil {
-		logger.Error("Error getting LDAP host name", "host", u.Host, "err", err)
+		logger.Error("Error starting TLS for LDAP connection", "err", err)
 		return err
 	}
+	metrics.MetricLDAPTLSInfo.Reset()
+	if state, ok := l.TLSConnectionState(); ok {
+		version := tls.VersionName(state.Version)
+		cipher := tls.CipherSuiteName(state.CipherSuite)
+		logger.Debug("Negotiated TLS with LDAP server", "version", version, "cipher", cipher)
+		metrics.MetricLDAPTLSInfo.WithLabelValues(version, cipher).Set(1)
+	}
+	return nil
+}
+
+func LDAPTLSConfig(config *config.Config, logger *slog.Logger) (*tls.Config, error) {
+	serverName := config.LdapTLSServerName
+	if serverName == "" {
+		u, err := url.Parse(config.LdapURL)
+		if err != nil {
+			logger.Error("Error parsing LDAP URL", "url", config.LdapURL, "err", err)
+			return nil, err
+		}
+		host, _, err := net.SplitHostPort(u.Host)
+		if err != nil {
+			logger.Error("Error getting LDAP host name", "host", u.Host, "err", err)
+			return nil, err
+		}
+		serverName = host
+	}
+	minVersion, err := TLSVersion(config.LdapTLSMinVersion)
+	if err != nil {
+		logger.Error("Error parsing TLS minimum version", "err", err)
+		return nil, err
+	}
+	cipherSuites, err := TLSCipherSuites(config.LdapTLSCipherSuites)
+	if err != nil {
+		logger.Error("Error parsing TLS cipher suites", "err", err)
+		return nil, err
+	}
+	pins, err := TLSPins(config.LdapTLSPinSHA256)
+	if err != nil {
+		logger.Error("Error parsing TLS SPKI pins", "err", err)
+		return nil, err
+	}
 	tlsConfig := &tls.Config{
 		InsecureSkipVerify: !config.LdapTLSVerify,
-		ServerName:         host,
+		ServerName:         serverName,
+		MinVersion:         minVersion,
+		CipherSuites:       cipherSuites,
 	}
-	if config.LdapTLSCACert != "" {
-		caCertPool := x509.NewCertPool()
-		caCertPool.AppendCertsFromPEM([]byte(config.LdapTLSCACert))
+	if len(pins) > 0 {
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifyPin(state, pins)
+		}
+	}
+	caCertPool, err := LDAPCACertPool(config, logger)
+	if err != nil {
+		return nil, err
+	}
+	if caCertPool != nil {
 		tlsConfig.RootCAs = caCertPool
 	}
-	logger.Debug("Performing Start TLS with LDAP server")
-	err = l.StartTLS(tlsConfig)
+	return tlsConfig, nil
+}
+
+// TLSVersion converts a version such as 1.2 to its crypto/tls value.
+// An empty version leaves the Go default in place.
+func TLSVersion(version string) (uint16, error) {
+	switch version {
+	case "":
+		return 0, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q", version)
+}
+
+// TLSCipherSuites converts IANA cipher suite names to their crypto/tls IDs.
+// Cipher suites only apply to TLS 1.2 and earlier.
+func TLSCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	ids := []uint16{}
+	for _, name := range names {
+		id, ok := known[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure TLS cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// TLSPins decodes base64 encoded SHA-256 hashes of a certificate's SubjectPublicKeyInfo,
+// the same format as produced by
+// openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+func TLSPins(values []string) ([][]byte, error) {
+	pins := [][]byte{}
+	for _, value := range values {
+		pin, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode SPKI pin %q: %w", value, err)
+		}
+		if len(pin) != sha256.Size {
+			return nil, fmt.Errorf("SPKI pin %q is not a SHA-256 hash", value)
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+func verifyPin(state tls.ConnectionState, pins [][]byte) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("no server certificate presented to check SPKI pin")
+	}
+	hash := sha256.Sum256(state.PeerCertificates[0].RawSubjectPublicKeyInfo)
+	for _, pin := range pins {
+		if bytes.Equal(hash[:], pin) {
+			return nil
+		}
+	}
+	return fmt.Errorf("server certificate SPKI hash %s does not match any configured pin",
+		base64.StdEncoding.EncodeToString(hash[:]))
+}
+
+var caCache = &caCertCache{}
+
+type caCertCache struct {
+	mu        sync.Mutex
+	signature string
+	pool      *x509.CertPool
+}
+
+// LDAPCACertPool returns the pool of CA certificates used to verify the LDAP server.
+// A nil pool means the system pool should be used. CA files and directories extend the
+// system pool and are only re-read when their contents change.
+func LDAPCACertPool(config *config.Config, logger *slog.Logger) (*x509.CertPool, error) {
+	if config.LdapTLSCACert == "" && config.LdapTLSCAFile == "" && config.LdapTLSCADir == "" {
+		return nil, nil
+	}
+	files, err := caCertFiles(config)
 	if err != nil {
-		logger.Error("Error starting TLS for LDAP connection", "err", err)
+		logger.Error("Error listing LDAP CA certificate files", "err", err)
+		return nil, err
+	}
+	signature, err := caCertSignature(config.LdapTLSCACert, files)
+	if err != nil {
+		logger.Error("Error checking LDAP CA certificate files", "err", err)
+		return nil, err
+	}
+	caCache.mu.Lock()
+	defer caCache.mu.Unlock()
+	if caCache.pool != nil && caCache.signature == signature {
+		return caCache.pool, nil
+	}
+	var pool *x509.CertPool
+	if len(files) == 0 {
+		pool = x509.NewCertPool()
+	} else {
+		pool, err = x509.SystemCertPool()
+		if err != nil {
+			logger.Warn("Unable to load system CA certificates", "err", err)
+			pool = x509.NewCertPool()
+		}
+	}
+	if config.LdapTLSCACert != "" {
+		err = appendCertsFromPEM(pool, []byte(config.LdapTLSCACert), "ldap.tls-ca-cert")
+		if err != nil {
+			logger.Error("Error loading LDAP CA certificate", "err", err)
+			return nil, err
+		}
+	}
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			logger.Error("Error reading LDAP CA certificate file", "file", file, "err", err)
+			return nil, err
+		}
+		err = appendCertsFromPEM(pool, content, file)
+		if err != nil {
+			logger.Error("Error loading LDAP CA certificate file", "file", file, "err", err)
+			return nil, err
+		}
+	}
+	logger.Info("Loaded LDAP CA certificates", "files", len(files))
+	caCache.signature = signature
+	caCache.pool = pool
+	return pool, nil
+}
+
+func caCertFiles(config *config.Config) ([]string, error) {
+	files := []string{}
+	if config.LdapTLSCAFile != "" {
+		files = append(files, config.LdapTLSCAFile)
+	}
+	if config.LdapTLSCADir != "" {
+		entries, err := os.ReadDir(config.LdapTLSCADir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			switch strings.ToLower(filepath.Ext(entry.Name())) {
+			case ".pem", ".crt", ".cer":
+			default:
+				continue
+			}
+			path := filepath.Join(config.LdapTLSCADir, entry.Name())
+			info, err := os.Stat(path)
+			if err != nil {
+				return nil, err
+			}
+			if info.IsDir() {
+				continue
+			}
+			files = append(files, path)
+		}
+	}
+	return files, nil
+}
+
+func caCertSignature(inline string, files []string) (string, error) {
+	signature := []string{inline}
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", err
+		}
+		signature = append(signature, fmt.Sprintf("%s:%d:%d", file, info.Size(), info.ModTime().UnixNano()))
+	}
+	return strings.Join(signature, "\n"), nil
+}
+
+func appendCertsFromPEM(pool *x509.CertPool, content []byte, source string) error {
+	count := 0
+	rest := content
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("unable to parse certificate from %s: %w", source, err)
+		}
+		pool.AddCert(cert)
+		count++
+	}
+	if len(bytes.TrimSpace(rest)) > 0 {
+		return fmt.Errorf("unable to parse PEM data from %s", source)
+	}
+	if count == 0 {
+		return fmt.Errorf("no certificates found in %s", source)
 	}
-	return err
+	return nil
 }
 
-func LDAPUsers(l *ldap.Conn, config *config.Config, logger *slog.Logger) ([]string, error) {
+func LDAPUsers(ctx context.Context, l *ldap.Conn, info *ServerInfo, config *config.Config, logger *slog.Logger) ([]string, error) {
 	users := []string{}
+	err := searchUsers(ctx, l, info, config, nil, logger, func(entry *ldap.Entry, key string) error {
+		users = append(users, key)
+		return nil
+	})
+	return users, err
+}
+
+// searchUsers runs the user search requesting the extra attributes and passes each user
+// with the key of the user to fn, skipping inactive users.
+func searchUsers(ctx context.Context, l *ldap.Conn, info *ServerInfo, config *config.Config, extraAttrs []string, logger *slog.Logger, fn func(*ldap.Entry, string) error) error {
+	config = LDAPServerDefaults(info, config, logger)
+	return userSearch(connSearch(ctx, l, logger), config, extraAttrs, logger, fn)
+}
+
+// searchFunc runs a search passing each entry to fn.
+type searchFunc func(request *ldap.SearchRequest, queryType string, config *config.Config, fn func(*ldap.Entry) error) error
+
+// connSearch returns a searchFunc searching the directory with LDAPSearch.
+func connSearch(ctx context.Context, l *ldap.Conn, logger *slog.Logger) searchFunc {
+	return func(request *ldap.SearchRequest, queryType string, config *config.Config, fn func(*ldap.Entry) error) error {
+		return LDAPSearch(ctx, l, request, queryType, config, logger, fn)
+	}
+}
+
+// userSearch runs the user search, or each of the searches passing an entry returned by
+// more than one search to fn once.
+func userSearch(search searchFunc, config *config.Config, extraAttrs []string, logger *slog.Logger, fn func(*ldap.Entry, string) error) error {
+	attrs := append(userAttrs(config), extraAttrs...)
+	var sortControl ldap.Control
+	if config.SearchSort != "" {
+		control, err := SortControl(config.SearchSort)
+		if err != nil {
+			logger.Error("Error building sort control", "sort", config.SearchSort, "err", err)
+			return err
+		}
+		sortControl = control
+	}
+	now := time.Now()
+	metrics.MetricUsersInactive.Reset()
+	accountState := accountStateEnabled(config)
+	if accountState {
+		if err := inactiveAccounts.Load(config.AccountStateFile, logger); err != nil {
+			return err
+		}
+	}
+	searches := config.UserSearches()
+	seen := make(map[string]bool)
+	for _, searchConfig := range searches {
+		logger.Debug("Running user search", "basedn", searchConfig.UserBaseDN, "filter", searchConfig.UserFilter, "attr", config.UserUIDAttr,
+			"scope", searchConfig.UserScope, "deref", config.UserDerefAliases, "sort", config.SearchSort)
+		request, err := userSearchRequest(searchConfig, attrs)
+		if err != nil {
+			logger.Error("Error building user search", "err", err)
+			return err
+		}
+		if sortControl != nil {
+			request.Controls = append(request.Controls, sortControl)
+		}
+		err = search(request, "user", searchConfig, func(entry *ldap.Entry) error {
+			if len(searches) > 1 {
+				dn := normalizeDN(entry.DN)
+				if seen[dn] {
+					return nil
+				}
+				seen[dn] = true
+			}
+			if _, err := entryKey(entry, config); err != nil {
+				logger.Warn("Unable to determine user key", "dn", entry.DN, "err", err)
+				return nil
+			}
+			key, state, until := activeUserKey(entry, config, inactiveAccounts, now)
+			if !state.Active {
+				action := "grace"
+				if key == "" {
+					action = "excluded"
+				}
+				logger.Debug("Inactive user", "dn", entry.DN, "reason", state.Reason, "since", state.Since, "action", action, "until", until)
+				metrics.MetricUsersInactive.WithLabelValues(state.Reason, action).Inc()
+				if key == "" {
+					return nil
+				}
+			}
+			return fn(entry, key)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if accountState {
+		return inactiveAccounts.Save(now, logger)
+	}
+	return nil
+}
+
+// LDAPMaxID returns the highest uidNumber or gidNumber below the overlap base DN, or the
+// user base DN when not set. When UIDs are mapped from objectSid the top of the ID mapping
+// range is also considered.
+func LDAPMaxID(ctx context.Context, l *ldap.Conn, config *config.Config, logger *slog.Logger) (int, error) {
+	return searchMaxID(connSearch(ctx, l, logger), config, logger)
+}
+
+func searchMaxID(search searchFunc, config *config.Config, logger *slog.Logger) (int, error) {
+	baseDNs := []string{config.OverlapBaseDN}
+	if config.OverlapBaseDN == "" {
+		baseDNs = nil
+		for _, searchConfig := range config.UserSearches() {
+			baseDNs = append(baseDNs, searchConfig.UserBaseDN)
+		}
+	}
+	maxID := 0
+	if config.UserKeyMode == UserKeyObjectSID {
+		_, rangeMax, _ := sidRange(config)
+		maxID = rangeMax - 1
+	}
+	// The size limit is for the user search, this search also returns groups
+	searchConfig := *config
+	searchConfig.SearchSizeLimit = 0
+	for _, baseDN := range baseDNs {
+		logger.Debug("Running max ID search", "basedn", baseDN)
+		request := ldap.NewSearchRequest(baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+			"(|(uidNumber=*)(gidNumber=*))", []string{"uidNumber", "gidNumber"}, nil)
+		err := search(request, "maxid", &searchConfig, func(entry *ldap.Entry) error {
+			for _, attr := range []string{"uidNumber", "gidNumber"} {
+				for _, value := range entry.GetAttributeValues(attr) {
+					if id, err := strconv.Atoi(value); err == nil && id > maxID {
+						maxID = id
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	metrics.MetricLDAPMaxID.Set(float64(maxID))
+	return maxID, nil
+}
+
+// userAttrs returns the attributes needed to evaluate a user entry.
+func userAttrs(config *config.Config) []string {
 	attrs := []string{config.UserUIDAttr}
-	logger.Debug("Running user search", "basedn", config.UserBaseDN, "filter", config.UserFilter, "attr", config.UserUIDAttr)
-	request := ldap.NewSearchRequest(config.UserBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
-		config.UserFilter, attrs, nil)
-	result, err := LDAPSearch(l, request, "user", config, logger)
-	for _, entry := range result.Entries {
-		uid := entry.GetAttributeValue(config.UserUIDAttr)
-		users = append(users, uid)
+	if config.UserKeyMode == UserKeyObjectSID {
+		attrs = []string{"objectSid"}
 	}
-	return users, err
+	if accountStateEnabled(config) {
+		attrs = append(attrs, accountStateAttrs...)
+	}
+	if pipeline, err := keyTransform(config); err == nil {
+		attrs = append(attrs, pipeline.Attributes()...)
+	}
+	return attrs
 }
 
-func LDAPSearch(l *ldap.Conn, request *ldap.SearchRequest, queryType string, config *config.Config, logger *slog.Logger) (*ldap.SearchResult, error) {
-	var result *ldap.SearchResult
-	var err error
-	if config.PagedSearch {
-		result, err = l.SearchWithPaging(request, uint32(config.PagedSearchSize))
-	} else {
-		result, err = l.Search(request)
+func userKey(entry *ldap.Entry, config *config.Config) string {
+	key, _ := entryKey(entry, config)
+	return key
+}
+
+// entryKey returns the user key of the entry, either the UID attribute or the UID mapped
+// from objectSid, passed through the key transforms.
+func entryKey(entry *ldap.Entry, config *config.Config) (string, error) {
+	pipeline, err := keyTransform(config)
+	if err != nil {
+		return "", err
 	}
+	key := entry.GetAttributeValue(config.UserUIDAttr)
+	if config.UserKeyMode == UserKeyObjectSID {
+		value := entry.GetRawAttributeValue("objectSid")
+		if len(value) == 0 {
+			return "", errors.New("entry has no objectSid")
+		}
+		sid, err := ParseSID(value)
+		if err != nil {
+			return "", err
+		}
+		uid, err := SIDToUID(sid, config)
+		if err != nil {
+			return "", err
+		}
+		key = strconv.FormatUint(uint64(uid), 10)
+	}
+	if pipeline.Empty() || key == "" {
+		return key, nil
+	}
+	return pipeline.Apply(key, entry.GetAttributeValue)
+}
+
+var transformCache sync.Map
+
+// keyTransform returns the compiled key transforms, compiling them once per configuration.
+func keyTransform(config *config.Config) (*transform.Pipeline, error) {
+	cacheKey := strings.Join(config.UserKeyTransforms, "\x00")
+	if pipeline, ok := transformCache.Load(cacheKey); ok {
+		return pipeline.(*transform.Pipeline), nil
+	}
+	pipeline, err := transform.Compile(config.UserKeyTransforms)
 	if err != nil {
-		logger.Error("Error getting results", "type", queryType, "err", err)
-	} else {
-		logger.Debug("results", "type", queryType, "count", len(result.Entries))
+		return nil, err
+	}
+	transformCache.Store(cacheKey, pipeline)
+	return pipeline, nil
+}
+
+// LDAPSearch runs the search and passes each entry to fn as it is received rather than
+// collecting the full result, so with paged searches only a page of entries is in memory.
+// An error returned by fn stops the search. The configured size and time limits are also
+// enforced by the client so a server ignoring them cannot return a partial or endless result.
+// When parent ends the search is abandoned and no further pages are requested.
+func LDAPSearch(parent context.Context, l *ldap.Conn, request *ldap.SearchRequest, queryType string, config *config.Config, logger *slog.Logger, fn func(*ldap.Entry) error) error {
+	ctx, cancel := context.WithCancel(parent)
+	if config.SearchTimeLimit > 0 {
+		ctx, cancel = context.WithTimeout(parent, config.SearchTimeLimit)
+	}
+	defer cancel()
+	var paging *ldap.ControlPaging
+	if config.PagedSearch {
+		paging = ldap.NewControlPaging(uint32(config.PagedSearchSize))
+		request.Controls = append(request.Controls, paging)
+	}
+	count := 0
+	for {
+		var controls []ldap.Control
+		r := l.SearchAsync(ctx, request, searchBufferSize)
+		for r.Next() {
+			entry := r.Entry()
+			if entry == nil {
+				controls = r.Controls()
+				continue
+			}
+			count++
+			err := fn(entry)
+			if err == nil && config.SearchSizeLimit > 0 && count > config.SearchSizeLimit {
+				err = ldap.NewError(ldap.LDAPResultSizeLimitExceeded, fmt.Errorf("search returned more than %d entries", config.SearchSizeLimit))
+			}
+			if err != nil {
+				logger.Error("Error processing results", "type", queryType, "dn", entry.DN, "err", err)
+				// Drain the remaining results so the search goroutine can exit
+				cancel()
+				for r.Next() {
+				}
+				return err
+			}
+		}
+		if err := r.Err(); err != nil {
+			logger.Error("Error getting results", "type", queryType, "err", err)
+			return err
+		}
+		// The search ends without an error when the context is done
+		if parent.Err() != nil {
+			err := context.Cause(parent)
+			logger.Error("Search abandoned", "type", queryType, "err", err)
+			return err
+		}
+		if ctx.Err() != nil {
+			err := ldap.NewError(ldap.LDAPResultTimeLimitExceeded, fmt.Errorf("search did not complete within %s", config.SearchTimeLimit))
+			logger.Error("Error getting results", "type", queryType, "err", err)
+			return err
+		}
+		if paging == nil {
+			break
+		}
+		pagingResult, ok := ldap.FindControl(controls, ldap.ControlTypePaging).(*ldap.ControlPaging)
+		if !ok || len(pagingResult.Cookie) == 0 {
+			break
+		}
+		paging.SetCookie(pagingResult.Cookie)
 	}
-	return result, err
+	logger.Debug("results", "type", queryType, "count", count)
+	return nil
 }
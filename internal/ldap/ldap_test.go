@@ -14,13 +14,26 @@
 package ldap
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/metrics"
+	"strings"
 	"testing"
 	"time"
 
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/common/promslog"
 	"github.com/treydock/subid-ldap/internal/config"
+	localmetrics "github.com/treydock/subid-ldap/internal/metrics"
 	"github.com/treydock/subid-ldap/internal/test"
 )
 
@@ -52,6 +65,14 @@ func TestMain(m *testing.M) {
 	os.Exit(exitVal)
 }
 
+func testServerInfo(t *testing.T, l *ldap.Conn) *ServerInfo {
+	info, err := LDAPServerInfo(l, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return info
+}
+
 func TestLDAPConnectErr(t *testing.T) {
 	_config := getConfig()
 	_config.LdapURL = "ldap://dne:389"
@@ -100,3 +121,310 @@ func TestLDAPConnectTLSError(t *testing.T) {
 		t.Errorf("Expected an error with invalid TLS ServerName")
 	}
 }
+
+func TestLDAPConnectTLSCAFile(t *testing.T) {
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, test.LocalhostCert, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_config := getConfig()
+	_config.LdapTLS = true
+	_config.LdapTLSCAFile = caFile
+	_, err := LDAPConnect(_config, promslog.NewNopLogger())
+	if err != nil {
+		t.Errorf("Unexpected error during StartTLS: %s", err.Error())
+	}
+	if err := os.WriteFile(caFile, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(caFile, time.Now().Add(time.Minute), time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	_, err = LDAPConnect(_config, promslog.NewNopLogger())
+	if err == nil {
+		t.Errorf("Expected an error after CA file changed to invalid PEM")
+	}
+}
+
+func TestLDAPConnectTLSCADir(t *testing.T) {
+	caDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(caDir, "ca.crt"), test.LocalhostCert, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(caDir, "README"), []byte("ignored"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_config := getConfig()
+	_config.LdapTLS = true
+	_config.LdapTLSCADir = caDir
+	_, err := LDAPConnect(_config, promslog.NewNopLogger())
+	if err != nil {
+		t.Errorf("Unexpected error during StartTLS: %s", err.Error())
+	}
+}
+
+func TestLDAPCACertPoolInvalid(t *testing.T) {
+	_config := getConfig()
+	_config.LdapTLSCACert = "-----BEGIN CERTIFICATE-----\nZm9v\n-----END CERTIFICATE-----\n"
+	_, err := LDAPCACertPool(_config, promslog.NewNopLogger())
+	if err == nil {
+		t.Errorf("Expected an error with invalid CA cert")
+	}
+	_config.LdapTLSCACert = ""
+	_config.LdapTLSCAFile = "/dne/ca.pem"
+	_, err = LDAPCACertPool(_config, promslog.NewNopLogger())
+	if err == nil {
+		t.Errorf("Expected an error with missing CA file")
+	}
+}
+
+func TestLDAPConnectTLSHardening(t *testing.T) {
+	block, _ := pem.Decode(test.LocalhostCert)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	_config := getConfig()
+	_config.LdapURL = fmt.Sprintf("ldap://%s", strings.Replace(ldapserver, "127.0.0.1", "localhost", 1))
+	_config.LdapTLS = true
+	_config.LdapTLSCACert = string(test.LocalhostCert)
+	_config.LdapTLSMinVersion = "1.2"
+	_config.LdapTLSCipherSuites = []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}
+	_config.LdapTLSServerName = "127.0.0.1"
+	_config.LdapTLSPinSHA256 = []string{base64.StdEncoding.EncodeToString(hash[:])}
+	localmetrics.MetricLDAPTLSInfo.Reset()
+	_, err = LDAPConnect(_config, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error during StartTLS: %s", err.Error())
+	}
+	expected := `
+	# HELP subid_ldap_ldap_tls_info TLS version and cipher suite negotiated with the LDAP server
+	# TYPE subid_ldap_ldap_tls_info gauge
+	subid_ldap_ldap_tls_info{cipher="TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",version="TLS 1.2"} 1
+	`
+	if err := testutil.CollectAndCompare(localmetrics.MetricLDAPTLSInfo, strings.NewReader(expected)); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestLDAPConnectTLSPinMismatch(t *testing.T) {
+	hash := sha256.Sum256([]byte("foo"))
+	_config := getConfig()
+	_config.LdapTLS = true
+	_config.LdapTLSCACert = string(test.LocalhostCert)
+	_config.LdapTLSPinSHA256 = []string{base64.StdEncoding.EncodeToString(hash[:])}
+	_, err := LDAPConnect(_config, promslog.NewNopLogger())
+	if err == nil {
+		t.Errorf("Expected an error with mismatched SPKI pin")
+	}
+}
+
+func TestLDAPConnectTLSMinVersion(t *testing.T) {
+	_config := getConfig()
+	_config.LdapTLS = true
+	_config.LdapTLSCACert = string(test.LocalhostCert)
+	_config.LdapTLSMinVersion = "1.3"
+	_, err := LDAPConnect(_config, promslog.NewNopLogger())
+	if err == nil {
+		t.Errorf("Expected an error with TLS 1.3 minimum version")
+	}
+}
+
+func TestLDAPTLSConfigErrors(t *testing.T) {
+	_config := getConfig()
+	_config.LdapTLSMinVersion = "2.0"
+	if _, err := LDAPTLSConfig(_config, promslog.NewNopLogger()); err == nil {
+		t.Errorf("Expected an error with invalid TLS version")
+	}
+	_config = getConfig()
+	_config.LdapTLSCipherSuites = []string{"TLS_RSA_WITH_RC4_128_SHA"}
+	if _, err := LDAPTLSConfig(_config, promslog.NewNopLogger()); err == nil {
+		t.Errorf("Expected an error with insecure cipher suite")
+	}
+	_config = getConfig()
+	_config.LdapTLSPinSHA256 = []string{"Zm9v"}
+	if _, err := LDAPTLSConfig(_config, promslog.NewNopLogger()); err == nil {
+		t.Errorf("Expected an error with invalid SPKI pin")
+	}
+}
+
+func TestLDAPUsersBulk(t *testing.T) {
+	_config := getConfig()
+	_config.UserBaseDN = test.BulkBaseDN
+	l, err := LDAPConnect(_config, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer l.Close()
+	users, err := LDAPUsers(context.Background(), l, nil, _config, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(users) != test.BulkUsers {
+		t.Errorf("Unexpected number of users, got: %d", len(users))
+	}
+	if users[0] != "10000" {
+		t.Errorf("Unexpected first user, got: %s", users[0])
+	}
+}
+
+func TestLDAPSearchCallbackError(t *testing.T) {
+	_config := getConfig()
+	_config.UserBaseDN = test.BulkBaseDN
+	l, err := LDAPConnect(_config, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer l.Close()
+	request := ldap.NewSearchRequest(_config.UserBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		_config.UserFilter, []string{_config.UserUIDAttr}, nil)
+	count := 0
+	err = LDAPSearch(context.Background(), l, request, "user", _config, promslog.NewNopLogger(), func(entry *ldap.Entry) error {
+		count++
+		return fmt.Errorf("stop")
+	})
+	if err == nil {
+		t.Errorf("Expected an error from callback")
+	}
+	if count != 1 {
+		t.Errorf("Expected search to stop after first entry, got: %d", count)
+	}
+}
+
+// BenchmarkLDAPUsers compares the live heap once every entry has been received when
+// streaming the user search against materializing the full search result. The live-heap-B
+// of the streaming search stays flat as the number of users grows while the materialized
+// search grows with every entry.
+func BenchmarkLDAPUsers(b *testing.B) {
+	defer func(users int) { test.BulkUsers = users }(test.BulkUsers)
+	_config := getConfig()
+	_config.UserBaseDN = test.BulkBaseDN
+	l, err := LDAPConnect(_config, promslog.NewNopLogger())
+	if err != nil {
+		b.Fatalf("Unexpected error: %s", err)
+	}
+	defer l.Close()
+	newRequest := func() *ldap.SearchRequest {
+		return ldap.NewSearchRequest(_config.UserBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+			_config.UserFilter, []string{"*"}, nil)
+	}
+	for _, size := range []int{1000, 10000, 50000} {
+		test.BulkUsers = size
+		b.Run(fmt.Sprintf("stream-%d", size), func(b *testing.B) {
+			var heap uint64
+			for b.Loop() {
+				base := liveHeap()
+				count := 0
+				err := LDAPSearch(context.Background(), l, newRequest(), "user", _config, promslog.NewNopLogger(), func(entry *ldap.Entry) error {
+					count++
+					if count == size {
+						heap = max(heap, liveHeap()-min(base, liveHeap()))
+					}
+					return nil
+				})
+				if err != nil || count != size {
+					b.Fatalf("Unexpected result %d: %v", count, err)
+				}
+			}
+			b.ReportMetric(float64(heap), "live-heap-B")
+		})
+		b.Run(fmt.Sprintf("materialize-%d", size), func(b *testing.B) {
+			var heap uint64
+			for b.Loop() {
+				base := liveHeap()
+				result, err := l.Search(newRequest())
+				if err != nil || len(result.Entries) != size {
+					b.Fatalf("Unexpected result: %v", err)
+				}
+				heap = max(heap, liveHeap()-min(base, liveHeap()))
+				runtime.KeepAlive(result)
+			}
+			b.ReportMetric(float64(heap), "live-heap-B")
+		})
+	}
+}
+
+// liveHeap returns the bytes of live heap objects after a garbage collection.
+func liveHeap() uint64 {
+	runtime.GC()
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(sample)
+	return sample[0].Value.Uint64()
+}
+
+func TestLDAPSearchContextCanceled(t *testing.T) {
+	_config := getConfig()
+	_config.UserBaseDN = test.BulkBaseDN
+	l, err := LDAPConnect(_config, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer l.Close()
+	request := ldap.NewSearchRequest(_config.UserBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		_config.UserFilter, []string{_config.UserUIDAttr}, nil)
+	cause := errors.New("run timed out")
+	ctx, cancel := context.WithCancelCause(context.Background())
+	count := 0
+	err = LDAPSearch(ctx, l, request, "user", _config, promslog.NewNopLogger(), func(entry *ldap.Entry) error {
+		count++
+		if count == 1 {
+			cancel(cause)
+		}
+		return nil
+	})
+	if !errors.Is(err, cause) {
+		t.Errorf("Expected cancel cause, got: %v", err)
+	}
+	if count >= test.BulkUsers {
+		t.Errorf("Expected search to be abandoned, got %d entries", count)
+	}
+}
+
+func TestLDAPUsersKeyTransform(t *testing.T) {
+	_config := getConfig()
+	_config.UserBaseDN = test.BulkBaseDN
+	_config.UserUIDAttr = "uid"
+	_config.UserKeyTransforms = []string{"regex:/^bulk//", "template:{{.value}}-{{.uidNumber}}"}
+	l, err := LDAPConnect(_config, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer l.Close()
+	users, err := LDAPUsers(context.Background(), l, nil, _config, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(users) != test.BulkUsers {
+		t.Fatalf("Unexpected number of users, got: %d", len(users))
+	}
+	if users[0] != "user0-10000" {
+		t.Errorf("Unexpected first user, got: %s", users[0])
+	}
+}
+
+func TestLDAPMaxID(t *testing.T) {
+	_config := getConfig()
+	_config.OverlapBaseDN = test.BulkBaseDN
+	_config.SearchSizeLimit = 10
+	l, err := LDAPConnect(_config, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer l.Close()
+	maxID, err := LDAPMaxID(context.Background(), l, _config, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if maxID != 10000+test.BulkUsers-1 {
+		t.Errorf("Unexpected max ID, got: %d", maxID)
+	}
+	_config.UserKeyMode = UserKeyObjectSID
+	maxID, err = LDAPMaxID(context.Background(), l, _config, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if maxID != SIDRangeMax-1 {
+		t.Errorf("Unexpected max ID with ID mapping, got: %d", maxID)
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldap
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/treydock/subid-ldap/internal/config"
+	"github.com/treydock/subid-ldap/internal/metrics"
+)
+
+// LDAPRootDSE reads the RootDSE of the LDAP server.
+func LDAPRootDSE(l *ldap.Conn, logger *slog.Logger) (*ldap.Entry, error) {
+	request := ldap.NewSearchRequest("", ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{"*", "+"}, nil)
+	result, err := l.Search(request)
+	if err != nil {
+		logger.Error("Error reading RootDSE", "err", err)
+		return nil, err
+	}
+	if len(result.Entries) != 1 {
+		err = fmt.Errorf("expected one RootDSE entry, got %d", len(result.Entries))
+		logger.Error("Error reading RootDSE", "err", err)
+		return nil, err
+	}
+	return result.Entries[0], nil
+}
+
+const (
+	VendorActiveDirectory = "Active Directory"
+	VendorOpenLDAP        = "OpenLDAP"
+	Vendor389DS           = "389 Directory Server"
+	VendorUnknown         = "unknown"
+
+	capabilityActiveDirectory    = "1.2.840.113556.1.4.800"
+	capabilityActiveDirectoryLDS = "1.2.840.113556.1.4.1851"
+	// Active Directory default MaxPageSize
+	activeDirectoryMaxPageSize = 1000
+)
+
+// ServerInfo describes the LDAP server based on its RootDSE.
+type ServerInfo struct {
+	Vendor            string
+	VendorVersion     string
+	SupportedControls []string
+	DNSHostName       string
+	DSServiceName     string
+	InvocationID      string
+}
+
+// Identity identifies the server instance, values such as uSNChanged are only comparable
+// between searches of the same instance. Active Directory gives each domain controller a
+// dsServiceName and a new invocationId when its database is restored.
+func (s *ServerInfo) Identity() string {
+	return strings.Join([]string{s.DSServiceName, s.InvocationID, s.DNSHostName}, "\n")
+}
+
+func (s *ServerInfo) SupportsControl(oid string) bool {
+	for _, control := range s.SupportedControls {
+		if control == oid {
+			return true
+		}
+	}
+	return false
+}
+
+// LDAPServerInfo reads the RootDSE and detects the LDAP server vendor.
+func LDAPServerInfo(l *ldap.Conn, logger *slog.Logger) (*ServerInfo, error) {
+	rootDSE, err := LDAPRootDSE(l, logger)
+	if err != nil {
+		return nil, err
+	}
+	info := serverInfo(rootDSE)
+	if info.DSServiceName != "" {
+		info.InvocationID = invocationID(l, info.DSServiceName, logger)
+	}
+	logger.Info("Detected LDAP server", "vendor", info.Vendor, "version", info.VendorVersion,
+		"paging", info.SupportsControl(ldap.ControlTypePaging))
+	metrics.MetricLDAPServerInfo.Reset()
+	metrics.MetricLDAPServerInfo.WithLabelValues(info.Vendor, info.VendorVersion).Set(1)
+	return info, nil
+}
+
+func serverInfo(rootDSE *ldap.Entry) *ServerInfo {
+	info := &ServerInfo{
+		Vendor:            VendorUnknown,
+		VendorVersion:     rootDSE.GetAttributeValue("vendorVersion"),
+		SupportedControls: rootDSE.GetAttributeValues("supportedControl"),
+		DNSHostName:       rootDSE.GetAttributeValue("dnsHostName"),
+		DSServiceName:     rootDSE.GetAttributeValue("dsServiceName"),
+	}
+	vendorName := strings.ToLower(rootDSE.GetAttributeValue("vendorName"))
+	capabilities := rootDSE.GetAttributeValues("supportedCapabilities")
+	objectClasses := rootDSE.GetAttributeValues("objectClass")
+	switch {
+	case slices.Contains(capabilities, capabilityActiveDirectory) || slices.Contains(capabilities, capabilityActiveDirectoryLDS):
+		info.Vendor = VendorActiveDirectory
+		if info.VendorVersion == "" {
+			info.VendorVersion = rootDSE.GetAttributeValue("domainControllerFunctionality")
+		}
+	case strings.Contains(vendorName, "389 project") || strings.Contains(vendorName, "fedora project") ||
+		strings.Contains(vendorName, "red hat") || strings.Contains(strings.ToLower(info.VendorVersion), "389-directory"):
+		info.Vendor = Vendor389DS
+	case slices.ContainsFunc(objectClasses, func(oc string) bool { return strings.EqualFold(oc, "OpenLDAProotDSE") }):
+		info.Vendor = VendorOpenLDAP
+	}
+	return info
+}
+
+// invocationID reads the invocationId of an Active Directory domain controller from its NTDS settings.
+func invocationID(l *ldap.Conn, dsServiceName string, logger *slog.Logger) string {
+	request := ldap.NewSearchRequest(dsServiceName, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{"invocationId"}, nil)
+	result, err := l.Search(request)
+	if err != nil || len(result.Entries) != 1 {
+		logger.Debug("Unable to read invocationId", "dn", dsServiceName, "err", err)
+		return ""
+	}
+	return hex.EncodeToString(result.Entries[0].GetRawAttributeValue("invocationId"))
+}
+
+// LDAPServerDefaults returns a copy of config with defaults for the detected LDAP server applied.
+// Paged searches are enabled when the server supports them and always for Active Directory.
+// Settings given explicitly are left unchanged, info is nil when the server could not be detected.
+func LDAPServerDefaults(info *ServerInfo, config *config.Config, logger *slog.Logger) *config.Config {
+	if !config.LdapAutoDetect {
+		return config
+	}
+	if info == nil {
+		logger.Warn("Unable to detect LDAP server, using configured settings")
+		return config
+	}
+	if config.PagedSearch {
+		logger.Debug("Paged search configured explicitly, not applying server defaults", "vendor", info.Vendor)
+		return config
+	}
+	return serverDefaults(info, config, logger)
+}
+
+func serverDefaults(info *ServerInfo, config *config.Config, logger *slog.Logger) *config.Config {
+	c := *config
+	if info.SupportsControl(ldap.ControlTypePaging) || info.Vendor == VendorActiveDirectory {
+		logger.Debug("Enabling paged search", "vendor", info.Vendor)
+		c.PagedSearch = true
+	}
+	if info.Vendor == VendorActiveDirectory && c.PagedSearchSize > activeDirectoryMaxPageSize {
+		c.PagedSearchSize = activeDirectoryMaxPageSize
+	}
+	return &c
+}
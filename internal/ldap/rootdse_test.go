@@ -0,0 +1,139 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldap
+
+import (
+	"context"
+	"testing"
+
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/prometheus/common/promslog"
+)
+
+func TestServerInfo(t *testing.T) {
+	tests := []struct {
+		name   string
+		attrs  map[string][]string
+		vendor string
+	}{
+		{
+			name: "ad",
+			attrs: map[string][]string{
+				"supportedCapabilities":         {"1.2.840.113556.1.4.800", "1.2.840.113556.1.4.1670"},
+				"supportedControl":              {ldap.ControlTypePaging},
+				"domainControllerFunctionality": {"7"},
+			},
+			vendor: VendorActiveDirectory,
+		},
+		{
+			name: "389ds",
+			attrs: map[string][]string{
+				"vendorName":       {"389 Project"},
+				"vendorVersion":    {"389-Directory/2.4.5 B2024.019.0000"},
+				"supportedControl": {ldap.ControlTypePaging, ControlTypePersistentSearch},
+			},
+			vendor: Vendor389DS,
+		},
+		{
+			name: "openldap",
+			attrs: map[string][]string{
+				"objectClass": {"top", "OpenLDAProotDSE"},
+			},
+			vendor: VendorOpenLDAP,
+		},
+		{
+			name:   "unknown",
+			attrs:  map[string][]string{"objectClass": {"top"}},
+			vendor: VendorUnknown,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := serverInfo(ldap.NewEntry("", tt.attrs))
+			if info.Vendor != tt.vendor {
+				t.Errorf("Unexpected vendor, got %s expected %s", info.Vendor, tt.vendor)
+			}
+		})
+	}
+}
+
+func TestServerInfoIdentity(t *testing.T) {
+	attrs := map[string][]string{
+		"supportedCapabilities": {"1.2.840.113556.1.4.800"},
+		"dnsHostName":           {"dc1.example.com"},
+		"dsServiceName":         {"CN=NTDS Settings,CN=DC1,CN=Servers,CN=Default-First-Site-Name,CN=Sites,CN=Configuration,DC=example,DC=com"},
+	}
+	info := serverInfo(ldap.NewEntry("", attrs))
+	other := serverInfo(ldap.NewEntry("", attrs))
+	if info.Identity() != other.Identity() {
+		t.Errorf("Expected same identity, got %q and %q", info.Identity(), other.Identity())
+	}
+	// A restored domain controller has a new invocationId
+	other.InvocationID = "0123456789abcdef0123456789abcdef"
+	if info.Identity() == other.Identity() {
+		t.Errorf("Expected identity to change with invocationId")
+	}
+	attrs["dnsHostName"] = []string{"dc2.example.com"}
+	if info.Identity() == serverInfo(ldap.NewEntry("", attrs)).Identity() {
+		t.Errorf("Expected identity to change with dnsHostName")
+	}
+}
+
+func TestServerDefaults(t *testing.T) {
+	_config := getConfig()
+	_config.PagedSearchSize = 5000
+	info := &ServerInfo{Vendor: VendorActiveDirectory}
+	c := serverDefaults(info, _config, promslog.NewNopLogger())
+	if !c.PagedSearch || c.PagedSearchSize != 1000 {
+		t.Errorf("Expected AD to use paged search of 1000, got %t %d", c.PagedSearch, c.PagedSearchSize)
+	}
+	if _config.PagedSearch {
+		t.Errorf("Original config should not be modified")
+	}
+	info = &ServerInfo{Vendor: VendorOpenLDAP}
+	c = serverDefaults(info, _config, promslog.NewNopLogger())
+	if c.PagedSearch {
+		t.Errorf("Expected no paged search when not supported")
+	}
+}
+
+func TestLDAPServerDefaults(t *testing.T) {
+	_config := getConfig()
+	_config.LdapAutoDetect = true
+	_config.PagedSearchSize = 1000
+	l, err := LDAPConnect(_config, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer l.Close()
+	info := testServerInfo(t, l)
+	c := LDAPServerDefaults(info, _config, promslog.NewNopLogger())
+	if !c.PagedSearch {
+		t.Errorf("Expected paged search to be enabled")
+	}
+	users, err := LDAPUsers(context.Background(), l, info, _config, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(users) != 4 {
+		t.Errorf("Unexpected users, got: %v", users)
+	}
+	if c := LDAPServerDefaults(nil, _config, promslog.NewNopLogger()); c != _config {
+		t.Errorf("Expected undetected server to leave the config unchanged")
+	}
+	_config.PagedSearch = true
+	if c := LDAPServerDefaults(info, _config, promslog.NewNopLogger()); c != _config {
+		t.Errorf("Expected explicit paged search to leave the config unchanged")
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldap
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/treydock/subid-ldap/internal/config"
+)
+
+const (
+	ScopeBase = "base"
+	ScopeOne  = "one"
+	ScopeSub  = "sub"
+
+	DerefNever  = "never"
+	DerefSearch = "search"
+	DerefFind   = "find"
+	DerefAlways = "always"
+)
+
+var (
+	SearchScopes = []string{ScopeBase, ScopeOne, ScopeSub}
+	DerefAliases = []string{DerefNever, DerefSearch, DerefFind, DerefAlways}
+)
+
+// SearchScope returns the LDAP scope for the scope name, an empty name is a subtree search.
+func SearchScope(name string) (int, error) {
+	switch name {
+	case ScopeBase:
+		return ldap.ScopeBaseObject, nil
+	case ScopeOne:
+		return ldap.ScopeSingleLevel, nil
+	case ScopeSub, "":
+		return ldap.ScopeWholeSubtree, nil
+	}
+	return 0, fmt.Errorf("unknown search scope %q", name)
+}
+
+// SearchDerefAliases returns the LDAP alias dereferencing policy for the name, an empty
+// name never dereferences aliases.
+func SearchDerefAliases(name string) (int, error) {
+	switch name {
+	case DerefNever, "":
+		return ldap.NeverDerefAliases, nil
+	case DerefSearch:
+		return ldap.DerefInSearching, nil
+	case DerefFind:
+		return ldap.DerefFindingBaseObj, nil
+	case DerefAlways:
+		return ldap.DerefAlways, nil
+	}
+	return 0, fmt.Errorf("unknown alias dereferencing policy %q", name)
+}
+
+// userSearchRequest builds the search for users using the configured scope, alias
+// dereferencing and limits.
+func userSearchRequest(config *config.Config, attrs []string) (*ldap.SearchRequest, error) {
+	scope, err := SearchScope(config.UserScope)
+	if err != nil {
+		return nil, err
+	}
+	deref, err := SearchDerefAliases(config.UserDerefAliases)
+	if err != nil {
+		return nil, err
+	}
+	timeLimit := int(math.Ceil(config.SearchTimeLimit.Seconds()))
+	return ldap.NewSearchRequest(config.UserBaseDN, scope, deref, config.SearchSizeLimit, timeLimit, false,
+		config.UserFilter, attrs, nil), nil
+}
+
+// SortControl returns a non-critical server-side sort control for the sort attribute,
+// an attribute prefixed with - is sorted in reverse order.
+func SortControl(attr string) (ldap.Control, error) {
+	reverse := strings.HasPrefix(attr, "-")
+	attr = strings.TrimPrefix(attr, "-")
+	if attr == "" {
+		return nil, fmt.Errorf("sort attribute must not be empty")
+	}
+	return &controlServerSideSorting{AttributeType: attr, Reverse: reverse}, nil
+}
+
+// controlServerSideSorting is a RFC 2891 sort request with a single sort key. The go-ldap
+// control always sends an orderingRule which some servers reject when it is empty.
+type controlServerSideSorting struct {
+	AttributeType string
+	Reverse       bool
+}
+
+func (c *controlServerSideSorting) GetControlType() string {
+	return ldap.ControlTypeServerSideSorting
+}
+
+func (c *controlServerSideSorting) Encode() *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Control")
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, ldap.ControlTypeServerSideSorting, "Control Type (Server Side Sorting)"))
+	value := ber.Encode(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, nil, "Control Value (Server Side Sorting)")
+	keys := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "SortKeyList")
+	key := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "SortKey")
+	key.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, c.AttributeType, "attributeType"))
+	if c.Reverse {
+		key.AppendChild(ber.NewBoolean(ber.ClassContext, ber.TypePrimitive, 1, true, "reverseOrder"))
+	}
+	keys.AppendChild(key)
+	value.AppendChild(keys)
+	packet.AppendChild(value)
+	return packet
+}
+
+func (c *controlServerSideSorting) String() string {
+	return fmt.Sprintf("Control Type: Server Side Sorting (%q)  AttributeType: %s  Reverse: %t",
+		ldap.ControlTypeServerSideSorting, c.AttributeType, c.Reverse)
+}
@@ -0,0 +1,133 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldap
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/prometheus/common/promslog"
+	"github.com/treydock/subid-ldap/internal/test"
+)
+
+func TestUserSearchRequest(t *testing.T) {
+	_config := getConfig()
+	_config.UserScope = ScopeOne
+	_config.UserDerefAliases = DerefAlways
+	_config.SearchSizeLimit = 10
+	_config.SearchTimeLimit = 1500 * time.Millisecond
+	request, err := userSearchRequest(_config, []string{"uid"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if request.Scope != ldap.ScopeSingleLevel {
+		t.Errorf("Unexpected scope, got: %d", request.Scope)
+	}
+	if request.DerefAliases != ldap.DerefAlways {
+		t.Errorf("Unexpected deref, got: %d", request.DerefAliases)
+	}
+	if request.SizeLimit != 10 {
+		t.Errorf("Unexpected size limit, got: %d", request.SizeLimit)
+	}
+	if request.TimeLimit != 2 {
+		t.Errorf("Unexpected time limit, got: %d", request.TimeLimit)
+	}
+	_config = getConfig()
+	request, err = userSearchRequest(_config, []string{"uid"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if request.Scope != ldap.ScopeWholeSubtree || request.DerefAliases != ldap.NeverDerefAliases || request.SizeLimit != 0 || request.TimeLimit != 0 {
+		t.Errorf("Unexpected defaults, got: %+v", request)
+	}
+	_config.UserScope = "foo"
+	if _, err = userSearchRequest(_config, nil); err == nil {
+		t.Errorf("Expected error with invalid scope")
+	}
+	_config = getConfig()
+	_config.UserDerefAliases = "foo"
+	if _, err = userSearchRequest(_config, nil); err == nil {
+		t.Errorf("Expected error with invalid deref")
+	}
+}
+
+func TestSortControl(t *testing.T) {
+	control, err := SortControl("-uidNumber")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	packet := ber.DecodePacket(control.Encode().Bytes())
+	if oid := packet.Children[0].Value.(string); oid != ldap.ControlTypeServerSideSorting {
+		t.Errorf("Unexpected control type, got: %s", oid)
+	}
+	if len(packet.Children) != 2 {
+		t.Fatalf("Expected non-critical control without criticality, got %d children", len(packet.Children))
+	}
+	value := ber.DecodePacket(packet.Children[1].Data.Bytes())
+	key := value.Children[0]
+	if len(key.Children) != 2 {
+		t.Fatalf("Expected attribute and reverse order without ordering rule, got %d children", len(key.Children))
+	}
+	if attr := key.Children[0].Value.(string); attr != "uidNumber" {
+		t.Errorf("Unexpected sort attribute, got: %s", attr)
+	}
+	if key.Children[1].Tag != 1 || key.Children[1].Data.Bytes()[0] == 0 {
+		t.Errorf("Expected reverse order")
+	}
+	if _, err = SortControl("-"); err == nil {
+		t.Errorf("Expected error with empty sort attribute")
+	}
+}
+
+func TestLDAPUsersLimits(t *testing.T) {
+	_config := getConfig()
+	_config.UserBaseDN = test.BulkBaseDN
+	_config.UserScope = ScopeOne
+	_config.SearchSort = "uidNumber"
+	l, err := LDAPConnect(_config, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer l.Close()
+	users, err := LDAPUsers(context.Background(), l, nil, _config, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(users) != test.BulkUsers {
+		t.Errorf("Unexpected number of users, got: %d", len(users))
+	}
+	_config.SearchSizeLimit = 10
+	_, err = LDAPUsers(context.Background(), l, nil, _config, promslog.NewNopLogger())
+	if !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		t.Errorf("Expected size limit error, got: %v", err)
+	}
+	_config.SearchSizeLimit = 0
+	_config.SearchTimeLimit = time.Nanosecond
+	_, err = LDAPUsers(context.Background(), l, nil, _config, promslog.NewNopLogger())
+	if !ldap.IsErrorWithCode(err, ldap.LDAPResultTimeLimitExceeded) {
+		t.Errorf("Expected time limit error, got: %v", err)
+	}
+	// The connection remains usable after the search was stopped
+	_config.SearchTimeLimit = 0
+	users, err = LDAPUsers(context.Background(), l, nil, _config, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(users) != test.BulkUsers {
+		t.Errorf("Unexpected number of users, got: %d", len(users))
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+
+	"github.com/treydock/subid-ldap/internal/config"
+)
+
+const (
+	UserKeyAttribute = "attribute"
+	UserKeyObjectSID = "objectsid"
+
+	// SSSD ldap_idmap_range_min, ldap_idmap_range_max and ldap_idmap_range_size defaults
+	SIDRangeMin  = 200000
+	SIDRangeMax  = 2000200000
+	SIDRangeSize = 200000
+
+	sidHashSeed = 0xdeadbeef
+)
+
+var UserKeyModes = []string{UserKeyAttribute, UserKeyObjectSID}
+
+// SID is a decoded Windows security identifier.
+type SID struct {
+	Revision       uint8
+	Authority      uint64
+	SubAuthorities []uint32
+}
+
+// ParseSID decodes the binary objectSid attribute value.
+func ParseSID(value []byte) (SID, error) {
+	if len(value) < 8 {
+		return SID{}, errors.New("SID is too short")
+	}
+	count := int(value[1])
+	if len(value) != 8+4*count {
+		return SID{}, fmt.Errorf("SID length %d does not match %d sub-authorities", len(value), count)
+	}
+	sid := SID{Revision: value[0]}
+	for _, b := range value[2:8] {
+		sid.Authority = sid.Authority<<8 | uint64(b)
+	}
+	for i := 0; i < count; i++ {
+		sid.SubAuthorities = append(sid.SubAuthorities, binary.LittleEndian.Uint32(value[8+4*i:]))
+	}
+	return sid, nil
+}
+
+func (s SID) String() string {
+	parts := []string{"S", strconv.Itoa(int(s.Revision)), strconv.FormatUint(s.Authority, 10)}
+	for _, sub := range s.SubAuthorities {
+		parts = append(parts, strconv.FormatUint(uint64(sub), 10))
+	}
+	return strings.Join(parts, "-")
+}
+
+// Domain returns the domain SID and relative identifier of the SID.
+func (s SID) Domain() (string, uint32, error) {
+	if len(s.SubAuthorities) < 2 {
+		return "", 0, fmt.Errorf("SID %s has no domain", s)
+	}
+	domain := SID{Revision: s.Revision, Authority: s.Authority, SubAuthorities: s.SubAuthorities[:len(s.SubAuthorities)-1]}
+	return domain.String(), s.SubAuthorities[len(s.SubAuthorities)-1], nil
+}
+
+// SIDToUID maps the SID to the UID SSSD assigns with ID mapping. The slice of a domain is
+// chosen by hashing the domain SID, RIDs beyond the range size use secondary slices named
+// after the domain SID and the first RID of the slice. With autorid compatibility the
+// domain uses the first slice and only RIDs within it can be mapped.
+func SIDToUID(sid SID, config *config.Config) (uint32, error) {
+	domain, rid, err := sid.Domain()
+	if err != nil {
+		return 0, err
+	}
+	rangeMin, rangeMax, rangeSize := sidRange(config)
+	if rangeSize <= 0 || rangeMax <= rangeMin {
+		return 0, errors.New("invalid ID mapping range")
+	}
+	slices := uint32((rangeMax - rangeMin) / rangeSize)
+	if slices == 0 {
+		return 0, errors.New("ID mapping range is smaller than the range size")
+	}
+	firstRID := rid - rid%uint32(rangeSize)
+	var slice uint32
+	switch {
+	case firstRID != 0 && config.SIDAutoridCompat:
+		return 0, fmt.Errorf("RID %d of %s is outside the first slice in autorid compatibility mode", rid, sid)
+	case firstRID != 0:
+		primary := domainSlice(domain, slices, config)
+		slice = murmurHash3([]byte(fmt.Sprintf("%s-%d", domain, firstRID)), sidHashSeed) % slices
+		// SSSD moves a slice that collides with an existing one to the next free slice
+		if slice == primary {
+			slice = (slice + 1) % slices
+		}
+	default:
+		slice = domainSlice(domain, slices, config)
+	}
+	uid := uint64(rangeMin) + uint64(slice)*uint64(rangeSize) + uint64(rid-firstRID)
+	return uint32(uid), nil
+}
+
+func domainSlice(domain string, slices uint32, config *config.Config) uint32 {
+	if config.SIDAutoridCompat || (config.SIDDefaultDomainSID != "" && config.SIDDefaultDomainSID == domain) {
+		return 0
+	}
+	return murmurHash3([]byte(domain), sidHashSeed) % slices
+}
+
+func sidRange(config *config.Config) (int, int, int) {
+	rangeMin, rangeMax, rangeSize := config.SIDRangeMin, config.SIDRangeMax, config.SIDRangeSize
+	if rangeMin == 0 && rangeMax == 0 {
+		rangeMin, rangeMax = SIDRangeMin, SIDRangeMax
+	}
+	if rangeSize == 0 {
+		rangeSize = SIDRangeSize
+	}
+	return rangeMin, rangeMax, rangeSize
+}
+
+// murmurHash3 is the 32-bit x86 MurmurHash3 used by SSSD.
+func murmurHash3(data []byte, seed uint32) uint32 {
+	const (
+		c1 = 0xcc9e2d51
+		c2 = 0x1b873593
+	)
+	h := seed
+	blocks := len(data) / 4
+	for i := 0; i < blocks; i++ {
+		k := binary.LittleEndian.Uint32(data[i*4:])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		h ^= k
+		h = bits.RotateLeft32(h, 13)
+		h = h*5 + 0xe6546b64
+	}
+	tail := data[blocks*4:]
+	var k uint32
+	switch len(tail) {
+	case 3:
+		k ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(tail[0])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		h ^= k
+	}
+	h ^= uint32(len(data))
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
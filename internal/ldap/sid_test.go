@@ -0,0 +1,188 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldap
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/promslog"
+	"github.com/treydock/subid-ldap/internal/test"
+)
+
+func TestMurmurHash3(t *testing.T) {
+	tests := []struct {
+		data     string
+		seed     uint32
+		expected uint32
+	}{
+		{data: "", seed: 0, expected: 0},
+		{data: "", seed: 1, expected: 0x514e28b7},
+		{data: "hello", seed: 0, expected: 0x248bfa47},
+		{data: "The quick brown fox jumps over the lazy dog", seed: 0, expected: 0x2e4ff723},
+		// Expected hash of a domain SID from the SSSD pysss_murmur tests
+		{data: "S-1-5-21-2153326666-2176343378-3404031434", seed: sidHashSeed, expected: 93103853},
+	}
+	for _, tt := range tests {
+		if hash := murmurHash3([]byte(tt.data), tt.seed); hash != tt.expected {
+			t.Errorf("Unexpected hash of %q, got: %x", tt.data, hash)
+		}
+	}
+}
+
+func TestParseSID(t *testing.T) {
+	sid, err := ParseSID(test.BulkSID(1104))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if sid.String() != "S-1-5-21-1-2-3-1104" {
+		t.Errorf("Unexpected SID, got: %s", sid)
+	}
+	domain, rid, err := sid.Domain()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if domain != "S-1-5-21-1-2-3" || rid != 1104 {
+		t.Errorf("Unexpected domain %s rid %d", domain, rid)
+	}
+	if _, err = ParseSID([]byte{1, 5, 0}); err == nil {
+		t.Errorf("Expected error with short SID")
+	}
+	if _, err = ParseSID(test.BulkSID(1104)[:20]); err == nil {
+		t.Errorf("Expected error with truncated SID")
+	}
+}
+
+func TestSIDToUID(t *testing.T) {
+	_config := getConfig()
+	sid, _ := ParseSID(test.BulkSID(1104))
+	uid, err := SIDToUID(sid, _config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if uid != 686201104 {
+		t.Errorf("Unexpected UID, got: %d", uid)
+	}
+	_config.SIDDefaultDomainSID = "S-1-5-21-1-2-3"
+	if uid, _ = SIDToUID(sid, _config); uid != 201104 {
+		t.Errorf("Unexpected UID for default domain, got: %d", uid)
+	}
+	_config.SIDDefaultDomainSID = ""
+	_config.SIDAutoridCompat = true
+	if uid, _ = SIDToUID(sid, _config); uid != 201104 {
+		t.Errorf("Unexpected UID with autorid compat, got: %d", uid)
+	}
+	secondary, _ := ParseSID(test.BulkSID(401104))
+	if _, err = SIDToUID(secondary, _config); err == nil {
+		t.Errorf("Expected error for secondary slice with autorid compat")
+	}
+	_config.SIDAutoridCompat = false
+	uid, err = SIDToUID(secondary, _config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if uid != 313801104 {
+		t.Errorf("Unexpected UID for secondary slice, got: %d", uid)
+	}
+	_config.SIDRangeMin = 100000
+	_config.SIDRangeMax = 300000
+	_config.SIDRangeSize = 100000
+	if uid, _ = SIDToUID(sid, _config); uid < 100000 || uid >= 300000 {
+		t.Errorf("Unexpected UID outside custom range, got: %d", uid)
+	}
+}
+
+func TestSIDToUIDVectors(t *testing.T) {
+	// The domain hashes to 93103853 so with the SSSD default range of 10000 slices of
+	// 200000 its primary slice is 3853
+	const domain = "S-1-5-21-2153326666-2176343378-3404031434"
+	tests := []struct {
+		sid      string
+		autorid  bool
+		expected uint32
+	}{
+		{sid: domain + "-500", expected: 770800500},
+		{sid: domain + "-1104", expected: 770801104},
+		{sid: domain + "-199999", expected: 770999999},
+		// Secondary slice named S-1-5-21-2153326666-2176343378-3404031434-200000
+		{sid: domain + "-200500", expected: 504400500},
+		// Secondary slice that hashes to the primary slice 3853 moves to slice 3854
+		{sid: domain + "-120400005", expected: 771000005},
+		// Primary slice 9999 is the last slice so a colliding secondary slice wraps to slice 0
+		{sid: "S-1-5-21-1-2-2198-1897400007", expected: 200007},
+		{sid: domain + "-500", autorid: true, expected: 200500},
+		{sid: domain + "-199999", autorid: true, expected: 399999},
+	}
+	for _, tt := range tests {
+		_config := getConfig()
+		_config.SIDAutoridCompat = tt.autorid
+		uid, err := SIDToUID(parseSIDString(t, tt.sid), _config)
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %s", tt.sid, err)
+			continue
+		}
+		if uid != tt.expected {
+			t.Errorf("Unexpected UID for %s autorid=%t, got: %d expected: %d", tt.sid, tt.autorid, uid, tt.expected)
+		}
+	}
+	_config := getConfig()
+	_config.SIDAutoridCompat = true
+	if _, err := SIDToUID(parseSIDString(t, domain+"-200000"), _config); err == nil {
+		t.Errorf("Expected error for RID outside the first slice with autorid compat")
+	}
+}
+
+// parseSIDString parses the S-1-... form of a SID.
+func parseSIDString(t *testing.T, value string) SID {
+	parts := strings.Split(value, "-")
+	revision, _ := strconv.ParseUint(parts[1], 10, 8)
+	authority, _ := strconv.ParseUint(parts[2], 10, 64)
+	sid := SID{Revision: uint8(revision), Authority: authority}
+	for _, part := range parts[3:] {
+		sub, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			t.Fatalf("Invalid SID %s: %s", value, err)
+		}
+		sid.SubAuthorities = append(sid.SubAuthorities, uint32(sub))
+	}
+	if sid.String() != value {
+		t.Fatalf("Unexpected SID, got: %s", sid)
+	}
+	return sid
+}
+
+func TestLDAPUsersObjectSID(t *testing.T) {
+	_config := getConfig()
+	_config.UserBaseDN = test.BulkBaseDN
+	_config.UserKeyMode = UserKeyObjectSID
+	_config.SIDDefaultDomainSID = "S-1-5-21-1-2-3"
+	l, err := LDAPConnect(_config, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer l.Close()
+	users, err := LDAPUsers(context.Background(), l, nil, _config, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(users) != test.BulkUsers {
+		t.Fatalf("Unexpected number of users, got: %d", len(users))
+	}
+	if users[0] != fmt.Sprintf("%d", 201000) {
+		t.Errorf("Unexpected first user, got: %s", users[0])
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldap
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/treydock/subid-ldap/internal/config"
+	"github.com/treydock/subid-ldap/internal/subid"
+)
+
+const (
+	// FreeIPA ipaSubordinateIdEntry attributes
+	SubUIDStartAttr = "ipaSubUidNumber"
+	SubUIDCountAttr = "ipaSubUidCount"
+	SubGIDStartAttr = "ipaSubGidNumber"
+	SubGIDCountAttr = "ipaSubGidCount"
+	SubIDFilter     = "(objectClass=ipaSubordinateIdEntry)"
+)
+
+// LDAPSubIDs reads the subordinate ID ranges assigned to users in LDAP. Without an owner
+// attribute the ranges are read from the user entries, otherwise from entries below the
+// subid base DN that reference the user entry DN with the owner attribute like FreeIPA.
+// When the subgid attributes are missing the subuid range is also used for subgid.
+func LDAPSubIDs(ctx context.Context, l *ldap.Conn, info *ServerInfo, config *config.Config, logger *slog.Logger) ([]subid.SubIDEntry, []subid.SubIDEntry, error) {
+	subuids := []subid.SubIDEntry{}
+	subgids := []subid.SubIDEntry{}
+	attrs := []string{config.SubUIDStartAttr, config.SubUIDCountAttr, config.SubGIDStartAttr, config.SubGIDCountAttr}
+	add := func(entry *ldap.Entry, key string) {
+		subuid, err := entryRange(entry, key, config.SubUIDStartAttr, config.SubUIDCountAttr)
+		if err != nil {
+			logger.Warn("Invalid subuid range", "dn", entry.DN, "err", err)
+			return
+		}
+		subgid := subuid
+		if entry.GetAttributeValue(config.SubGIDStartAttr) != "" {
+			subgid, err = entryRange(entry, key, config.SubGIDStartAttr, config.SubGIDCountAttr)
+			if err != nil {
+				logger.Warn("Invalid subgid range", "dn", entry.DN, "err", err)
+				return
+			}
+		}
+		subuids = append(subuids, subuid)
+		subgids = append(subgids, subgid)
+	}
+	if config.SubIDOwnerAttr == "" {
+		err := searchUsers(ctx, l, info, config, attrs, logger, func(entry *ldap.Entry, key string) error {
+			if entry.GetAttributeValue(config.SubUIDStartAttr) == "" {
+				logger.Debug("User has no subid range", "dn", entry.DN)
+				return nil
+			}
+			add(entry, key)
+			return nil
+		})
+		return subuids, subgids, err
+	}
+	owners := make(map[string]string)
+	err := searchUsers(ctx, l, info, config, nil, logger, func(entry *ldap.Entry, key string) error {
+		owners[normalizeDN(entry.DN)] = key
+		return nil
+	})
+	if err != nil {
+		return subuids, subgids, err
+	}
+	baseDN := config.SubIDBaseDN
+	if baseDN == "" {
+		baseDN = config.UserBaseDN
+	}
+	filter := config.SubIDFilter
+	if filter == "" {
+		filter = SubIDFilter
+	}
+	logger.Debug("Running subid search", "basedn", baseDN, "filter", filter, "owner", config.SubIDOwnerAttr)
+	request := ldap.NewSearchRequest(baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		filter, append(attrs, config.SubIDOwnerAttr), nil)
+	err = LDAPSearch(ctx, l, request, "subid", config, logger, func(entry *ldap.Entry) error {
+		owner := entry.GetAttributeValue(config.SubIDOwnerAttr)
+		key, ok := owners[normalizeDN(owner)]
+		if !ok {
+			logger.Debug("Subid owner is not a returned user", "dn", entry.DN, "owner", owner)
+			return nil
+		}
+		add(entry, key)
+		return nil
+	})
+	return subuids, subgids, err
+}
+
+func entryRange(entry *ldap.Entry, key string, startAttr string, countAttr string) (subid.SubIDEntry, error) {
+	start, err := strconv.Atoi(entry.GetAttributeValue(startAttr))
+	if err != nil {
+		return subid.SubIDEntry{}, fmt.Errorf("invalid %s: %w", startAttr, err)
+	}
+	count, err := strconv.Atoi(entry.GetAttributeValue(countAttr))
+	if err != nil {
+		return subid.SubIDEntry{}, fmt.Errorf("invalid %s: %w", countAttr, err)
+	}
+	return subid.SubIDEntry{UID: key, ID: start, Count: count}, nil
+}
+
+// normalizeDN returns a DN suitable for comparing DNs from different entries.
+func normalizeDN(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return strings.ToLower(dn)
+	}
+	parts := make([]string, 0, len(parsed.RDNs))
+	for _, rdn := range parsed.RDNs {
+		attrs := make([]string, 0, len(rdn.Attributes))
+		for _, attr := range rdn.Attributes {
+			attrs = append(attrs, strings.ToLower(attr.Type)+"="+strings.ToLower(attr.Value))
+		}
+		parts = append(parts, strings.Join(attrs, "+"))
+	}
+	return strings.Join(parts, ",")
+}
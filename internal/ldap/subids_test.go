@@ -0,0 +1,86 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldap
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/common/promslog"
+	"github.com/treydock/subid-ldap/internal/config"
+	"github.com/treydock/subid-ldap/internal/test"
+)
+
+func getSubIDConfig() *config.Config {
+	_config := getConfig()
+	_config.UserBaseDN = test.BulkBaseDN
+	_config.SubUIDStartAttr = SubUIDStartAttr
+	_config.SubUIDCountAttr = SubUIDCountAttr
+	_config.SubGIDStartAttr = SubGIDStartAttr
+	_config.SubGIDCountAttr = SubGIDCountAttr
+	return _config
+}
+
+func TestLDAPSubIDsUserAttributes(t *testing.T) {
+	_config := getSubIDConfig()
+	l, err := LDAPConnect(_config, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer l.Close()
+	subuids, subgids, err := LDAPSubIDs(context.Background(), l, nil, _config, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(subuids) != test.BulkSubIDs || len(subgids) != test.BulkSubIDs {
+		t.Fatalf("Unexpected number of ranges, got: %d %d", len(subuids), len(subgids))
+	}
+	if subuids[1].UID != "10001" || subuids[1].ID != test.BulkSubIDStart(1) || subuids[1].Count != 65536 {
+		t.Errorf("Unexpected subuid range, got: %+v", subuids[1])
+	}
+	if subgids[1] != subuids[1] {
+		t.Errorf("Unexpected subgid range, got: %+v", subgids[1])
+	}
+}
+
+func TestLDAPSubIDsOwner(t *testing.T) {
+	_config := getSubIDConfig()
+	_config.SubIDBaseDN = test.SubIDBaseDN
+	_config.SubIDOwnerAttr = "ipaOwner"
+	_config.SubGIDStartAttr = "missing"
+	l, err := LDAPConnect(_config, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer l.Close()
+	subuids, subgids, err := LDAPSubIDs(context.Background(), l, nil, _config, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(subuids) != test.BulkSubIDs {
+		t.Fatalf("Unexpected number of ranges, got: %d", len(subuids))
+	}
+	if subuids[0].UID != "10000" || subuids[0].ID != test.BulkSubIDStart(0) {
+		t.Errorf("Unexpected subuid range, got: %+v", subuids[0])
+	}
+	if subgids[0] != subuids[0] {
+		t.Errorf("Expected subuid range used for subgid without subgid attributes, got: %+v", subgids[0])
+	}
+}
+
+func TestNormalizeDN(t *testing.T) {
+	if normalizeDN("UID=User1, OU=People,DC=test") != normalizeDN("uid=user1,ou=people,dc=TEST") {
+		t.Errorf("Expected DNs to match")
+	}
+}
@@ -0,0 +1,368 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/treydock/subid-ldap/internal/config"
+	"github.com/treydock/subid-ldap/internal/metrics"
+)
+
+const (
+	SyncModeNone             = "none"
+	SyncModeAuto             = "auto"
+	SyncModeSyncrepl         = "syncrepl"
+	SyncModePersistentSearch = "psearch"
+
+	ControlTypePersistentSearch        = "2.16.840.1.113730.3.4.3"
+	ControlTypeEntryChangeNotification = "2.16.840.1.113730.3.4.7"
+
+	psearchChangeAdd    = 1
+	psearchChangeDelete = 2
+	psearchChangeModify = 4
+	psearchChangeModDN  = 8
+
+	syncBufferSize = 64
+)
+
+// UserSet holds users keyed by a stable identifier such as entryUUID or DN.
+type UserSet struct {
+	mu      sync.Mutex
+	users   map[string]string
+	expires map[string]time.Time
+}
+
+func (s *UserSet) Set(id string, key string) {
+	s.SetUntil(id, key, time.Time{})
+}
+
+// SetUntil adds a user that is removed from the keys at until, a zero until never expires.
+func (s *UserSet) SetUntil(id string, key string, until time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.users == nil {
+		s.users = make(map[string]string)
+	}
+	if s.expires == nil {
+		s.expires = make(map[string]time.Time)
+	}
+	s.users[id] = key
+	if until.IsZero() {
+		delete(s.expires, id)
+	} else {
+		s.expires[id] = until
+	}
+}
+
+func (s *UserSet) Delete(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.users, id)
+	delete(s.expires, id)
+}
+
+func (s *UserSet) Replace(users map[string]string) {
+	s.replace(users, nil)
+}
+
+// replace sets the users along with when users in the account state grace period expire.
+func (s *UserSet) replace(users map[string]string, expires map[string]time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = users
+	s.expires = make(map[string]time.Time)
+	for id, until := range expires {
+		if _, ok := users[id]; ok && !until.IsZero() {
+			s.expires[id] = until
+		}
+	}
+}
+
+// Keys returns the unique user keys in the set that have not expired.
+func (s *UserSet) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	seen := make(map[string]bool, len(s.users))
+	keys := make([]string, 0, len(s.users))
+	for id, key := range s.users {
+		if until, ok := s.expires[id]; ok && !now.Before(until) {
+			continue
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// LDAPSyncMode resolves the auto sync mode using the controls advertised in the RootDSE.
+func LDAPSyncMode(l *ldap.Conn, mode string, logger *slog.Logger) (string, error) {
+	if mode != SyncModeAuto {
+		return mode, nil
+	}
+	rootDSE, err := LDAPRootDSE(l, logger)
+	if err != nil {
+		return "", err
+	}
+	controls := rootDSE.GetAttributeValues("supportedControl")
+	for _, control := range controls {
+		if control == ldap.ControlTypeSyncRequest {
+			return SyncModeSyncrepl, nil
+		}
+	}
+	for _, control := range controls {
+		if control == ControlTypePersistentSearch {
+			return SyncModePersistentSearch, nil
+		}
+	}
+	return "", errors.New("LDAP server supports neither content synchronization nor persistent search")
+}
+
+// LDAPSync follows changes to users using RFC 4533 refreshAndPersist or a persistent search,
+// keeping users up to date and calling notify after each change. It returns when ctx is
+// cancelled or the search ends.
+func LDAPSync(ctx context.Context, l *ldap.Conn, config *config.Config, mode string, users *UserSet, notify func(), logger *slog.Logger) error {
+	// Changes are followed for a single search, the configuration has at most one search
+	config = config.UserSearches()[0]
+	// Size and time limits only apply to the searches that complete
+	streamConfig := *config
+	streamConfig.SearchSizeLimit = 0
+	streamConfig.SearchTimeLimit = 0
+	request, err := userSearchRequest(&streamConfig, userAttrs(config))
+	if err != nil {
+		return err
+	}
+	if accountStateEnabled(config) {
+		if err := inactiveAccounts.Load(config.AccountStateFile, logger); err != nil {
+			return err
+		}
+	}
+	switch mode {
+	case SyncModeSyncrepl:
+		logger.Info("Starting LDAP content synchronization", "basedn", config.UserBaseDN, "filter", config.UserFilter)
+		r := l.Syncrepl(ctx, request, syncBufferSize, ldap.SyncRequestModeRefreshAndPersist, nil, false)
+		return processSyncrepl(r, config, users, notify, logger)
+	case SyncModePersistentSearch:
+		logger.Info("Starting LDAP persistent search", "basedn", config.UserBaseDN, "filter", config.UserFilter)
+		request.Controls = append(request.Controls, &controlPersistentSearch{
+			ChangeTypes: psearchChangeAdd | psearchChangeDelete | psearchChangeModify | psearchChangeModDN,
+			ChangesOnly: true,
+			ReturnECs:   true,
+		})
+		r := l.SearchAsync(ctx, request, syncBufferSize)
+		// The persistent search only returns changes so seed the users with a regular search
+		// started after the persistent search so no change is missed.
+		initial, err := userSearchRequest(config, userAttrs(config))
+		if err != nil {
+			return err
+		}
+		seed := make(map[string]string)
+		seedUntil := make(map[string]time.Time)
+		now := time.Now()
+		err = LDAPSearch(ctx, l, initial, "user", config, logger, func(entry *ldap.Entry) error {
+			if key, _, until := activeUserKey(entry, config, inactiveAccounts, now); key != "" {
+				seed[entry.DN] = key
+				seedUntil[entry.DN] = until
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if accountStateEnabled(config) {
+			_ = inactiveAccounts.Save(now, logger)
+		}
+		users.replace(seed, seedUntil)
+		notify()
+		return processPersistentSearch(r, config, users, notify, logger)
+	}
+	return fmt.Errorf("unknown sync mode %q", mode)
+}
+
+// syncUserKey evaluates a changed entry, saving when accounts were first seen inactive.
+func syncUserKey(entry *ldap.Entry, config *config.Config, logger *slog.Logger) (string, AccountState, time.Time) {
+	now := time.Now()
+	key, state, until := activeUserKey(entry, config, inactiveAccounts, now)
+	if accountStateEnabled(config) {
+		_ = inactiveAccounts.Save(now, logger)
+	}
+	return key, state, until
+}
+
+func processSyncrepl(r ldap.Response, config *config.Config, users *UserSet, notify func(), logger *slog.Logger) error {
+	refreshing := true
+	pending := make(map[string]string)
+	pendingUntil := make(map[string]time.Time)
+	for r.Next() {
+		entry := r.Entry()
+		if entry != nil {
+			state, ok := ldap.FindControl(r.Controls(), ldap.ControlTypeSyncState).(*ldap.ControlSyncState)
+			if !ok {
+				logger.Debug("Ignoring sync entry without sync state", "dn", entry.DN)
+				continue
+			}
+			id := state.EntryUUID.String()
+			key, _, until := syncUserKey(entry, config, logger)
+			deleted := state.State == ldap.SyncStateDelete || key == ""
+			if deleted {
+				metrics.MetricSyncEvents.WithLabelValues("delete").Inc()
+			} else {
+				metrics.MetricSyncEvents.WithLabelValues("add").Inc()
+			}
+			logger.Debug("Received sync entry", "dn", entry.DN, "uuid", id, "state", state.State, "refresh", refreshing)
+			switch {
+			case refreshing && deleted:
+				delete(pending, id)
+				delete(pendingUntil, id)
+			case refreshing:
+				pending[id] = key
+				pendingUntil[id] = until
+			case deleted:
+				users.Delete(id)
+				notify()
+			default:
+				users.SetUntil(id, key, until)
+				notify()
+			}
+			continue
+		}
+		info, ok := ldap.FindControl(r.Controls(), ldap.ControlTypeSyncInfo).(*ldap.ControlSyncInfo)
+		if !ok {
+			continue
+		}
+		switch {
+		case info.SyncIdSet != nil && info.SyncIdSet.RefreshDeletes:
+			for _, id := range info.SyncIdSet.SyncUUIDs {
+				if refreshing {
+					delete(pending, id.String())
+					delete(pendingUntil, id.String())
+				} else {
+					users.Delete(id.String())
+				}
+			}
+			if !refreshing {
+				notify()
+			}
+		case refreshing && (info.RefreshDelete != nil && info.RefreshDelete.RefreshDone ||
+			info.RefreshPresent != nil && info.RefreshPresent.RefreshDone):
+			logger.Info("LDAP content synchronization refresh complete", "count", len(pending))
+			refreshing = false
+			users.replace(pending, pendingUntil)
+			notify()
+		}
+	}
+	if err := r.Err(); err != nil {
+		logger.Error("Error during LDAP content synchronization", "err", err)
+		return err
+	}
+	return nil
+}
+
+func processPersistentSearch(r ldap.Response, config *config.Config, users *UserSet, notify func(), logger *slog.Logger) error {
+	for r.Next() {
+		entry := r.Entry()
+		if entry == nil {
+			continue
+		}
+		changeType, previousDN, err := decodeEntryChangeNotification(r.Controls())
+		if err != nil {
+			logger.Error("Unable to decode entry change notification", "dn", entry.DN, "err", err)
+			continue
+		}
+		key, _, until := syncUserKey(entry, config, logger)
+		logger.Debug("Received persistent search entry", "dn", entry.DN, "change", changeType)
+		if changeType == psearchChangeModDN && previousDN != "" {
+			users.Delete(previousDN)
+		}
+		if changeType == psearchChangeDelete || key == "" {
+			metrics.MetricSyncEvents.WithLabelValues("delete").Inc()
+			users.Delete(entry.DN)
+		} else {
+			metrics.MetricSyncEvents.WithLabelValues("add").Inc()
+			users.SetUntil(entry.DN, key, until)
+		}
+		notify()
+	}
+	if err := r.Err(); err != nil {
+		logger.Error("Error during LDAP persistent search", "err", err)
+		return err
+	}
+	return nil
+}
+
+// controlPersistentSearch implements the persistent search control from draft-ietf-ldapext-psearch.
+type controlPersistentSearch struct {
+	ChangeTypes int64
+	ChangesOnly bool
+	ReturnECs   bool
+}
+
+func (c *controlPersistentSearch) GetControlType() string {
+	return ControlTypePersistentSearch
+}
+
+func (c *controlPersistentSearch) Encode() *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Control")
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, ControlTypePersistentSearch, "Control Type (Persistent Search)"))
+	packet.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, true, "Criticality"))
+	value := ber.Encode(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, nil, "Control Value (Persistent Search)")
+	seq := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Persistent Search Control Value")
+	seq.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, c.ChangeTypes, "Change Types"))
+	seq.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, c.ChangesOnly, "Changes Only"))
+	seq.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, c.ReturnECs, "Return ECs"))
+	value.AppendChild(seq)
+	packet.AppendChild(value)
+	return packet
+}
+
+func (c *controlPersistentSearch) String() string {
+	return fmt.Sprintf("Control Type: Persistent Search (%q)  ChangeTypes: %d  ChangesOnly: %t  ReturnECs: %t",
+		ControlTypePersistentSearch, c.ChangeTypes, c.ChangesOnly, c.ReturnECs)
+}
+
+func decodeEntryChangeNotification(controls []ldap.Control) (int64, string, error) {
+	control, ok := ldap.FindControl(controls, ControlTypeEntryChangeNotification).(*ldap.ControlString)
+	if !ok {
+		return 0, "", errors.New("missing entry change notification control")
+	}
+	packet, err := ber.DecodePacketErr([]byte(control.ControlValue))
+	if err != nil {
+		return 0, "", err
+	}
+	if len(packet.Children) == 0 {
+		return 0, "", errors.New("empty entry change notification control")
+	}
+	changeType, ok := packet.Children[0].Value.(int64)
+	if !ok {
+		return 0, "", errors.New("invalid change type in entry change notification control")
+	}
+	var previousDN string
+	if len(packet.Children) > 1 && packet.Children[1].Tag == ber.TagOctetString {
+		previousDN = packet.Children[1].Data.String()
+	}
+	return changeType, previousDN, nil
+}
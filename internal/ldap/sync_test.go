@@ -0,0 +1,177 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldap
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/google/uuid"
+	"github.com/prometheus/common/promslog"
+)
+
+type fakeResult struct {
+	entry    *ldap.Entry
+	controls []ldap.Control
+}
+
+type fakeResponse struct {
+	results []fakeResult
+	current fakeResult
+}
+
+func (r *fakeResponse) Entry() *ldap.Entry       { return r.current.entry }
+func (r *fakeResponse) Referral() string         { return "" }
+func (r *fakeResponse) Controls() []ldap.Control { return r.current.controls }
+func (r *fakeResponse) Err() error               { return nil }
+func (r *fakeResponse) Next() bool {
+	if len(r.results) == 0 {
+		return false
+	}
+	r.current = r.results[0]
+	r.results = r.results[1:]
+	return true
+}
+
+func syncEntry(dn string, uid string, id uuid.UUID, state ldap.ControlSyncStateState) fakeResult {
+	attrs := map[string][]string{}
+	if uid != "" {
+		attrs["uidNumber"] = []string{uid}
+	}
+	return fakeResult{
+		entry:    ldap.NewEntry(dn, attrs),
+		controls: []ldap.Control{&ldap.ControlSyncState{State: state, EntryUUID: id}},
+	}
+}
+
+func psearchEntry(dn string, uid string, changeType int64, previousDN string) fakeResult {
+	value := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Entry Change Notification")
+	value.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, changeType, "Change Type"))
+	if previousDN != "" {
+		value.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, previousDN, "Previous DN"))
+	}
+	return fakeResult{
+		entry:    ldap.NewEntry(dn, map[string][]string{"uidNumber": {uid}}),
+		controls: []ldap.Control{ldap.NewControlString(ControlTypeEntryChangeNotification, false, string(value.Bytes()))},
+	}
+}
+
+func TestProcessSyncrepl(t *testing.T) {
+	_config := getConfig()
+	user1 := uuid.New()
+	user2 := uuid.New()
+	user3 := uuid.New()
+	r := &fakeResponse{results: []fakeResult{
+		syncEntry("cn=testuser1,ou=People,dc=test", "1000", user1, ldap.SyncStateAdd),
+		syncEntry("cn=testuser2,ou=People,dc=test", "1001", user2, ldap.SyncStateAdd),
+		{controls: []ldap.Control{&ldap.ControlSyncInfo{
+			Value:          ldap.SyncInfoRefreshPresent,
+			RefreshPresent: &ldap.ControlSyncInfoRefreshPresent{RefreshDone: true},
+		}}},
+		syncEntry("cn=testuser3,ou=People,dc=test", "1002", user3, ldap.SyncStateAdd),
+		syncEntry("cn=testuser1,ou=People,dc=test", "", user1, ldap.SyncStateDelete),
+	}}
+	users := &UserSet{}
+	notifications := 0
+	notify := func() { notifications++ }
+	err := processSyncrepl(r, _config, users, notify, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if keys := users.Keys(); !reflect.DeepEqual(keys, []string{"1001", "1002"}) {
+		t.Errorf("Unexpected users, got: %v", keys)
+	}
+	if notifications != 3 {
+		t.Errorf("Unexpected notifications, got: %d", notifications)
+	}
+}
+
+func TestProcessPersistentSearch(t *testing.T) {
+	_config := getConfig()
+	users := &UserSet{}
+	users.Replace(map[string]string{
+		"cn=testuser1,ou=People,dc=test": "1000",
+		"cn=testuser2,ou=People,dc=test": "1001",
+	})
+	r := &fakeResponse{results: []fakeResult{
+		psearchEntry("cn=testuser3,ou=People,dc=test", "1002", psearchChangeAdd, ""),
+		psearchEntry("cn=testuser1,ou=People,dc=test", "1000", psearchChangeDelete, ""),
+		psearchEntry("cn=renamed,ou=People,dc=test", "1001", psearchChangeModDN, "cn=testuser2,ou=People,dc=test"),
+	}}
+	notifications := 0
+	notify := func() { notifications++ }
+	err := processPersistentSearch(r, _config, users, notify, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if keys := users.Keys(); !reflect.DeepEqual(keys, []string{"1001", "1002"}) {
+		t.Errorf("Unexpected users, got: %v", keys)
+	}
+	if len(users.users) != 2 {
+		t.Errorf("Expected renamed entry to replace previous DN, got: %v", users.users)
+	}
+	if notifications != 3 {
+		t.Errorf("Unexpected notifications, got: %d", notifications)
+	}
+}
+
+func TestControlPersistentSearchEncode(t *testing.T) {
+	control := &controlPersistentSearch{ChangeTypes: 15, ChangesOnly: true, ReturnECs: true}
+	packet, err := ber.DecodePacketErr(control.Encode().Bytes())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if packet.Children[0].Value.(string) != ControlTypePersistentSearch {
+		t.Errorf("Unexpected control type: %v", packet.Children[0].Value)
+	}
+	value, err := ber.DecodePacketErr(packet.Children[2].Data.Bytes())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if value.Children[0].Value.(int64) != 15 || !value.Children[1].Value.(bool) || !value.Children[2].Value.(bool) {
+		t.Errorf("Unexpected control value: %v", value.Children)
+	}
+}
+
+func TestLDAPSyncModeAutoUnsupported(t *testing.T) {
+	l, err := LDAPConnect(getConfig(), promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer l.Close()
+	if _, err := LDAPSyncMode(l, SyncModeAuto, promslog.NewNopLogger()); err == nil {
+		t.Errorf("Expected an error when server does not support sync")
+	}
+	mode, err := LDAPSyncMode(l, SyncModeSyncrepl, promslog.NewNopLogger())
+	if err != nil || mode != SyncModeSyncrepl {
+		t.Errorf("Unexpected mode %s or error %v", mode, err)
+	}
+}
+
+func TestUserSetExpires(t *testing.T) {
+	users := &UserSet{}
+	users.Set("user1", "1000")
+	users.SetUntil("user2", "1001", time.Now().Add(time.Hour))
+	users.SetUntil("user3", "1002", time.Now().Add(-time.Second))
+	if keys := users.Keys(); !reflect.DeepEqual(keys, []string{"1000", "1001"}) {
+		t.Errorf("Unexpected users, got: %v", keys)
+	}
+	users.Set("user3", "1002")
+	if keys := users.Keys(); !reflect.DeepEqual(keys, []string{"1000", "1001", "1002"}) {
+		t.Errorf("Unexpected users after reactivation, got: %v", keys)
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldap
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/treydock/subid-ldap/internal/config"
+	"github.com/treydock/subid-ldap/internal/metrics"
+	"github.com/treydock/subid-ldap/internal/subid"
+)
+
+const (
+	LedgerAttr = "description"
+
+	// Attempts to advance the ledger before giving up when other hosts keep winning
+	ledgerAttempts = 10
+
+	ControlTypeAssertion = "1.3.6.1.1.12"
+)
+
+// SubIDUser is a user entry without a subid range in LDAP.
+type SubIDUser struct {
+	DN  string
+	Key string
+}
+
+// LDAPSubIDMissing returns the users that do not have a subid range in their entry.
+func LDAPSubIDMissing(ctx context.Context, l *ldap.Conn, info *ServerInfo, config *config.Config, logger *slog.Logger) ([]SubIDUser, error) {
+	users := []SubIDUser{}
+	err := searchUsers(ctx, l, info, config, []string{config.SubUIDStartAttr}, logger, func(entry *ldap.Entry, key string) error {
+		if entry.GetAttributeValue(config.SubUIDStartAttr) == "" {
+			users = append(users, SubIDUser{DN: entry.DN, Key: key})
+		}
+		return nil
+	})
+	return users, err
+}
+
+// LDAPSubIDAllocate assigns a subid range to each user and writes it to the user entry.
+// The next free ID is kept in the ledger entry and advanced with a modify that deletes
+// the old value and adds the new one, so when hosts race only one modify succeeds and
+// the others retry with the new value. The range is written to the user entry the same
+// way, deleting the values read from the entry and adding the new ones, with an assertion
+// that the entry has no range when the server supports it. When another host assigned the
+// user a range first its range is read back and the reserved range is used for the next
+// user, a range left unused is returned to the ledger if no other host advanced it since.
+// The ranges in used are skipped. Returns the number of ranges written.
+func LDAPSubIDAllocate(ctx context.Context, l *ldap.Conn, info *ServerInfo, config *config.Config, users []SubIDUser, used []subid.SubIDEntry, logger *slog.Logger) (int, error) {
+	used = append([]subid.SubIDEntry{}, used...)
+	assigned := 0
+	reserved := -1
+	defer func() {
+		if reserved >= 0 {
+			ledgerRelease(l, config, reserved, logger)
+		}
+	}()
+	assertion := info != nil && info.SupportsControl(ControlTypeAssertion)
+	for _, user := range users {
+		// Do not start another write once the run has been abandoned
+		if ctx.Err() != nil {
+			return assigned, context.Cause(ctx)
+		}
+		current, err := userRange(ctx, l, config, user.DN, logger)
+		if err != nil {
+			return assigned, err
+		}
+		if existing := current[config.SubUIDStartAttr]; len(existing) > 0 {
+			used = conflictRange(config, user, existing, used, logger)
+			continue
+		}
+		if reserved < 0 {
+			reserved, err = ledgerAdvance(ctx, l, config, used, logger)
+			if err != nil {
+				reserved = -1
+				return assigned, err
+			}
+		}
+		err = userRangeWrite(l, config, user.DN, current, reserved, assertion)
+		if isConflict(err) {
+			current, err = userRange(ctx, l, config, user.DN, logger)
+			if err != nil {
+				return assigned, err
+			}
+			existing := current[config.SubUIDStartAttr]
+			if len(existing) == 0 {
+				err = fmt.Errorf("subid range of %s changed while writing it", user.DN)
+				logger.Error("Unable to write subid range", "dn", user.DN, "err", err)
+				return assigned, err
+			}
+			used = conflictRange(config, user, existing, used, logger)
+			continue
+		}
+		if err != nil {
+			logger.Error("Unable to write subid range", "dn", user.DN, "err", err)
+			return assigned, err
+		}
+		logger.Info("Assigned subid range", "dn", user.DN, "user", user.Key, "start", reserved, "count", config.SubIDRange)
+		metrics.MetricLDAPWrites.WithLabelValues("assigned").Inc()
+		used = append(used, subid.SubIDEntry{UID: user.Key, ID: reserved, Count: config.SubIDRange})
+		reserved = -1
+		assigned++
+	}
+	return assigned, nil
+}
+
+// conflictRange records the range another host assigned to the user so it is not handed out again.
+func conflictRange(config *config.Config, user SubIDUser, existing []string, used []subid.SubIDEntry, logger *slog.Logger) []subid.SubIDEntry {
+	logger.Info("Subid range was assigned by another host", "dn", user.DN, "start", existing[0])
+	metrics.MetricLDAPWrites.WithLabelValues("conflict").Inc()
+	start, err := strconv.Atoi(existing[0])
+	if err != nil {
+		logger.Warn("Invalid subid range assigned by another host", "dn", user.DN, "start", existing[0], "err", err)
+		return used
+	}
+	return append(used, subid.SubIDEntry{UID: user.Key, ID: start, Count: config.SubIDRange})
+}
+
+// userRangeAttrs returns the start and count attributes written to user entries.
+func userRangeAttrs(config *config.Config) []string {
+	attrs := []string{config.SubUIDStartAttr, config.SubUIDCountAttr}
+	if config.SubGIDStartAttr != config.SubUIDStartAttr {
+		attrs = append(attrs, config.SubGIDStartAttr, config.SubGIDCountAttr)
+	}
+	return attrs
+}
+
+// userRange reads the subid range attributes of a user entry.
+func userRange(ctx context.Context, l *ldap.Conn, config *config.Config, dn string, logger *slog.Logger) (map[string][]string, error) {
+	values := make(map[string][]string)
+	attrs := userRangeAttrs(config)
+	request := ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", attrs, nil)
+	err := LDAPSearch(ctx, l, request, "user range", config, logger, func(entry *ldap.Entry) error {
+		for _, attr := range attrs {
+			values[attr] = entry.GetAttributeValues(attr)
+		}
+		return nil
+	})
+	return values, err
+}
+
+// userRangeWrite replaces the range values read from the user entry with the range at start.
+// The modify fails with a conflict if the entry changed since it was read.
+func userRangeWrite(l *ldap.Conn, config *config.Config, dn string, current map[string][]string, start int, assertion bool) error {
+	var controls []ldap.Control
+	if assertion {
+		controls = append(controls, &controlAssertion{Filter: fmt.Sprintf("(!(%s=*))", config.SubUIDStartAttr)})
+	}
+	request := ldap.NewModifyRequest(dn, controls)
+	for i, attr := range userRangeAttrs(config) {
+		value := strconv.Itoa(start)
+		if i%2 == 1 {
+			value = strconv.Itoa(config.SubIDRange)
+		}
+		if len(current[attr]) > 0 {
+			request.Delete(attr, current[attr])
+		}
+		request.Add(attr, []string{value})
+	}
+	return l.Modify(request)
+}
+
+// ledgerAdvance reserves the next free range in the ledger and returns its start.
+func ledgerAdvance(ctx context.Context, l *ldap.Conn, config *config.Config, used []subid.SubIDEntry, logger *slog.Logger) (int, error) {
+	for attempt := 0; attempt < ledgerAttempts; attempt++ {
+		current, err := ledgerValue(ctx, l, config, logger)
+		if err != nil {
+			return 0, err
+		}
+		next, err := strconv.Atoi(current)
+		if err != nil {
+			err = fmt.Errorf("invalid ledger value %q in %s: %w", current, config.SubIDLedgerDN, err)
+			logger.Error(err.Error())
+			return 0, err
+		}
+		start, err := subid.SubIDNextFree(next, config.SubIDRange, used)
+		if err != nil {
+			logger.Error("Unable to allocate subid range", "err", err)
+			return 0, err
+		}
+		request := ldap.NewModifyRequest(config.SubIDLedgerDN, nil)
+		request.Delete(config.SubIDLedgerAttr, []string{current})
+		request.Add(config.SubIDLedgerAttr, []string{strconv.Itoa(start + config.SubIDRange)})
+		err = l.Modify(request)
+		if err == nil {
+			return start, nil
+		}
+		if !isConflict(err) {
+			logger.Error("Unable to update subid ledger", "dn", config.SubIDLedgerDN, "err", err)
+			return 0, err
+		}
+		logger.Debug("Subid ledger changed by another host, retrying", "dn", config.SubIDLedgerDN, "value", current)
+	}
+	err := fmt.Errorf("subid ledger %s changed on each of %d attempts", config.SubIDLedgerDN, ledgerAttempts)
+	logger.Error(err.Error())
+	return 0, err
+}
+
+// ledgerRelease returns an unused range to the ledger if no other host advanced it since the range
+// was reserved, otherwise the range is left unused.
+func ledgerRelease(l *ldap.Conn, config *config.Config, start int, logger *slog.Logger) {
+	request := ldap.NewModifyRequest(config.SubIDLedgerDN, nil)
+	request.Delete(config.SubIDLedgerAttr, []string{strconv.Itoa(start + config.SubIDRange)})
+	request.Add(config.SubIDLedgerAttr, []string{strconv.Itoa(start)})
+	if err := l.Modify(request); err != nil {
+		logger.Warn("Unable to return unused subid range to the ledger", "dn", config.SubIDLedgerDN, "start", start, "err", err)
+		return
+	}
+	logger.Debug("Returned unused subid range to the ledger", "dn", config.SubIDLedgerDN, "start", start)
+}
+
+func ledgerValue(ctx context.Context, l *ldap.Conn, config *config.Config, logger *slog.Logger) (string, error) {
+	var value string
+	request := ldap.NewSearchRequest(config.SubIDLedgerDN, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{config.SubIDLedgerAttr}, nil)
+	err := LDAPSearch(ctx, l, request, "ledger", config, logger, func(entry *ldap.Entry) error {
+		value = entry.GetAttributeValue(config.SubIDLedgerAttr)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if value == "" {
+		err = fmt.Errorf("subid ledger %s has no %s value, set it to the start of the subid pool", config.SubIDLedgerDN, config.SubIDLedgerAttr)
+		logger.Error(err.Error())
+		return "", err
+	}
+	return value, nil
+}
+
+// isConflict returns true when a modify failed because the entry was changed by another host.
+func isConflict(err error) bool {
+	return ldap.IsErrorAnyOf(err, ldap.LDAPResultNoSuchAttribute, ldap.LDAPResultAttributeOrValueExists,
+		ldap.LDAPResultConstraintViolation, ldap.LDAPResultAssertionFailed)
+}
+
+// controlAssertion is a RFC 4528 assertion, the operation is only performed if the entry matches Filter.
+// It is only sent to servers that advertise it so it is not marked critical.
+type controlAssertion struct {
+	Filter string
+}
+
+func (c *controlAssertion) GetControlType() string {
+	return ControlTypeAssertion
+}
+
+func (c *controlAssertion) Encode() *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Control")
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, ControlTypeAssertion, "Control Type (Assertion)"))
+	value := ber.Encode(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, nil, "Control Value (Assertion)")
+	filter, err := ldap.CompileFilter(c.Filter)
+	if err == nil {
+		value.AppendChild(filter)
+	}
+	packet.AppendChild(value)
+	return packet
+}
+
+func (c *controlAssertion) String() string {
+	return fmt.Sprintf("Control Type: Assertion (%q)  Filter: %s", ControlTypeAssertion, c.Filter)
+}
@@ -0,0 +1,306 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldap
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+
+	goldap "github.com/go-ldap/ldap/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/promslog"
+	"github.com/treydock/subid-ldap/internal/config"
+	"github.com/treydock/subid-ldap/internal/metrics"
+	"github.com/treydock/subid-ldap/internal/subid"
+	"github.com/treydock/subid-ldap/internal/test"
+)
+
+func getWritebackConfig() *config.Config {
+	_config := getSubIDConfig()
+	_config.UserBaseDN = test.WritebackBaseDN
+	_config.SubIDRange = 65536
+	_config.SubIDAllocate = true
+	_config.SubIDLedgerDN = test.LedgerDN
+	_config.SubIDLedgerAttr = test.LedgerAttr
+	return _config
+}
+
+func writebackUserDN(i int) string {
+	return fmt.Sprintf("uid=writebackuser%d,%s", i, test.WritebackBaseDN)
+}
+
+func TestLDAPSubIDAllocate(t *testing.T) {
+	test.ResetWriteback()
+	_config := getWritebackConfig()
+	logger := promslog.NewNopLogger()
+	l, err := LDAPConnect(_config, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer l.Close()
+	subuids, _, err := LDAPSubIDs(context.Background(), l, nil, _config, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	missing, err := LDAPSubIDMissing(context.Background(), l, nil, _config, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(missing) != 2 || missing[0].Key != "20001" {
+		t.Fatalf("Unexpected missing users, got: %+v", missing)
+	}
+	assigned, err := LDAPSubIDAllocate(context.Background(), l, testServerInfo(t, l), _config, missing, subuids, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if assigned != 2 {
+		t.Errorf("Unexpected assigned, got: %d", assigned)
+	}
+	// The ledger starts at the range of the first user so that range is skipped
+	for i := 1; i < test.WritebackUsers; i++ {
+		entry := test.WritebackEntry(writebackUserDN(i))
+		expected := fmt.Sprintf("%d", test.LedgerStart+i*65536)
+		if len(entry["ipaSubUidNumber"]) != 1 || entry["ipaSubUidNumber"][0] != expected {
+			t.Errorf("Unexpected subuid start for user %d, got: %v", i, entry["ipaSubUidNumber"])
+		}
+		if len(entry["ipaSubGidNumber"]) != 1 || entry["ipaSubGidNumber"][0] != expected {
+			t.Errorf("Unexpected subgid start for user %d, got: %v", i, entry["ipaSubGidNumber"])
+		}
+	}
+	ledger := test.WritebackEntry(test.LedgerDN)[test.LedgerAttr]
+	if len(ledger) != 1 || ledger[0] != fmt.Sprintf("%d", test.LedgerStart+3*65536) {
+		t.Errorf("Unexpected ledger value, got: %v", ledger)
+	}
+	subuids, _, err = LDAPSubIDs(context.Background(), l, nil, _config, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(subuids) != test.WritebackUsers {
+		t.Errorf("Unexpected subuid ranges, got: %+v", subuids)
+	}
+}
+
+func TestLDAPSubIDAllocateConflict(t *testing.T) {
+	test.ResetWriteback()
+	_config := getWritebackConfig()
+	logger := promslog.NewNopLogger()
+	l, err := LDAPConnect(_config, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer l.Close()
+	conflicts := testutil.ToFloat64(metrics.MetricLDAPWrites.WithLabelValues("conflict"))
+	// The first user already has a range like when another host assigned it first
+	users := []SubIDUser{{DN: writebackUserDN(0), Key: "20000"}}
+	assigned, err := LDAPSubIDAllocate(context.Background(), l, testServerInfo(t, l), _config, users, nil, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if assigned != 0 {
+		t.Errorf("Unexpected assigned, got: %d", assigned)
+	}
+	if val := testutil.ToFloat64(metrics.MetricLDAPWrites.WithLabelValues("conflict")); val != conflicts+1 {
+		t.Errorf("Unexpected conflicts, got: %v", val)
+	}
+	entry := test.WritebackEntry(writebackUserDN(0))
+	if len(entry["ipaSubUidNumber"]) != 1 || entry["ipaSubUidNumber"][0] != fmt.Sprintf("%d", test.LedgerStart) {
+		t.Errorf("Unexpected subuid start, got: %v", entry["ipaSubUidNumber"])
+	}
+}
+
+func TestLDAPSubIDAllocateRace(t *testing.T) {
+	test.ResetWriteback()
+	_config := getWritebackConfig()
+	logger := promslog.NewNopLogger()
+	used := []subid.SubIDEntry{{UID: "20000", ID: test.LedgerStart, Count: 65536}}
+	var wg sync.WaitGroup
+	errs := make([]error, test.WritebackUsers)
+	for i := 1; i < test.WritebackUsers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			l, err := LDAPConnect(_config, logger)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer l.Close()
+			info, err := LDAPServerInfo(l, logger)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			users := []SubIDUser{{DN: writebackUserDN(i), Key: fmt.Sprintf("%d", 20000+i)}}
+			_, errs[i] = LDAPSubIDAllocate(context.Background(), l, info, _config, users, used, logger)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	first := test.WritebackEntry(writebackUserDN(1))["ipaSubUidNumber"]
+	second := test.WritebackEntry(writebackUserDN(2))["ipaSubUidNumber"]
+	if len(first) != 1 || len(second) != 1 || first[0] == second[0] {
+		t.Errorf("Expected distinct ranges, got: %v %v", first, second)
+	}
+}
+
+func TestLDAPSubIDAllocateNoLedger(t *testing.T) {
+	test.ResetWriteback()
+	_config := getWritebackConfig()
+	_config.SubIDLedgerAttr = "missing"
+	logger := promslog.NewNopLogger()
+	l, err := LDAPConnect(_config, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer l.Close()
+	users := []SubIDUser{{DN: writebackUserDN(1), Key: "20001"}}
+	if _, err := LDAPSubIDAllocate(context.Background(), l, testServerInfo(t, l), _config, users, nil, logger); err == nil {
+		t.Errorf("Expected error without ledger value")
+	}
+}
+
+func TestLDAPSubIDAllocateUserRace(t *testing.T) {
+	test.ResetWriteback()
+	_config := getWritebackConfig()
+	// Attributes that are not single valued so only the assertion keeps a second range out
+	_config.SubUIDStartAttr = "subUidStart"
+	_config.SubUIDCountAttr = "subUidCount"
+	_config.SubGIDStartAttr = "subUidStart"
+	_config.SubGIDCountAttr = "subUidCount"
+	logger := promslog.NewNopLogger()
+	assignedWrites := testutil.ToFloat64(metrics.MetricLDAPWrites.WithLabelValues("assigned"))
+	conflicts := testutil.ToFloat64(metrics.MetricLDAPWrites.WithLabelValues("conflict"))
+	var wg sync.WaitGroup
+	writers := 2
+	errs := make([]error, writers)
+	assigned := make([]int, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			l, err := LDAPConnect(_config, logger)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer l.Close()
+			info, err := LDAPServerInfo(l, logger)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			users := []SubIDUser{{DN: writebackUserDN(1), Key: "20001"}}
+			assigned[i], errs[i] = LDAPSubIDAllocate(context.Background(), l, info, _config, users, nil, logger)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	if assigned[0]+assigned[1] != 1 {
+		t.Errorf("Expected one writer to assign a range, got: %v", assigned)
+	}
+	if val := testutil.ToFloat64(metrics.MetricLDAPWrites.WithLabelValues("assigned")); val != assignedWrites+1 {
+		t.Errorf("Unexpected assigned writes, got: %v", val)
+	}
+	if val := testutil.ToFloat64(metrics.MetricLDAPWrites.WithLabelValues("conflict")); val != conflicts+1 {
+		t.Errorf("Unexpected conflicts, got: %v", val)
+	}
+	entry := test.WritebackEntry(writebackUserDN(1))
+	if len(entry["subUidStart"]) != 1 || len(entry["subUidCount"]) != 1 {
+		t.Errorf("Expected a single range, got: %v %v", entry["subUidStart"], entry["subUidCount"])
+	}
+	// The range reserved by the losing writer is returned unless the winner advanced the ledger after it
+	ledger := test.WritebackEntry(test.LedgerDN)[test.LedgerAttr]
+	if len(ledger) != 1 {
+		t.Fatalf("Unexpected ledger value, got: %v", ledger)
+	}
+	end, _ := strconv.Atoi(ledger[0])
+	start, _ := strconv.Atoi(entry["subUidStart"][0])
+	if end != start+65536 && end != test.LedgerStart+2*65536 {
+		t.Errorf("Unexpected ledger value %d for range %d", end, start)
+	}
+}
+
+func TestLDAPSubIDAllocateReuseReserved(t *testing.T) {
+	test.ResetWriteback()
+	_config := getWritebackConfig()
+	logger := promslog.NewNopLogger()
+	l, err := LDAPConnect(_config, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer l.Close()
+	used := []subid.SubIDEntry{{UID: "20000", ID: test.LedgerStart, Count: 65536}}
+	// Another host assigns user 1 a range after it was found missing
+	users := []SubIDUser{{DN: writebackUserDN(1), Key: "20001"}, {DN: writebackUserDN(2), Key: "20002"}}
+	test.AddWriteback(writebackUserDN(1), map[string][]string{
+		"objectClass":     {"posixAccount"},
+		"uid":             {"writebackuser1"},
+		"uidNumber":       {"20001"},
+		"ipaSubUidNumber": {fmt.Sprintf("%d", test.LedgerStart+65536)},
+		"ipaSubUidCount":  {"65536"},
+	})
+	request := goldap.NewModifyRequest(test.LedgerDN, nil)
+	request.Replace(test.LedgerAttr, []string{fmt.Sprintf("%d", test.LedgerStart+2*65536)})
+	if err := l.Modify(request); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	assigned, err := LDAPSubIDAllocate(context.Background(), l, testServerInfo(t, l), _config, users, used, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if assigned != 1 {
+		t.Errorf("Unexpected assigned, got: %d", assigned)
+	}
+	entry := test.WritebackEntry(writebackUserDN(2))
+	if len(entry["ipaSubUidNumber"]) != 1 || entry["ipaSubUidNumber"][0] != fmt.Sprintf("%d", test.LedgerStart+2*65536) {
+		t.Errorf("Unexpected subuid start, got: %v", entry["ipaSubUidNumber"])
+	}
+	ledger := test.WritebackEntry(test.LedgerDN)[test.LedgerAttr]
+	if len(ledger) != 1 || ledger[0] != fmt.Sprintf("%d", test.LedgerStart+3*65536) {
+		t.Errorf("Unexpected ledger value, got: %v", ledger)
+	}
+}
+
+func TestLDAPSubIDAllocateRelease(t *testing.T) {
+	test.ResetWriteback()
+	_config := getWritebackConfig()
+	logger := promslog.NewNopLogger()
+	l, err := LDAPConnect(_config, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer l.Close()
+	used := []subid.SubIDEntry{{UID: "20000", ID: test.LedgerStart, Count: 65536}}
+	// The write fails for a user that no longer exists so the reserved range is returned
+	users := []SubIDUser{{DN: "uid=missing," + test.WritebackBaseDN, Key: "20009"}}
+	if _, err := LDAPSubIDAllocate(context.Background(), l, testServerInfo(t, l), _config, users, used, logger); err == nil {
+		t.Errorf("Expected error for missing user")
+	}
+	// The ledger is left at the start of the reserved range which follows the used range
+	ledger := test.WritebackEntry(test.LedgerDN)[test.LedgerAttr]
+	if len(ledger) != 1 || ledger[0] != fmt.Sprintf("%d", test.LedgerStart+65536) {
+		t.Errorf("Unexpected ledger value, got: %v", ledger)
+	}
+}
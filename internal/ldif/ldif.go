@@ -0,0 +1,154 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldif
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	ldap "github.com/go-ldap/ldap/v3"
+)
+
+// Load reads the entries of an LDIF file.
+func Load(path string) ([]*ldap.Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	entries, err := Parse(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return entries, nil
+}
+
+// Parse reads the content records of LDIF as defined by RFC 2849. Change records and
+// values read from URLs are not supported.
+func Parse(r io.Reader) ([]*ldap.Entry, error) {
+	entries := []*ldap.Entry{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	var lines []string
+	var lineNumber, start int
+	flush := func() error {
+		if len(lines) == 0 {
+			return nil
+		}
+		entry, err := parseRecord(lines)
+		if err != nil {
+			return fmt.Errorf("record at line %d: %w", start, err)
+		}
+		if entry != nil {
+			entries = append(entries, entry)
+		}
+		lines = nil
+		return nil
+	}
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		switch {
+		case line == "":
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(line, " "):
+			// Folded lines continue the previous line without the leading space
+			if len(lines) == 0 {
+				return nil, fmt.Errorf("line %d: continuation without a previous line", lineNumber)
+			}
+			if !strings.HasPrefix(lines[len(lines)-1], "#") {
+				lines[len(lines)-1] += line[1:]
+			}
+		default:
+			if len(lines) == 0 {
+				start = lineNumber
+			}
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// parseRecord returns the entry of a record, or nil for a record holding only comments
+// or the version.
+func parseRecord(lines []string) (*ldap.Entry, error) {
+	var dn string
+	attributes := make(map[string][]string)
+	order := []string{}
+	for _, line := range lines {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, err := parseLine(line)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case strings.EqualFold(name, "version") && dn == "":
+			continue
+		case strings.EqualFold(name, "dn"):
+			if dn != "" {
+				return nil, fmt.Errorf("multiple dn lines")
+			}
+			dn = value
+		case dn == "":
+			return nil, fmt.Errorf("expected dn, got %q", name)
+		case strings.EqualFold(name, "changetype"):
+			return nil, fmt.Errorf("change records are not supported")
+		default:
+			if _, ok := attributes[name]; !ok {
+				order = append(order, name)
+			}
+			attributes[name] = append(attributes[name], value)
+		}
+	}
+	if dn == "" {
+		return nil, nil
+	}
+	entry := &ldap.Entry{DN: dn}
+	for _, name := range order {
+		entry.Attributes = append(entry.Attributes, ldap.NewEntryAttribute(name, attributes[name]))
+	}
+	return entry, nil
+}
+
+func parseLine(line string) (string, string, error) {
+	name, value, ok := strings.Cut(line, ":")
+	if !ok || name == "" {
+		return "", "", fmt.Errorf("invalid line %q", line)
+	}
+	switch {
+	case strings.HasPrefix(value, ":"):
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value[1:]))
+		if err != nil {
+			return "", "", fmt.Errorf("invalid base64 value of %s: %w", name, err)
+		}
+		return name, string(decoded), nil
+	case strings.HasPrefix(value, "<"):
+		return "", "", fmt.Errorf("URL value of %s is not supported", name)
+	}
+	return name, strings.TrimLeft(value, " "), nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldif
+
+import (
+	"strings"
+	"testing"
+
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/treydock/subid-ldap/internal/test"
+)
+
+func TestLoad(t *testing.T) {
+	entries, err := Load(test.GetFixture("users.ldif"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(entries) != 7 {
+		t.Fatalf("Unexpected number of entries, got: %d", len(entries))
+	}
+	if val := entries[2].GetAttributeValue("description"); val != "A user with a long description that is folded over more than one line" {
+		t.Errorf("Unexpected folded value, got: %q", val)
+	}
+	if val := entries[3].GetAttributeValue("uid"); val != "testuser3" {
+		t.Errorf("Unexpected base64 value, got: %q", val)
+	}
+	if _, err := Load("/dne"); err == nil {
+		t.Errorf("Expected error loading missing file")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []string{
+		"dn: cn=test,dc=test\nchangetype: delete\n",
+		"cn: test\n",
+		"dn: cn=test,dc=test\nuid:: !!!\n",
+		"dn: cn=test,dc=test\njpegPhoto:< file:///tmp/photo.jpg\n",
+		" folded\n",
+		"dn: cn=test,dc=test\ninvalid\n",
+	}
+	for _, content := range tests {
+		if _, err := Parse(strings.NewReader(content)); err == nil {
+			t.Errorf("Expected error parsing %q", content)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	entries, err := Load(test.GetFixture("users.ldif"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	tests := []struct {
+		base   string
+		scope  int
+		filter string
+		size   int
+		want   []string
+	}{
+		{base: "ou=People,dc=test", scope: ldap.ScopeWholeSubtree, filter: "(objectClass=posixAccount)",
+			want: []string{"testuser1", "testuser2", "testuser3", "testuser4"}},
+		{base: "OU=people,DC=test", scope: ldap.ScopeSingleLevel, filter: "(&(objectClass=posixAccount)(status=active))",
+			want: []string{"testuser1", "testuser2", "testuser3"}},
+		{base: "dc=test", scope: ldap.ScopeWholeSubtree, filter: "(&(uidNumber>=1002)(!(status=RESTRICTED)))",
+			want: []string{"testuser3", "otheruser"}},
+		{base: "dc=test", scope: ldap.ScopeWholeSubtree, filter: "(|(uid=*user1)(uid=test*4)(cn=*grou*))",
+			want: []string{"testuser1", "testuser4", ""}},
+		{base: "dc=test", scope: ldap.ScopeSingleLevel, filter: "(objectClass=*)", want: []string{}},
+		{base: "cn=testuser2,ou=People,dc=test", scope: ldap.ScopeBaseObject, filter: "(uidNumber<=1001)",
+			want: []string{"testuser2"}},
+	}
+	for _, tt := range tests {
+		request := ldap.NewSearchRequest(tt.base, tt.scope, ldap.NeverDerefAliases, tt.size, 0, false, tt.filter, []string{"uid"}, nil)
+		got := []string{}
+		err := Search(entries, request, func(entry *ldap.Entry) error {
+			if len(entry.Attributes) > 1 {
+				t.Errorf("Unexpected attributes returned: %v", entry.Attributes)
+			}
+			got = append(got, entry.GetAttributeValue("uid"))
+			return nil
+		})
+		if err != nil {
+			t.Errorf("Unexpected error: %s", err)
+			continue
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("Unexpected results for %s %s\nGot: %v\nExpected: %v", tt.base, tt.filter, got, tt.want)
+		}
+	}
+	request := ldap.NewSearchRequest("ou=People,dc=test", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		"(objectClass=posixAccount)", nil, nil)
+	err = Search(entries, request, func(entry *ldap.Entry) error { return nil })
+	if !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		t.Errorf("Expected size limit error, got: %v", err)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	entry := ldap.NewEntry("cn=test,dc=test", map[string][]string{"uidNumber": {"1000"}, "cn": {"Test"}})
+	tests := map[string]bool{
+		"(cn=test)":                 true,
+		"(CN=TEST)":                 true,
+		"(uidNumber>=999)":          true,
+		"(uidNumber<=999)":          false,
+		"(cn:=test)":                true,
+		"(cn:caseExactMatch:=Test)": false,
+		"(!(cn=test))":              false,
+		"(missing=*)":               false,
+	}
+	for filter, want := range tests {
+		got, err := Match(entry, filter)
+		if err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+		if got != want {
+			t.Errorf("Unexpected match of %s, got: %v", filter, got)
+		}
+	}
+	if _, err := Match(entry, "(cn=test"); err == nil {
+		t.Errorf("Expected error with invalid filter")
+	}
+}
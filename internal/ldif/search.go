@@ -0,0 +1,209 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldif
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	ldap "github.com/go-ldap/ldap/v3"
+)
+
+// Search calls fn with a copy of each entry below the base DN in scope that matches the
+// filter, holding only the requested attributes. The size limit is enforced like a server.
+func Search(entries []*ldap.Entry, request *ldap.SearchRequest, fn func(*ldap.Entry) error) error {
+	base, err := ldap.ParseDN(request.BaseDN)
+	if err != nil {
+		return err
+	}
+	filter, err := ldap.CompileFilter(request.Filter)
+	if err != nil {
+		return err
+	}
+	count := 0
+	for _, entry := range entries {
+		dn, err := ldap.ParseDN(entry.DN)
+		if err != nil {
+			return fmt.Errorf("invalid DN %q: %w", entry.DN, err)
+		}
+		if !inScope(base, dn, request.Scope) || !match(entry, filter) {
+			continue
+		}
+		count++
+		if request.SizeLimit > 0 && count > request.SizeLimit {
+			return ldap.NewError(ldap.LDAPResultSizeLimitExceeded, fmt.Errorf("search returned more than %d entries", request.SizeLimit))
+		}
+		if err := fn(selectAttributes(entry, request.Attributes)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Match returns true when the entry matches the filter.
+func Match(entry *ldap.Entry, filter string) (bool, error) {
+	packet, err := ldap.CompileFilter(filter)
+	if err != nil {
+		return false, err
+	}
+	return match(entry, packet), nil
+}
+
+func inScope(base *ldap.DN, dn *ldap.DN, scope int) bool {
+	switch scope {
+	case ldap.ScopeBaseObject:
+		return base.EqualFold(dn)
+	case ldap.ScopeSingleLevel:
+		return len(dn.RDNs) == len(base.RDNs)+1 && base.AncestorOfFold(dn)
+	}
+	return base.EqualFold(dn) || base.AncestorOfFold(dn)
+}
+
+func selectAttributes(entry *ldap.Entry, attributes []string) *ldap.Entry {
+	selected := &ldap.Entry{DN: entry.DN}
+	all := len(attributes) == 0
+	for _, attr := range attributes {
+		if attr == "*" {
+			all = true
+		}
+	}
+	for _, attr := range entry.Attributes {
+		keep := all
+		for _, name := range attributes {
+			if strings.EqualFold(name, attr.Name) {
+				keep = true
+			}
+		}
+		if keep {
+			selected.Attributes = append(selected.Attributes, attr)
+		}
+	}
+	return selected
+}
+
+// match evaluates a compiled filter. Values are compared ignoring case and ordering
+// compares numbers numerically, which matches the usual matching rules of the
+// attributes used for users. Extensible matches with a matching rule never match.
+func match(entry *ldap.Entry, packet *ber.Packet) bool {
+	switch packet.Tag {
+	case ldap.FilterAnd:
+		for _, child := range packet.Children {
+			if !match(entry, child) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, child := range packet.Children {
+			if match(entry, child) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return len(packet.Children) == 1 && !match(entry, packet.Children[0])
+	case ldap.FilterPresent:
+		return len(entry.GetEqualFoldAttributeValues(packetString(packet))) > 0
+	case ldap.FilterEqualityMatch, ldap.FilterApproxMatch, ldap.FilterGreaterOrEqual, ldap.FilterLessOrEqual:
+		attr, assertion := packetString(packet.Children[0]), packetString(packet.Children[1])
+		for _, value := range entry.GetEqualFoldAttributeValues(attr) {
+			if compareValue(value, assertion, packet.Tag) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterSubstrings:
+		attr := packetString(packet.Children[0])
+		for _, value := range entry.GetEqualFoldAttributeValues(attr) {
+			if matchSubstrings(strings.ToLower(value), packet.Children[1].Children) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterExtensibleMatch:
+		var attr, assertion string
+		for _, child := range packet.Children {
+			switch child.Tag {
+			case ldap.MatchingRuleAssertionMatchingRule:
+				return false
+			case ldap.MatchingRuleAssertionType:
+				attr = packetString(child)
+			case ldap.MatchingRuleAssertionMatchValue:
+				assertion = packetString(child)
+			}
+		}
+		for _, value := range entry.GetEqualFoldAttributeValues(attr) {
+			if strings.EqualFold(value, assertion) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func compareValue(value string, assertion string, tag ber.Tag) bool {
+	if tag == ldap.FilterEqualityMatch || tag == ldap.FilterApproxMatch {
+		return strings.EqualFold(value, assertion)
+	}
+	var cmp int
+	a, errA := strconv.ParseInt(value, 10, 64)
+	b, errB := strconv.ParseInt(assertion, 10, 64)
+	if errA == nil && errB == nil {
+		switch {
+		case a < b:
+			cmp = -1
+		case a > b:
+			cmp = 1
+		}
+	} else {
+		cmp = strings.Compare(strings.ToLower(value), strings.ToLower(assertion))
+	}
+	if tag == ldap.FilterGreaterOrEqual {
+		return cmp >= 0
+	}
+	return cmp <= 0
+}
+
+func matchSubstrings(value string, parts []*ber.Packet) bool {
+	for _, part := range parts {
+		s := strings.ToLower(packetString(part))
+		switch part.Tag {
+		case ldap.FilterSubstringsInitial:
+			if !strings.HasPrefix(value, s) {
+				return false
+			}
+			value = value[len(s):]
+		case ldap.FilterSubstringsAny:
+			i := strings.Index(value, s)
+			if i < 0 {
+				return false
+			}
+			value = value[i+len(s):]
+		case ldap.FilterSubstringsFinal:
+			if !strings.HasSuffix(value, s) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func packetString(packet *ber.Packet) string {
+	if s, ok := packet.Value.(string); ok {
+		return s
+	}
+	return packet.Data.String()
+}
@@ -57,6 +57,106 @@ var (
 		Name:      "last_run_timestamp_seconds",
 		Help:      "Last timestamp of execution",
 	})
+	MetricConfigReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_last_reload_successful",
+		Help:      "Indicates the last configuration reload was successful",
+	})
+	MetricConfigReloadTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_last_reload_success_timestamp_seconds",
+		Help:      "Time of the last successful configuration reload",
+	})
+	MetricAllocationLoadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "allocation_last_load_successful",
+		Help:      "Indicates the last load of the subid files served by the query APIs was successful",
+	})
+	MetricLDAPTLSInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "ldap_tls_info",
+		Help:      "TLS version and cipher suite negotiated with the LDAP server",
+	}, []string{"version", "cipher"})
+	MetricLDAPConnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "ldap_connects_total",
+		Help:      "Number of connections established to the LDAP server",
+	})
+	MetricLDAPServerInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "ldap_server_info",
+		Help:      "LDAP server vendor and version detected from the RootDSE",
+	}, []string{"vendor", "version"})
+	MetricSyncEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "sync_events_total",
+		Help:      "Number of user changes received from LDAP content synchronization",
+	}, []string{"type"})
+	MetricSyncConnected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "sync_connected",
+		Help:      "Indicates LDAP content synchronization is connected",
+	})
+	MetricUsersInactive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "users_inactive",
+		Help:      "Number of inactive LDAP users from the last search, action is excluded or grace",
+	}, []string{"reason", "action"})
+	MetricUsersExcluded = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "users_excluded",
+		Help:      "Number of users excluded from subid allocation during the last update",
+	}, []string{"reason"})
+	MetricSourceUsers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "source_users",
+		Help:      "Number of users returned by each source during the last run",
+	}, []string{"source"})
+	MetricServedFromCache = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "served_from_cache",
+		Help:      "Indicates the last run used the cached user list because the source was unavailable",
+	})
+	MetricCacheTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_timestamp_seconds",
+		Help:      "Time the user list in use was cached",
+	})
+	MetricLDAPIncrementalChanges = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "ldap_incremental_changes",
+		Help:      "Number of changed users returned by the last incremental LDAP search",
+	})
+	MetricLDAPFullSearch = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "ldap_full_search_timestamp_seconds",
+		Help:      "Time of the last full LDAP user search in incremental mode",
+	})
+	MetricLDAPMaxID = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "ldap_max_id",
+		Help:      "Highest UID or GID found in LDAP by the overlap check",
+	})
+	MetricSubIDStart = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "pool_start",
+		Help:      "Start of the subid pool",
+	})
+	MetricLDAPWrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "ldap_writes_total",
+		Help:      "Number of subid ranges written to LDAP, result is assigned or conflict",
+	}, []string{"result"})
+	MetricSocketRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "socket_requests_total",
+		Help:      "Number of query socket requests, result is ok or error",
+	}, []string{"op", "result"})
+	MetricSocketDenied = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "socket_connections_denied_total",
+		Help:      "Number of query socket connections rejected by the peer credential check",
+	})
 	MetricSubIDTotal = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: metricsNamespace,
 		Name:      "subid_total",
@@ -92,6 +192,26 @@ func MetricGathers(processMetrics bool) prometheus.Gatherers {
 	registry.MustRegister(MetricError)
 	registry.MustRegister(MetricDuration)
 	registry.MustRegister(MetricLastRun)
+	registry.MustRegister(MetricConfigReloadSuccess)
+	registry.MustRegister(MetricConfigReloadTimestamp)
+	registry.MustRegister(MetricAllocationLoadSuccess)
+	registry.MustRegister(MetricLDAPTLSInfo)
+	registry.MustRegister(MetricLDAPConnects)
+	registry.MustRegister(MetricLDAPServerInfo)
+	registry.MustRegister(MetricSyncEvents)
+	registry.MustRegister(MetricSyncConnected)
+	registry.MustRegister(MetricUsersInactive)
+	registry.MustRegister(MetricUsersExcluded)
+	registry.MustRegister(MetricSourceUsers)
+	registry.MustRegister(MetricServedFromCache)
+	registry.MustRegister(MetricCacheTimestamp)
+	registry.MustRegister(MetricLDAPIncrementalChanges)
+	registry.MustRegister(MetricLDAPFullSearch)
+	registry.MustRegister(MetricLDAPMaxID)
+	registry.MustRegister(MetricSubIDStart)
+	registry.MustRegister(MetricLDAPWrites)
+	registry.MustRegister(MetricSocketRequests)
+	registry.MustRegister(MetricSocketDenied)
 	registry.MustRegister(MetricSubIDTotal)
 	registry.MustRegister(MetricSubIDAdded)
 	registry.MustRegister(MetricSubIDRemoved)
@@ -0,0 +1,207 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/treydock/subid-ldap/internal/metrics"
+	"github.com/treydock/subid-ldap/internal/subid"
+)
+
+const (
+	// Version is the protocol version sent as the first field of every request
+	Version        = 1
+	OpHasRange     = "has-range"
+	OpListRanges   = "list-owner-ranges"
+	OpFindOwner    = "find-owner"
+	socketMode     = 0666
+	maxRequestSize = 4096
+)
+
+var (
+	// IdleTimeout closes connections that send no request for this long
+	IdleTimeout = 30 * time.Second
+)
+
+// Server answers subordinate ID queries on a Unix socket from the ranges last written.
+//
+// Requests are single lines of space separated fields starting with the protocol version:
+//
+//	1 has-range <subuid|subgid> <owner> <start> <count>
+//	1 list-owner-ranges <subuid|subgid> <owner>
+//	1 find-owner <subuid|subgid> <id>
+//
+// Responses start with a line of "ok <result>" or "error <message>". has-range answers
+// "ok yes" or "ok no", the other operations answer "ok <n>" followed by n lines of
+// owner:start:count ranges or owners.
+type Server struct {
+	Allocation *subid.Allocation
+	// Allowed reports if a peer running as uid may send queries
+	Allowed func(uid int) bool
+	Logger  *slog.Logger
+}
+
+// Listen creates the socket at path, replacing a socket left by a previous run.
+// The socket is writable by all users and peers are checked when they connect.
+func Listen(path string) (*net.UnixListener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, socketMode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Serve accepts connections until the listener is closed.
+func (s *Server) Serve(l *net.UnixListener) error {
+	for {
+		conn, err := l.AcceptUnix()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn *net.UnixConn) {
+	defer conn.Close()
+	uid, err := peerUID(conn)
+	if err != nil {
+		s.Logger.Error("Unable to read query socket peer credentials", "err", err)
+		metrics.MetricSocketDenied.Inc()
+		return
+	}
+	logger := s.Logger.With("uid", uid)
+	if !s.Allowed(uid) {
+		logger.Warn("Query socket peer not allowed")
+		metrics.MetricSocketDenied.Inc()
+		fmt.Fprintln(conn, "error permission denied")
+		return
+	}
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, maxRequestSize), maxRequestSize)
+	w := bufio.NewWriter(conn)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(IdleTimeout))
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+				logger.Debug("Query socket read failed", "err", err)
+			}
+			return
+		}
+		op, lines, err := s.query(strings.Fields(scanner.Text()))
+		if err != nil {
+			logger.Debug("Query failed", "request", scanner.Text(), "err", err)
+			metrics.MetricSocketRequests.WithLabelValues(op, "error").Inc()
+			fmt.Fprintf(w, "error %s\n", err)
+		} else {
+			metrics.MetricSocketRequests.WithLabelValues(op, "ok").Inc()
+			for _, line := range lines {
+				fmt.Fprintln(w, line)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			logger.Debug("Query socket write failed", "err", err)
+			return
+		}
+	}
+}
+
+// query returns the operation and the response lines of a request.
+func (s *Server) query(fields []string) (string, []string, error) {
+	if len(fields) < 3 {
+		return "unknown", nil, fmt.Errorf("expected <version> <operation> <subuid|subgid> [arguments]")
+	}
+	op, kind, args := fields[1], fields[2], fields[3:]
+	if !slices.Contains([]string{OpHasRange, OpListRanges, OpFindOwner}, op) {
+		op = "unknown"
+	}
+	if fields[0] != strconv.Itoa(Version) {
+		return op, nil, fmt.Errorf("unsupported version %s, supported versions: %d", fields[0], Version)
+	}
+	if !slices.Contains(subid.Kinds, kind) {
+		return op, nil, fmt.Errorf("unknown kind %s", kind)
+	}
+	if s.Allocation.Loaded().IsZero() {
+		return op, nil, fmt.Errorf("subid ranges not loaded")
+	}
+	switch op {
+	case OpHasRange:
+		if len(args) != 3 {
+			return op, nil, fmt.Errorf("expected %s <kind> <owner> <start> <count>", op)
+		}
+		start, err := strconv.Atoi(args[1])
+		if err != nil {
+			return op, nil, fmt.Errorf("invalid start %s", args[1])
+		}
+		count, err := strconv.Atoi(args[2])
+		if err != nil {
+			return op, nil, fmt.Errorf("invalid count %s", args[2])
+		}
+		if s.Allocation.HasRange(kind, args[0], start, count) {
+			return op, []string{"ok yes"}, nil
+		}
+		return op, []string{"ok no"}, nil
+	case OpListRanges:
+		if len(args) != 1 {
+			return op, nil, fmt.Errorf("expected %s <kind> <owner>", op)
+		}
+		ranges := s.Allocation.OwnerRanges(kind, args[0])
+		lines := []string{fmt.Sprintf("ok %d", len(ranges))}
+		for _, e := range ranges {
+			lines = append(lines, fmt.Sprintf("%s:%d:%d", e.UID, e.ID, e.Count))
+		}
+		return op, lines, nil
+	case OpFindOwner:
+		if len(args) != 1 {
+			return op, nil, fmt.Errorf("expected %s <kind> <id>", op)
+		}
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			return op, nil, fmt.Errorf("invalid id %s", args[0])
+		}
+		var owners []string
+		for _, e := range s.Allocation.Owners(kind, id) {
+			if !slices.Contains(owners, e.UID) {
+				owners = append(owners, e.UID)
+			}
+		}
+		return op, append([]string{fmt.Sprintf("ok %d", len(owners))}, owners...), nil
+	}
+	return op, nil, fmt.Errorf("unknown operation %s", fields[1])
+}
@@ -0,0 +1,179 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package socket
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/promslog"
+	"github.com/treydock/subid-ldap/internal/metrics"
+	"github.com/treydock/subid-ldap/internal/subid"
+)
+
+func startServer(t *testing.T, allowed func(int) bool) (string, *subid.Allocation) {
+	dir := t.TempDir()
+	subuid := filepath.Join(dir, "subuid")
+	subgid := filepath.Join(dir, "subgid")
+	if err := os.WriteFile(subuid, []byte("# Managed\njdoe:100000:65536\nasmith:165536:65536\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(subgid, []byte("jdoe:100000:65536\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	allocation := &subid.Allocation{}
+	if err := allocation.Load(subuid, subgid, promslog.NewNopLogger()); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "subid.sock")
+	l, err := Listen(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	server := &Server{Allocation: allocation, Allowed: allowed, Logger: promslog.NewNopLogger()}
+	go func() {
+		if err := server.Serve(l); err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+	}()
+	return path, allocation
+}
+
+// query sends a request and reads the response lines.
+func query(t *testing.T, conn net.Conn, r *bufio.Reader, request string) []string {
+	if _, err := fmt.Fprintln(conn, request); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	first, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	lines := []string{strings.TrimSuffix(first, "\n")}
+	var n int
+	if _, err := fmt.Sscanf(lines[0], "ok %d", &n); err != nil {
+		return lines
+	}
+	for range n {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+	return lines
+}
+
+func TestServer(t *testing.T) {
+	metrics.MetricSocketRequests.Reset()
+	path, _ := startServer(t, func(uid int) bool { return uid == os.Getuid() })
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	tests := []struct {
+		request  string
+		response []string
+	}{
+		{"1 has-range subuid jdoe 100000 65536", []string{"ok yes"}},
+		{"1 has-range subuid jdoe 100000 65537", []string{"ok no"}},
+		{"1 has-range subgid asmith 165536 1", []string{"ok no"}},
+		{"1 list-owner-ranges subuid jdoe", []string{"ok 1", "jdoe:100000:65536"}},
+		{"1 list-owner-ranges subgid asmith", []string{"ok 0"}},
+		{"1 find-owner subuid 165540", []string{"ok 1", "asmith"}},
+		{"1 find-owner subgid 1000", []string{"ok 0"}},
+		{"2 find-owner subuid 1000", []string{"error unsupported version 2, supported versions: 1"}},
+		{"1 find-owner subuid foo", []string{"error invalid id foo"}},
+		{"1 find-owner other 1000", []string{"error unknown kind other"}},
+		{"1 has-range subuid jdoe", []string{"error expected has-range <kind> <owner> <start> <count>"}},
+		{"1 delete subuid jdoe", []string{"error unknown operation delete"}},
+		{"1", []string{"error expected <version> <operation> <subuid|subgid> [arguments]"}},
+	}
+	for _, test := range tests {
+		response := query(t, conn, r, test.request)
+		if strings.Join(response, "\n") != strings.Join(test.response, "\n") {
+			t.Errorf("Unexpected response to %q\nGot:\n%s\nExpected:\n%s", test.request, strings.Join(response, "\n"), strings.Join(test.response, "\n"))
+		}
+	}
+	expected := `# HELP subid_ldap_socket_requests_total Number of query socket requests, result is ok or error
+# TYPE subid_ldap_socket_requests_total counter
+subid_ldap_socket_requests_total{op="find-owner",result="error"} 3
+subid_ldap_socket_requests_total{op="find-owner",result="ok"} 2
+subid_ldap_socket_requests_total{op="has-range",result="error"} 1
+subid_ldap_socket_requests_total{op="has-range",result="ok"} 3
+subid_ldap_socket_requests_total{op="list-owner-ranges",result="ok"} 2
+subid_ldap_socket_requests_total{op="unknown",result="error"} 2
+`
+	if err := testutil.GatherAndCompare(metrics.MetricGathers(false), strings.NewReader(expected), "subid_ldap_socket_requests_total"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestServerDenied(t *testing.T) {
+	path, _ := startServer(t, func(uid int) bool { return false })
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if response := query(t, conn, r, "1 find-owner subuid 100000"); response[0] != "error permission denied" {
+		t.Errorf("Unexpected response: %v", response)
+	}
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Errorf("Expected connection to be closed")
+	}
+}
+
+func TestListen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "subid.sock")
+	l, err := Listen(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if info.Mode().Perm() != socketMode {
+		t.Errorf("Unexpected socket mode: %s", info.Mode())
+	}
+	// Leave the socket behind as a crashed daemon would
+	l.SetUnlinkOnClose(false)
+	l.Close()
+	l, err = Listen(path)
+	if err != nil {
+		t.Errorf("Expected stale socket to be replaced, got: %s", err)
+	} else {
+		l.Close()
+	}
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Listen(file); err == nil {
+		t.Errorf("Expected error listening on a regular file")
+	}
+}
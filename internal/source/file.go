@@ -0,0 +1,214 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/treydock/subid-ldap/internal/config"
+)
+
+// passwdAttrs are the RFC 2307 attributes of the fields of a passwd line after the name
+var passwdAttrs = []string{"userPassword", "uidNumber", "gidNumber", "gecos", "homeDirectory", "loginShell"}
+
+// loadPasswd reads a file in passwd format such as the output of getent passwd. Each line
+// is converted to a posixAccount entry below the user base DN so the user filter and
+// attribute settings apply as they would to the directory.
+func loadPasswd(path string, c *config.Config) ([]*ldap.Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parsePasswd(file, c)
+}
+
+func parsePasswd(r io.Reader, c *config.Config) ([]*ldap.Entry, error) {
+	entries := []*ldap.Entry{}
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		// NIS compat entries starting with + or - do not describe a user
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "+") || strings.HasPrefix(line, "-") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) != 7 || fields[0] == "" {
+			return nil, fmt.Errorf("line %d: expected 7 fields separated by colons", lineNumber)
+		}
+		attrs := map[string][]string{
+			"objectClass": {"posixAccount"},
+			"uid":         {fields[0]},
+		}
+		for i, attr := range passwdAttrs {
+			if fields[i+1] != "" {
+				attrs[attr] = []string{fields[i+1]}
+			}
+		}
+		entries = append(entries, ldap.NewEntry(entryDN(attrs, len(entries), c), attrs))
+	}
+	return entries, scanner.Err()
+}
+
+// loadJSON reads a JSON array of objects mapping attribute names to a value or a list of
+// values. A dn is optional and objectClass defaults to posixAccount.
+func loadJSON(path string, c *config.Config) ([]*ldap.Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseJSON(file, c)
+}
+
+func parseJSON(r io.Reader, c *config.Config) ([]*ldap.Entry, error) {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	var records []map[string]any
+	if err := decoder.Decode(&records); err != nil {
+		return nil, err
+	}
+	entries := make([]*ldap.Entry, 0, len(records))
+	for i, record := range records {
+		attrs := make(map[string][]string, len(record))
+		for attr, value := range record {
+			values, err := jsonValues(value)
+			if err != nil {
+				return nil, fmt.Errorf("record %d attribute %s: %w", i, attr, err)
+			}
+			if len(values) > 0 {
+				attrs[attr] = values
+			}
+		}
+		entries = append(entries, recordEntry(attrs, len(entries), c))
+	}
+	return entries, nil
+}
+
+func jsonValues(value any) ([]string, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case json.Number:
+		return []string{v.String()}, nil
+	case bool:
+		return []string{strings.ToUpper(fmt.Sprint(v))}, nil
+	case []any:
+		values := []string{}
+		for _, item := range v {
+			if _, ok := item.([]any); ok {
+				return nil, fmt.Errorf("nested lists are not supported")
+			}
+			itemValues, err := jsonValues(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, itemValues...)
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unsupported value %v", value)
+}
+
+// loadCSV reads a CSV file with a header row of attribute names, empty values are omitted.
+// A dn column is optional and objectClass defaults to posixAccount.
+func loadCSV(path string, c *config.Config) ([]*ldap.Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseCSV(file, c)
+}
+
+func parseCSV(r io.Reader, c *config.Config) ([]*ldap.Entry, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read header: %w", err)
+	}
+	entries := []*ldap.Entry{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		attrs := make(map[string][]string, len(header))
+		for i, attr := range header {
+			if value := strings.TrimSpace(record[i]); value != "" {
+				attrs[strings.TrimSpace(attr)] = []string{value}
+			}
+		}
+		entries = append(entries, recordEntry(attrs, len(entries), c))
+	}
+	return entries, nil
+}
+
+func recordEntry(attrs map[string][]string, index int, c *config.Config) *ldap.Entry {
+	dn := entryDN(attrs, index, c)
+	for attr := range attrs {
+		if strings.EqualFold(attr, "dn") {
+			delete(attrs, attr)
+		}
+	}
+	if !hasAttr(attrs, "objectClass") {
+		attrs["objectClass"] = []string{"posixAccount"}
+	}
+	return ldap.NewEntry(dn, attrs)
+}
+
+// entryDN returns the dn of a record or a dn below the user base DN, or the base DN of
+// the first search, named by the uid or the position of the record.
+func entryDN(attrs map[string][]string, index int, c *config.Config) string {
+	for attr, values := range attrs {
+		if strings.EqualFold(attr, "dn") {
+			return values[0]
+		}
+	}
+	rdn := fmt.Sprintf("entry=%d", index)
+	for attr, values := range attrs {
+		if strings.EqualFold(attr, "uid") {
+			rdn = "uid=" + ldap.EscapeDN(values[0])
+		}
+	}
+	baseDN := c.UserSearches()[0].UserBaseDN
+	if baseDN == "" {
+		return rdn
+	}
+	return rdn + "," + baseDN
+}
+
+func hasAttr(attrs map[string][]string, name string) bool {
+	for attr := range attrs {
+		if strings.EqualFold(attr, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/treydock/subid-ldap/internal/test"
+)
+
+func TestParsePasswd(t *testing.T) {
+	c := getConfig(Passwd)
+	entries, err := parsePasswd(strings.NewReader("alice:x:1000:100:Alice,,,:/home/alice:/bin/bash\n"), c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Unexpected entries, got: %d", len(entries))
+	}
+	if entries[0].DN != "uid=alice,"+test.UserBaseDN {
+		t.Errorf("Unexpected DN, got: %s", entries[0].DN)
+	}
+	for attr, expected := range map[string]string{"uidNumber": "1000", "gidNumber": "100", "gecos": "Alice,,,",
+		"homeDirectory": "/home/alice", "loginShell": "/bin/bash", "objectClass": "posixAccount"} {
+		if val := entries[0].GetAttributeValue(attr); val != expected {
+			t.Errorf("Unexpected %s, got: %s", attr, val)
+		}
+	}
+	if _, err := parsePasswd(strings.NewReader("alice:x:1000\n"), c); err == nil {
+		t.Errorf("Expected error with missing fields")
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	c := getConfig(JSON)
+	c.UserBaseDN = ""
+	entries, err := parseJSON(strings.NewReader(`[{"uid": "a,b", "uidNumber": 1000, "active": true, "mail": ["x", "y"], "empty": null}]`), c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if entries[0].DN != `uid=a\,b` {
+		t.Errorf("Unexpected DN, got: %s", entries[0].DN)
+	}
+	if val := entries[0].GetAttributeValue("active"); val != "TRUE" {
+		t.Errorf("Unexpected boolean value, got: %s", val)
+	}
+	if val := entries[0].GetAttributeValues("mail"); len(val) != 2 {
+		t.Errorf("Unexpected multiple values, got: %v", val)
+	}
+	for _, content := range []string{`{"uid": "a"}`, `[{"uid": {"a": "b"}}]`, `[{"uid": [["a"]]}]`} {
+		if _, err := parseJSON(strings.NewReader(content), c); err == nil {
+			t.Errorf("Expected error parsing %s", content)
+		}
+	}
+}
+
+func TestParseCSV(t *testing.T) {
+	c := getConfig(CSV)
+	entries, err := parseCSV(strings.NewReader("dn,uidNumber,mail\ncn=a,dc=test,1000,\n,1001,b@test\n"), c)
+	if err == nil {
+		t.Errorf("Expected error with unquoted DN, got: %v", entries)
+	}
+	entries, err = parseCSV(strings.NewReader("dn,uidNumber,mail\n\"cn=a,dc=test\",1000,\n,1001,b@test\n"), c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if entries[0].DN != "cn=a,dc=test" || entries[0].GetAttributeValue("dn") != "" {
+		t.Errorf("Unexpected entry, got: %s %v", entries[0].DN, entries[0].Attributes)
+	}
+	if entries[0].GetAttributeValue("mail") != "" {
+		t.Errorf("Expected empty value omitted")
+	}
+	if entries[1].DN != "entry=1,"+test.UserBaseDN {
+		t.Errorf("Unexpected DN, got: %s", entries[1].DN)
+	}
+	if _, err := parseCSV(strings.NewReader(""), c); err == nil {
+		t.Errorf("Expected error without header")
+	}
+}
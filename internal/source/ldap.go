@@ -0,0 +1,101 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"context"
+	"log/slog"
+
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/treydock/subid-ldap/internal/config"
+	localldap "github.com/treydock/subid-ldap/internal/ldap"
+	"github.com/treydock/subid-ldap/internal/ldif"
+	"github.com/treydock/subid-ldap/internal/subid"
+)
+
+// ldapSource searches the directory for users.
+type ldapSource struct {
+	config *config.Config
+	client *localldap.Client
+}
+
+func (s *ldapSource) Name() string {
+	return LDAP
+}
+
+func (s *ldapSource) Users(ctx context.Context, logger *slog.Logger) (Result, error) {
+	var result Result
+	err := s.client.Do(ctx, s.config, logger, func(l *ldap.Conn, info *localldap.ServerInfo) error {
+		var err error
+		if s.config.LdapIncremental != "" && s.config.LdapIncremental != localldap.IncrementalOff {
+			result.Users, err = localldap.LDAPIncrementalUsers(ctx, l, info, s.config, &s.client.Incremental, logger)
+		} else {
+			result.Users, err = localldap.LDAPUsers(ctx, l, info, s.config, logger)
+		}
+		if err != nil || !overlapCheck(s.config) {
+			return err
+		}
+		result.MaxID, err = localldap.LDAPMaxID(ctx, l, s.config, logger)
+		return err
+	})
+	if err != nil {
+		return Result{}, err
+	}
+	setUsers(LDAP, result)
+	return result, nil
+}
+
+// fileSource reads users from a file that is converted to entries and searched locally
+// like the directory.
+type fileSource struct {
+	name   string
+	path   string
+	config *config.Config
+	load   func(path string, config *config.Config) ([]*ldap.Entry, error)
+}
+
+func (s *fileSource) Name() string {
+	return s.name
+}
+
+func (s *fileSource) Users(_ context.Context, logger *slog.Logger) (Result, error) {
+	entries, err := s.load(s.path, s.config)
+	if err != nil {
+		logger.Error("Unable to read source", "source", s.name, "path", s.path, "err", err)
+		return Result{}, err
+	}
+	logger.Debug("Read source", "source", s.name, "path", s.path, "entries", len(entries))
+	var result Result
+	result.Users, err = localldap.EntryUsers(entries, s.config, logger)
+	if err != nil {
+		return Result{}, err
+	}
+	if overlapCheck(s.config) {
+		result.MaxID, err = localldap.EntryMaxID(entries, s.config, logger)
+		if err != nil {
+			return Result{}, err
+		}
+	}
+	setUsers(s.name, result)
+	return result, nil
+}
+
+func loadLDIF(path string, _ *config.Config) ([]*ldap.Entry, error) {
+	return ldif.Load(path)
+}
+
+// overlapCheck returns true when the highest ID is needed by the overlap check.
+func overlapCheck(c *config.Config) bool {
+	return c.OverlapCheck != "" && c.OverlapCheck != subid.OverlapOff
+}
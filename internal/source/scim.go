@@ -0,0 +1,263 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/treydock/subid-ldap/internal/config"
+	"github.com/treydock/subid-ldap/internal/transform"
+)
+
+const (
+	SCIMKeyAttr  = "userName"
+	SCIMPageSize = 100
+
+	scimContentType = "application/scim+json"
+)
+
+// scimListResponse is a page of a SCIM 2.0 list response as defined by RFC 7644.
+// TotalResults is nil when the service leaves it out.
+type scimListResponse struct {
+	TotalResults *int             `json:"totalResults"`
+	ItemsPerPage int              `json:"itemsPerPage"`
+	StartIndex   int              `json:"startIndex"`
+	Resources    []map[string]any `json:"Resources"`
+}
+
+// scimError is a SCIM 2.0 error response.
+type scimError struct {
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+}
+
+// scimSource pages through the Users endpoint of a SCIM 2.0 service.
+type scimSource struct {
+	config *config.Config
+	client *http.Client
+}
+
+func newSCIMSource(c *config.Config) *scimSource {
+	return &scimSource{config: c, client: &http.Client{Timeout: c.SCIMTimeout}}
+}
+
+func (s *scimSource) Name() string {
+	return SCIM
+}
+
+// Users returns the value of the key attribute of each active user. Users with active
+// set to false are skipped, users without the active attribute are treated as active.
+// Pages are requested until one is empty, or when the service does not return totalResults,
+// until a page has fewer users than requested.
+func (s *scimSource) Users(ctx context.Context, logger *slog.Logger) (Result, error) {
+	token, err := scimToken(s.config)
+	if err != nil {
+		logger.Error("Unable to read SCIM token", "err", err)
+		return Result{}, err
+	}
+	pipeline, err := transform.Compile(s.config.UserKeyTransforms)
+	if err != nil {
+		return Result{}, err
+	}
+	keyAttr := s.config.SCIMKeyAttr
+	if keyAttr == "" {
+		keyAttr = SCIMKeyAttr
+	}
+	pageSize := s.config.SCIMPageSize
+	if pageSize <= 0 {
+		pageSize = SCIMPageSize
+	}
+	attributes := append([]string{keyAttr, "active"}, pipeline.Attributes()...)
+	result := Result{Users: []string{}}
+	inactive := 0
+	for startIndex := 1; ; {
+		page, err := s.page(ctx, token, startIndex, pageSize, attributes, logger)
+		if err != nil {
+			return Result{}, err
+		}
+		for _, resource := range page.Resources {
+			if active, ok := scimBool(scimAttribute(resource, "active")); ok && !active {
+				logger.Debug("Inactive SCIM user", "id", resource["id"])
+				inactive++
+				continue
+			}
+			key := scimString(scimAttribute(resource, keyAttr))
+			if key == "" {
+				logger.Warn("Unable to determine user key", "id", resource["id"], "attr", keyAttr)
+				continue
+			}
+			key, err = pipeline.Apply(key, func(attr string) string {
+				return scimString(scimAttribute(resource, attr))
+			})
+			if err != nil || key == "" {
+				logger.Warn("Unable to determine user key", "id", resource["id"], "err", err)
+				continue
+			}
+			result.Users = append(result.Users, key)
+		}
+		startIndex += len(page.Resources)
+		if len(page.Resources) == 0 {
+			break
+		}
+		if page.TotalResults != nil {
+			// Services may return fewer users than requested before the last page
+			if startIndex > *page.TotalResults {
+				break
+			}
+		} else if len(page.Resources) < pageSize {
+			break
+		}
+	}
+	logger.Debug("results", "type", "scim", "count", len(result.Users), "inactive", inactive)
+	setUsers(SCIM, result)
+	return result, nil
+}
+
+func (s *scimSource) page(ctx context.Context, token string, startIndex int, count int, attributes []string, logger *slog.Logger) (*scimListResponse, error) {
+	query := url.Values{}
+	query.Set("startIndex", strconv.Itoa(startIndex))
+	query.Set("count", strconv.Itoa(count))
+	query.Set("attributes", strings.Join(attributes, ","))
+	u := strings.TrimSuffix(s.config.SCIMURL, "/") + "/Users?" + query.Encode()
+	logger.Debug("Requesting SCIM users", "url", u)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", scimContentType)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = context.Cause(ctx)
+		}
+		logger.Error("Error requesting SCIM users", "err", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		logger.Error("Error reading SCIM response", "err", err)
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var scimErr scimError
+		detail := strings.TrimSpace(string(body))
+		if json.Unmarshal(body, &scimErr) == nil && scimErr.Detail != "" {
+			detail = scimErr.Detail
+		}
+		err = fmt.Errorf("SCIM request failed with status %d: %s", resp.StatusCode, detail)
+		logger.Error("Error requesting SCIM users", "err", err)
+		return nil, err
+	}
+	var page scimListResponse
+	if err := json.Unmarshal(body, &page); err != nil {
+		logger.Error("Error parsing SCIM response", "err", err)
+		return nil, err
+	}
+	return &page, nil
+}
+
+// scimAttribute returns the value of an attribute path such as userName, name.givenName or
+// an extension attribute like urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:employeeNumber.
+// Attribute names are case insensitive.
+func scimAttribute(resource map[string]any, path string) any {
+	var parts []string
+	if strings.HasPrefix(strings.ToLower(path), "urn:") {
+		i := strings.LastIndex(path, ":")
+		parts = append([]string{path[:i]}, strings.Split(path[i+1:], ".")...)
+	} else {
+		parts = strings.Split(path, ".")
+	}
+	var value any = resource
+	for _, part := range parts {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = nil
+		for key, v := range object {
+			if strings.EqualFold(key, part) {
+				value = v
+				break
+			}
+		}
+	}
+	return value
+}
+
+// scimBool returns the value of a boolean attribute, some services return booleans as strings.
+func scimBool(value any) (bool, bool) {
+	switch v := value.(type) {
+	case bool:
+		return v, true
+	case string:
+		b, err := strconv.ParseBool(v)
+		return b, err == nil
+	}
+	return false, false
+}
+
+// scimString returns a single attribute value as a string. For multi-valued attributes
+// the primary value is used, or the first value when none is primary.
+func scimString(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case []any:
+		if len(v) == 0 {
+			return ""
+		}
+		for _, item := range v {
+			if object, ok := item.(map[string]any); ok && object["primary"] == true {
+				return scimString(object["value"])
+			}
+		}
+		if object, ok := v[0].(map[string]any); ok {
+			return scimString(object["value"])
+		}
+		return scimString(v[0])
+	}
+	return ""
+}
+
+// scimToken returns the bearer token, a token file is read on every call so a rotated
+// token is used without a restart.
+func scimToken(c *config.Config) (string, error) {
+	if c.SCIMTokenFile == "" {
+		return c.SCIMToken, nil
+	}
+	content, err := os.ReadFile(c.SCIMTokenFile)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return "", fmt.Errorf("SCIM token file %s is empty", c.SCIMTokenFile)
+	}
+	return token, nil
+}
@@ -0,0 +1,224 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/promslog"
+	"github.com/treydock/subid-ldap/internal/config"
+)
+
+const scimTestToken = "secret"
+
+func scimServer(users []map[string]any) *httptest.Server {
+	return scimPagedServer(users, 0, true)
+}
+
+// scimPagedServer returns at most maxPage users per page when maxPage is set and leaves out
+// totalResults when total is false.
+func scimPagedServer(users []map[string]any, maxPage int, total bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scim/v2/Users" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer "+scimTestToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"schemas":["urn:ietf:params:scim:api:messages:2.0:Error"],"status":"401","detail":"invalid token"}`)
+			return
+		}
+		startIndex, _ := strconv.Atoi(r.URL.Query().Get("startIndex"))
+		count, _ := strconv.Atoi(r.URL.Query().Get("count"))
+		if maxPage > 0 {
+			count = min(count, maxPage)
+		}
+		end := min(startIndex-1+count, len(users))
+		page := users[min(startIndex-1, end):end]
+		response := map[string]any{
+			"schemas":      []string{"urn:ietf:params:scim:api:messages:2.0:ListResponse"},
+			"itemsPerPage": len(page),
+			"startIndex":   startIndex,
+			"Resources":    page,
+		}
+		if total {
+			response["totalResults"] = len(users)
+		}
+		w.Header().Set("Content-Type", scimContentType)
+		_ = json.NewEncoder(w).Encode(response)
+	}))
+}
+
+func scimUsers() []map[string]any {
+	users := []map[string]any{}
+	for i := 0; i < 5; i++ {
+		user := map[string]any{
+			"id":       fmt.Sprintf("id%d", i),
+			"userName": fmt.Sprintf("User%d@example.com", i),
+			"emails":   []map[string]any{{"value": fmt.Sprintf("other%d@example.com", i)}, {"value": fmt.Sprintf("user%d@example.com", i), "primary": true}},
+			"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User": map[string]any{"employeeNumber": 1000 + i},
+		}
+		switch i {
+		case 1:
+			user["active"] = false
+		case 2:
+			user["active"] = true
+		}
+		users = append(users, user)
+	}
+	return users
+}
+
+func getSCIMConfig(url string) *config.Config {
+	c := getConfig(SCIM)
+	c.SCIMURL = url + "/scim/v2/"
+	c.SCIMToken = scimTestToken
+	c.SCIMPageSize = 2
+	c.SCIMTimeout = 5 * time.Second
+	return c
+}
+
+func TestSCIMSource(t *testing.T) {
+	server := scimServer(scimUsers())
+	defer server.Close()
+	tests := []struct {
+		attr       string
+		transforms []string
+		expected   string
+	}{
+		{attr: "", expected: "User0@example.com,User2@example.com,User3@example.com,User4@example.com"},
+		{attr: "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:employeeNumber", expected: "1000,1002,1003,1004"},
+		{attr: "emails", transforms: []string{"strip-realm"}, expected: "user0,user2,user3,user4"},
+		{attr: "USERNAME", transforms: []string{"lowercase", "template:{{.id}}-{{.value}}"},
+			expected: "id0-user0@example.com,id2-user2@example.com,id3-user3@example.com,id4-user4@example.com"},
+	}
+	for _, tt := range tests {
+		c := getSCIMConfig(server.URL)
+		c.SCIMKeyAttr = tt.attr
+		c.UserKeyTransforms = tt.transforms
+		s, err := New(c, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		result, err := s.Users(context.Background(), promslog.NewNopLogger())
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if got := strings.Join(result.Users, ","); got != tt.expected {
+			t.Errorf("Unexpected users with %s, got: %s expected: %s", tt.attr, got, tt.expected)
+		}
+	}
+}
+
+func TestSCIMSourcePaging(t *testing.T) {
+	users := scimUsers()
+	// Some services return booleans as strings
+	users[3]["active"] = "false"
+	users[4]["active"] = "True"
+	tests := []struct {
+		name    string
+		maxPage int
+		total   bool
+	}{
+		{name: "total", total: true},
+		{name: "no-total"},
+		{name: "capped", maxPage: 1, total: true},
+		{name: "capped-no-total", maxPage: 1},
+	}
+	for _, tt := range tests {
+		server := scimPagedServer(users, tt.maxPage, tt.total)
+		c := getSCIMConfig(server.URL)
+		s, err := New(c, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		result, err := s.Users(context.Background(), promslog.NewNopLogger())
+		server.Close()
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		expected := "User0@example.com,User2@example.com,User4@example.com"
+		// Without totalResults a page shorter than requested is taken as the last page
+		if tt.name == "capped-no-total" {
+			expected = "User0@example.com"
+		}
+		if got := strings.Join(result.Users, ","); got != expected {
+			t.Errorf("Unexpected users with %s, got: %s expected: %s", tt.name, got, expected)
+		}
+	}
+}
+
+func TestSCIMSourceTokenFile(t *testing.T) {
+	server := scimServer(scimUsers())
+	defer server.Close()
+	c := getSCIMConfig(server.URL)
+	c.SCIMToken = ""
+	c.SCIMTokenFile = filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(c.SCIMTokenFile, []byte(scimTestToken+"\n"), 0600); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	s := newSCIMSource(c)
+	if _, err := s.Users(context.Background(), promslog.NewNopLogger()); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if err := os.WriteFile(c.SCIMTokenFile, []byte("invalid"), 0600); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	_, err := s.Users(context.Background(), promslog.NewNopLogger())
+	if err == nil || !strings.Contains(err.Error(), "status 401: invalid token") {
+		t.Errorf("Expected error with invalid token, got: %v", err)
+	}
+	c.SCIMTokenFile = "/dne"
+	if _, err := s.Users(context.Background(), promslog.NewNopLogger()); err == nil {
+		t.Errorf("Expected error with missing token file")
+	}
+}
+
+func TestSCIMSourceErrors(t *testing.T) {
+	server := scimServer(scimUsers())
+	defer server.Close()
+	c := getSCIMConfig(server.URL)
+	c.SCIMURL = server.URL + "/dne"
+	if _, err := newSCIMSource(c).Users(context.Background(), promslog.NewNopLogger()); err == nil {
+		t.Errorf("Expected error with invalid URL")
+	}
+	invalid := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "not json")
+	}))
+	defer invalid.Close()
+	c = getSCIMConfig(invalid.URL)
+	if _, err := newSCIMSource(c).Users(context.Background(), promslog.NewNopLogger()); err == nil {
+		t.Errorf("Expected error with invalid response")
+	}
+	c = getSCIMConfig(server.URL)
+	c.SCIMPageSize = 0
+	if err := Validate(c); err == nil {
+		t.Errorf("Expected error with invalid page size")
+	}
+	c = getSCIMConfig(server.URL)
+	c.SCIMTokenFile = "token"
+	if err := Validate(c); err == nil {
+		t.Errorf("Expected error with token and token file")
+	}
+}
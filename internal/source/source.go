@@ -0,0 +1,208 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/treydock/subid-ldap/internal/config"
+	localldap "github.com/treydock/subid-ldap/internal/ldap"
+	"github.com/treydock/subid-ldap/internal/metrics"
+	"github.com/treydock/subid-ldap/internal/subid"
+)
+
+const (
+	LDAP   = "ldap"
+	LDIF   = "ldif"
+	Passwd = "passwd"
+	JSON   = "json"
+	CSV    = "csv"
+	SCIM   = "scim"
+
+	CombineUnion        = "union"
+	CombineIntersection = "intersection"
+)
+
+var (
+	Names        = []string{LDAP, LDIF, Passwd, JSON, CSV, SCIM}
+	CombineModes = []string{CombineUnion, CombineIntersection}
+)
+
+// Result holds the users returned by a source.
+type Result struct {
+	Users []string
+	// MaxID is the highest UID or GID known to the source, only set when the overlap check is enabled
+	MaxID int
+}
+
+// Source returns the users that are allocated subids. Users stops reading and returns
+// the cause when ctx ends.
+type Source interface {
+	Name() string
+	Users(ctx context.Context, logger *slog.Logger) (Result, error)
+}
+
+// New returns the configured sources, combined when more than one is configured.
+func New(c *config.Config, client *localldap.Client) (Source, error) {
+	sources := []Source{}
+	for _, name := range c.UserSources {
+		switch name {
+		case LDAP:
+			sources = append(sources, &ldapSource{config: c, client: client})
+		case LDIF:
+			sources = append(sources, &fileSource{name: name, path: c.LDIFFile, config: c, load: loadLDIF})
+		case Passwd:
+			sources = append(sources, &fileSource{name: name, path: c.PasswdFile, config: c, load: loadPasswd})
+		case JSON:
+			sources = append(sources, &fileSource{name: name, path: c.JSONFile, config: c, load: loadJSON})
+		case CSV:
+			sources = append(sources, &fileSource{name: name, path: c.CSVFile, config: c, load: loadCSV})
+		case SCIM:
+			sources = append(sources, newSCIMSource(c))
+		default:
+			return nil, fmt.Errorf("unknown source %q", name)
+		}
+	}
+	switch len(sources) {
+	case 0:
+		return nil, fmt.Errorf("no sources configured")
+	case 1:
+		return sources[0], nil
+	}
+	return Combine(c.SourceCombine, sources...)
+}
+
+// Validate checks the settings of the configured sources.
+func Validate(c *config.Config) error {
+	files := map[string]string{LDIF: c.LDIFFile, Passwd: c.PasswdFile, JSON: c.JSONFile, CSV: c.CSVFile}
+	for _, name := range c.UserSources {
+		if !slices.Contains(Names, name) {
+			return fmt.Errorf("unknown source %q", name)
+		}
+		if name == LDAP && c.LdapURL == "" {
+			return fmt.Errorf("the LDAP URL is required by the ldap source")
+		}
+		if name == SCIM {
+			if c.SCIMURL == "" {
+				return fmt.Errorf("the SCIM URL is required by the scim source")
+			}
+			if (c.SCIMToken == "") == (c.SCIMTokenFile == "") {
+				return fmt.Errorf("either a SCIM token or token file is required by the scim source")
+			}
+			if c.SCIMPageSize < 1 || c.SCIMTimeout <= 0 {
+				return fmt.Errorf("the SCIM page size and timeout must be greater than 0")
+			}
+		}
+		if path, ok := files[name]; ok && path == "" {
+			return fmt.Errorf("a file is required by the %s source", name)
+		}
+	}
+	if len(c.UserSources) > 1 && !slices.Contains(CombineModes, c.SourceCombine) {
+		return fmt.Errorf("unknown combine mode %q", c.SourceCombine)
+	}
+	if !slices.Equal(c.UserSources, []string{LDAP}) && c.SubIDSource == subid.SourceLDAP {
+		return fmt.Errorf("reading subid ranges from LDAP requires only the ldap source")
+	}
+	return nil
+}
+
+// Signature identifies the settings that change which users the configured sources return,
+// users read with another signature may come from another directory or filter.
+func Signature(c *config.Config) string {
+	settings := []string{
+		strings.Join(c.UserSources, ","), c.SourceCombine,
+		c.UserBaseDN, c.UserFilter, c.UserScope, c.UserDerefAliases,
+		c.UserUIDAttr, c.UserKeyMode, strings.Join(c.UserKeyTransforms, "\x00"),
+		fmt.Sprintf("%d:%d:%d:%t:%s", c.SIDRangeMin, c.SIDRangeMax, c.SIDRangeSize, c.SIDAutoridCompat, c.SIDDefaultDomainSID),
+		c.AccountState, c.AccountStateGrace.String(), c.AccountStateFile,
+		fmt.Sprintf("%v", c.Searches),
+	}
+	for _, name := range c.UserSources {
+		switch name {
+		case LDAP:
+			settings = append(settings, c.LdapURL)
+		case LDIF:
+			settings = append(settings, c.LDIFFile)
+		case Passwd:
+			settings = append(settings, c.PasswdFile)
+		case JSON:
+			settings = append(settings, c.JSONFile)
+		case CSV:
+			settings = append(settings, c.CSVFile)
+		case SCIM:
+			settings = append(settings, c.SCIMURL, c.SCIMKeyAttr)
+		}
+	}
+	sum := sha256.Sum256([]byte(strings.Join(settings, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+type combined struct {
+	mode    string
+	sources []Source
+}
+
+// Combine returns a source with the union or intersection of the users of the sources.
+// Users keep the order they are first returned in.
+func Combine(mode string, sources ...Source) (Source, error) {
+	if !slices.Contains(CombineModes, mode) {
+		return nil, fmt.Errorf("unknown combine mode %q", mode)
+	}
+	return &combined{mode: mode, sources: sources}, nil
+}
+
+func (s *combined) Name() string {
+	return s.mode
+}
+
+func (s *combined) Users(ctx context.Context, logger *slog.Logger) (Result, error) {
+	result := Result{Users: []string{}}
+	counts := make(map[string]int)
+	order := []string{}
+	for _, source := range s.sources {
+		r, err := source.Users(ctx, logger)
+		if err != nil {
+			return Result{}, err
+		}
+		result.MaxID = max(result.MaxID, r.MaxID)
+		seen := make(map[string]bool, len(r.Users))
+		for _, user := range r.Users {
+			if seen[user] {
+				continue
+			}
+			seen[user] = true
+			if counts[user] == 0 {
+				order = append(order, user)
+			}
+			counts[user]++
+		}
+	}
+	for _, user := range order {
+		if s.mode == CombineUnion || counts[user] == len(s.sources) {
+			result.Users = append(result.Users, user)
+		}
+	}
+	logger.Debug("Combined sources", "mode", s.mode, "sources", len(s.sources), "users", len(result.Users))
+	return result, nil
+}
+
+func setUsers(name string, result Result) {
+	metrics.MetricSourceUsers.WithLabelValues(name).Set(float64(len(result.Users)))
+}
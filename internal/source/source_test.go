@@ -0,0 +1,210 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/promslog"
+	"github.com/treydock/subid-ldap/internal/config"
+	"github.com/treydock/subid-ldap/internal/metrics"
+	"github.com/treydock/subid-ldap/internal/subid"
+	"github.com/treydock/subid-ldap/internal/test"
+)
+
+type staticSource struct {
+	name   string
+	result Result
+	err    error
+}
+
+func (s *staticSource) Name() string {
+	return s.name
+}
+
+func (s *staticSource) Users(_ context.Context, logger *slog.Logger) (Result, error) {
+	return s.result, s.err
+}
+
+func getConfig(sources ...string) *config.Config {
+	return &config.Config{
+		UserSources:   sources,
+		SourceCombine: CombineUnion,
+		UserBaseDN:    test.UserBaseDN,
+		UserFilter:    test.UserFilter,
+		UserUIDAttr:   test.UserUIDAttr,
+		LDIFFile:      test.GetFixture("users.ldif"),
+		PasswdFile:    test.GetFixture("passwd"),
+		JSONFile:      test.GetFixture("users.json"),
+		CSVFile:       test.GetFixture("users.csv"),
+		OverlapCheck:  subid.OverlapOff,
+	}
+}
+
+func TestCombine(t *testing.T) {
+	a := &staticSource{name: "a", result: Result{Users: []string{"1", "2", "3", "2"}, MaxID: 10}}
+	b := &staticSource{name: "b", result: Result{Users: []string{"4", "3", "2"}, MaxID: 20}}
+	tests := map[string]string{
+		CombineUnion:        "1,2,3,4",
+		CombineIntersection: "2,3",
+	}
+	for mode, expected := range tests {
+		s, err := Combine(mode, a, b)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		result, err := s.Users(context.Background(), promslog.NewNopLogger())
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if got := strings.Join(result.Users, ","); got != expected {
+			t.Errorf("Unexpected %s users, got: %s expected: %s", mode, got, expected)
+		}
+		if result.MaxID != 20 {
+			t.Errorf("Unexpected max ID, got: %d", result.MaxID)
+		}
+	}
+	if _, err := Combine("invalid", a, b); err == nil {
+		t.Errorf("Expected error with invalid mode")
+	}
+	s, _ := Combine(CombineUnion, a, &staticSource{name: "err", err: fmt.Errorf("failed")})
+	if _, err := s.Users(context.Background(), promslog.NewNopLogger()); err == nil {
+		t.Errorf("Expected error from source")
+	}
+}
+
+func TestFileSources(t *testing.T) {
+	tests := map[string]string{
+		LDIF:   "1000,1001,1002,1003",
+		Passwd: "0,1000,1001,500,1004",
+		JSON:   "1000,1001,1002",
+		CSV:    "1000,1002,1003",
+	}
+	for name, expected := range tests {
+		metrics.MetricSourceUsers.Reset()
+		s, err := New(getConfig(name), nil)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if s.Name() != name {
+			t.Errorf("Unexpected name, got: %s", s.Name())
+		}
+		result, err := s.Users(context.Background(), promslog.NewNopLogger())
+		if err != nil {
+			t.Fatalf("Unexpected error from %s: %s", name, err)
+		}
+		if got := strings.Join(result.Users, ","); got != expected {
+			t.Errorf("Unexpected %s users, got: %s expected: %s", name, got, expected)
+		}
+		if val := testutil.ToFloat64(metrics.MetricSourceUsers.WithLabelValues(name)); int(val) != len(result.Users) {
+			t.Errorf("Unexpected %s source users metric, got: %v", name, val)
+		}
+	}
+}
+
+func TestFileSourceSettings(t *testing.T) {
+	c := getConfig(Passwd)
+	c.UserUIDAttr = "uid"
+	c.UserFilter = "(&(objectClass=posixAccount)(uidNumber>=1000)(!(loginShell=/sbin/nologin)))"
+	c.OverlapCheck = subid.OverlapWarn
+	s, err := New(c, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	result, err := s.Users(context.Background(), promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if got := strings.Join(result.Users, ","); got != "testuser1,testuser2,testuser5" {
+		t.Errorf("Unexpected users, got: %s", got)
+	}
+	if result.MaxID != 1004 {
+		t.Errorf("Unexpected max ID, got: %d", result.MaxID)
+	}
+	c.PasswdFile = "/dne"
+	s, _ = New(c, nil)
+	if _, err := s.Users(context.Background(), promslog.NewNopLogger()); err == nil {
+		t.Errorf("Expected error reading missing file")
+	}
+}
+
+func TestNewCombined(t *testing.T) {
+	c := getConfig(CSV, JSON)
+	c.SourceCombine = CombineIntersection
+	s, err := New(c, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if s.Name() != CombineIntersection {
+		t.Errorf("Unexpected name, got: %s", s.Name())
+	}
+	result, err := s.Users(context.Background(), promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if got := strings.Join(result.Users, ","); got != "1000,1002" {
+		t.Errorf("Unexpected users, got: %s", got)
+	}
+	if _, err := New(getConfig("invalid"), nil); err == nil {
+		t.Errorf("Expected error with unknown source")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Validate(getConfig(Passwd, CSV)); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	tests := []*config.Config{
+		getConfig("invalid"),
+		getConfig(LDAP),
+		func() *config.Config { c := getConfig(JSON); c.JSONFile = ""; return c }(),
+		func() *config.Config { c := getConfig(JSON, CSV); c.SourceCombine = "invalid"; return c }(),
+		func() *config.Config { c := getConfig(JSON); c.SubIDSource = subid.SourceLDAP; return c }(),
+	}
+	for i, c := range tests {
+		if err := Validate(c); err == nil {
+			t.Errorf("Expected error validating config %d", i)
+		}
+	}
+}
+
+func TestSignature(t *testing.T) {
+	c := &config.Config{UserSources: []string{LDAP}, LdapURL: "ldap://a", UserBaseDN: "dc=example", UserFilter: "(uid=*)"}
+	signature := Signature(c)
+	changes := []func(c *config.Config){
+		func(c *config.Config) { c.LdapURL = "ldap://b" },
+		func(c *config.Config) { c.UserBaseDN = "dc=other" },
+		func(c *config.Config) { c.UserFilter = "(uid=user1)" },
+		func(c *config.Config) { c.UserUIDAttr = "uid" },
+		func(c *config.Config) { c.UserKeyTransforms = []string{"lowercase"} },
+	}
+	for i, change := range changes {
+		other := *c
+		change(&other)
+		if Signature(&other) == signature {
+			t.Errorf("Expected change %d to change the signature", i)
+		}
+	}
+	other := *c
+	other.BindPassword = "secret"
+	other.PasswdFile = "/etc/passwd"
+	if Signature(&other) != signature {
+		t.Errorf("Expected settings that do not change the users to keep the signature")
+	}
+}
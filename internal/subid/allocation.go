@@ -0,0 +1,118 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subid
+
+import (
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	KindSubUID = "subuid"
+	KindSubGID = "subgid"
+)
+
+var Kinds = []string{KindSubUID, KindSubGID}
+
+// Allocation holds the ranges of the subid files last written so they can be queried
+// without reading the files.
+type Allocation struct {
+	mu      sync.RWMutex
+	ranges  map[string][]SubIDEntry
+	updated time.Time
+}
+
+// Load replaces the ranges with those in the subuid and subgid files.
+func (a *Allocation) Load(subuidPath string, subgidPath string, logger *slog.Logger) error {
+	ranges := make(map[string][]SubIDEntry, len(Kinds))
+	for kind, path := range map[string]string{KindSubUID: subuidPath, KindSubGID: subgidPath} {
+		entries, err := SubIDLoad(path, logger)
+		if err != nil {
+			logger.Error("Unable to load subid allocation", "path", path, "err", err)
+			return err
+		}
+		for _, e := range *entries {
+			ranges[kind] = append(ranges[kind], e)
+		}
+		slices.SortFunc(ranges[kind], func(a, b SubIDEntry) int { return a.ID - b.ID })
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.ranges = ranges
+	a.updated = time.Now()
+	return nil
+}
+
+// Loaded returns when the ranges were last loaded, zero if they never have been.
+func (a *Allocation) Loaded() time.Time {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.updated
+}
+
+// Ranges returns the ranges of kind sorted by ID.
+func (a *Allocation) Ranges(kind string) []SubIDEntry {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return slices.Clone(a.ranges[kind])
+}
+
+// OwnerRanges returns the ranges of kind assigned to owner.
+func (a *Allocation) OwnerRanges(kind string, owner string) []SubIDEntry {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	var ranges []SubIDEntry
+	for _, e := range a.ranges[kind] {
+		if e.UID == owner {
+			ranges = append(ranges, e)
+		}
+	}
+	return ranges
+}
+
+// Owners returns the ranges of kind that contain id.
+func (a *Allocation) Owners(kind string, id int) []SubIDEntry {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	var ranges []SubIDEntry
+	for _, e := range a.ranges[kind] {
+		if e.ID > id {
+			break
+		}
+		if id < e.ID+e.Count {
+			ranges = append(ranges, e)
+		}
+	}
+	return ranges
+}
+
+// HasRange reports if the ranges of kind assigned to owner cover count IDs from start.
+func (a *Allocation) HasRange(kind string, owner string, start int, count int) bool {
+	if count <= 0 {
+		return false
+	}
+	next := start
+	for _, e := range a.OwnerRanges(kind, owner) {
+		if e.ID > next {
+			break
+		}
+		next = max(next, e.ID+e.Count)
+		if next >= start+count {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subid
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/common/promslog"
+)
+
+func TestAllocation(t *testing.T) {
+	dir := t.TempDir()
+	subuid := filepath.Join(dir, "subuid")
+	subgid := filepath.Join(dir, "subgid")
+	if err := os.WriteFile(subuid, []byte("# Managed\n1001:165537:65536\n1000:100000:65536\n1000:300000:10\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(subgid, []byte("1000:100000:65536\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	a := &Allocation{}
+	if !a.Loaded().IsZero() {
+		t.Errorf("Expected allocation to not be loaded")
+	}
+	if err := a.Load(subuid, subgid, promslog.NewNopLogger()); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if a.Loaded().IsZero() {
+		t.Errorf("Expected allocation to be loaded")
+	}
+	ranges := a.Ranges(KindSubUID)
+	if len(ranges) != 3 || ranges[0].ID != 100000 || ranges[2].ID != 300000 {
+		t.Errorf("Unexpected subuid ranges: %+v", ranges)
+	}
+	if ranges := a.Ranges(KindSubGID); len(ranges) != 1 {
+		t.Errorf("Unexpected subgid ranges: %+v", ranges)
+	}
+	if ranges := a.OwnerRanges(KindSubUID, "1000"); len(ranges) != 2 {
+		t.Errorf("Unexpected owner ranges: %+v", ranges)
+	}
+	if ranges := a.OwnerRanges(KindSubGID, "1001"); len(ranges) != 0 {
+		t.Errorf("Unexpected owner ranges: %+v", ranges)
+	}
+	if owners := a.Owners(KindSubUID, 165537+65535); len(owners) != 1 || owners[0].UID != "1001" {
+		t.Errorf("Unexpected owners: %+v", owners)
+	}
+	if owners := a.Owners(KindSubUID, 165536); len(owners) != 0 {
+		t.Errorf("Unexpected owners: %+v", owners)
+	}
+	tests := []struct {
+		owner string
+		start int
+		count int
+		want  bool
+	}{
+		{"1000", 100000, 65536, true},
+		{"1000", 100010, 10, true},
+		{"1000", 100000, 65537, false},
+		{"1000", 99999, 2, false},
+		{"1001", 100000, 1, false},
+		{"1000", 300000, 0, false},
+	}
+	for _, test := range tests {
+		if got := a.HasRange(KindSubUID, test.owner, test.start, test.count); got != test.want {
+			t.Errorf("Unexpected HasRange for %+v, got %t", test, got)
+		}
+	}
+	if err := a.Load(filepath.Join(dir, "dne"), subgid, promslog.NewNopLogger()); err == nil {
+		t.Errorf("Expected error loading missing file")
+	}
+	if ranges := a.Ranges(KindSubUID); len(ranges) != 3 {
+		t.Errorf("Expected ranges kept after failed load, got: %+v", ranges)
+	}
+}
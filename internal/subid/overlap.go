@@ -0,0 +1,90 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subid
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/treydock/subid-ldap/internal/config"
+	"github.com/treydock/subid-ldap/internal/metrics"
+)
+
+const (
+	OverlapOff   = "off"
+	OverlapWarn  = "warn"
+	OverlapError = "error"
+	OverlapAuto  = "auto"
+)
+
+var OverlapModes = []string{OverlapOff, OverlapWarn, OverlapError, OverlapAuto}
+
+// SubIDManagedStart returns the start of the pool recorded in the header of a managed
+// subid file using the configured range.
+func SubIDManagedStart(path string, c *config.Config) (int, bool) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() {
+		return 0, false
+	}
+	prefix := fmt.Sprintf("# Managed by %s: ", config.AppName)
+	header, ok := strings.CutPrefix(scanner.Text(), prefix)
+	if !ok {
+		return 0, false
+	}
+	var start, idRange int
+	if _, err := fmt.Sscanf(header, "start=%d range=%d", &start, &idRange); err != nil || idRange != c.SubIDRange {
+		return 0, false
+	}
+	return start, true
+}
+
+// SubIDPoolStart checks the pool starting at start against highestID, the highest UID or GID
+// in the directory. In auto mode a pool that overlaps is moved above highestID plus the
+// headroom, aligned to the start alignment, otherwise start is returned unchanged.
+func SubIDPoolStart(start int, highestID int, c *config.Config, logger *slog.Logger) (int, error) {
+	metrics.MetricSubIDStart.Set(float64(start))
+	if c.OverlapCheck == "" || c.OverlapCheck == OverlapOff || start > highestID {
+		return start, nil
+	}
+	switch c.OverlapCheck {
+	case OverlapWarn:
+		logger.Warn("Subid pool overlaps UIDs or GIDs in LDAP", "start", start, "max_id", highestID)
+		return start, nil
+	case OverlapError:
+		err := fmt.Errorf("subid pool start %d overlaps UIDs or GIDs in LDAP up to %d", start, highestID)
+		logger.Error(err.Error())
+		return start, err
+	}
+	newStart := highestID + c.OverlapHeadroom + 1
+	if align := c.SubIDStartAlign; align > 1 {
+		newStart = ((newStart + align - 1) / align) * align
+	}
+	if float64(newStart)+float64(c.SubIDRange) > maxID {
+		err := fmt.Errorf("no subid pool fits above UIDs or GIDs in LDAP up to %d", highestID)
+		logger.Error(err.Error())
+		return start, err
+	}
+	logger.Warn("Moving subid pool above UIDs and GIDs in LDAP, existing subids are reassigned",
+		"start", start, "new_start", newStart, "max_id", highestID)
+	metrics.MetricSubIDStart.Set(float64(newStart))
+	return newStart, nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subid
+
+import (
+	"os"
+	"testing"
+
+	"github.com/prometheus/common/promslog"
+	"github.com/treydock/subid-ldap/internal/test"
+)
+
+func TestSubIDManagedStart(t *testing.T) {
+	fixture, err := test.CreateSubUIDFixture("subuid1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer os.Remove(fixture)
+	c := test.TestConfig()
+	start, ok := SubIDManagedStart(fixture, &c)
+	if !ok || start != 65537 {
+		t.Errorf("Unexpected start %d managed %t", start, ok)
+	}
+	c.SubIDRange = 100000
+	if _, ok := SubIDManagedStart(fixture, &c); ok {
+		t.Errorf("Expected file with different range to not be managed")
+	}
+	unmanaged, err := test.CreateSubUIDFixture("subuid1-unmanaged")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer os.Remove(unmanaged)
+	if _, ok := SubIDManagedStart(unmanaged, &c); ok {
+		t.Errorf("Expected unmanaged file")
+	}
+}
+
+func TestSubIDPoolStart(t *testing.T) {
+	logger := promslog.NewNopLogger()
+	c := test.TestConfig()
+	c.OverlapHeadroom = 100000
+	c.SubIDStartAlign = 65536
+	tests := []struct {
+		mode     string
+		start    int
+		maxID    int
+		expected int
+		err      bool
+	}{
+		{mode: OverlapOff, start: 65537, maxID: 2000000, expected: 65537},
+		{mode: OverlapWarn, start: 65537, maxID: 2000000, expected: 65537},
+		{mode: OverlapError, start: 65537, maxID: 60000, expected: 65537},
+		{mode: OverlapError, start: 65537, maxID: 2000000, expected: 65537, err: true},
+		{mode: OverlapAuto, start: 65537, maxID: 60000, expected: 65537},
+		{mode: OverlapAuto, start: 65537, maxID: 2000000, expected: 2162688},
+		{mode: OverlapAuto, start: 65537, maxID: 4294900000, expected: 65537, err: true},
+	}
+	for _, tt := range tests {
+		c.OverlapCheck = tt.mode
+		start, err := SubIDPoolStart(tt.start, tt.maxID, &c, logger)
+		if tt.err != (err != nil) {
+			t.Errorf("Unexpected error for mode %s max %d: %v", tt.mode, tt.maxID, err)
+		}
+		if start != tt.expected {
+			t.Errorf("Unexpected start for mode %s max %d, got: %d", tt.mode, tt.maxID, start)
+		}
+	}
+}
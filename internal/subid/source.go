@@ -0,0 +1,118 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subid
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/treydock/subid-ldap/internal/config"
+	"github.com/treydock/subid-ldap/internal/metrics"
+)
+
+const (
+	SourceAllocate = "allocate"
+	SourceLDAP     = "ldap"
+)
+
+var Sources = []string{SourceAllocate, SourceLDAP}
+
+// SubIDSourceHeader is the header of subid files rendered from ranges assigned in LDAP.
+func SubIDSourceHeader() string {
+	return fmt.Sprintf("# Managed by %s: source=%s", config.AppName, SourceLDAP)
+}
+
+// SubIDValidate sorts the ranges and checks they are within the ID space and do not
+// overlap, an invalid range fails validation so a bad assignment is never written.
+func SubIDValidate(entries []SubIDEntry) error {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ID < entries[j].ID
+	})
+	for i, e := range entries {
+		if e.UID == "" {
+			return fmt.Errorf("range %d:%d has no user", e.ID, e.Count)
+		}
+		if e.ID <= 0 || e.Count <= 0 || float64(e.ID)+float64(e.Count)-1 > maxID {
+			return fmt.Errorf("range %d:%d of %s is outside the ID space", e.ID, e.Count, e.UID)
+		}
+		if i > 0 {
+			prev := entries[i-1]
+			if prev.ID+prev.Count > e.ID {
+				return fmt.Errorf("range %d:%d of %s overlaps range %d:%d of %s",
+					e.ID, e.Count, e.UID, prev.ID, prev.Count, prev.UID)
+			}
+		}
+	}
+	return nil
+}
+
+// SubIDSaveRanges validates and writes the ranges to path.
+func SubIDSaveRanges(entries []SubIDEntry, path string, logger *slog.Logger) error {
+	if err := SubIDValidate(entries); err != nil {
+		logger.Error("Invalid subid ranges", "err", err)
+		return err
+	}
+	lines := []string{SubIDSourceHeader()}
+	current := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		line := fmt.Sprintf("%s:%d:%d", e.UID, e.ID, e.Count)
+		current[line] = true
+		lines = append(lines, line)
+	}
+	var added, removed float64
+	existing := make(map[string]bool)
+	if content, err := os.ReadFile(path); err == nil {
+		for _, line := range strings.Split(string(content), "\n") {
+			if line != "" && !strings.HasPrefix(line, "#") {
+				existing[line] = true
+			}
+		}
+	}
+	for line := range current {
+		if !existing[line] {
+			added++
+		}
+	}
+	for line := range existing {
+		if !current[line] {
+			removed++
+		}
+	}
+	metrics.MetricSubIDTotal.Set(float64(len(entries)))
+	metrics.MetricSubIDAdded.Set(added)
+	metrics.MetricSubIDRemoved.Set(removed)
+	logger.Debug("Write subid ranges", "path", path, "count", len(entries), "added", added, "removed", removed)
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")), subidMode)
+}
+
+// SubIDNextFree returns the first range of count IDs at or above start that does not
+// overlap the used ranges.
+func SubIDNextFree(start int, count int, used []SubIDEntry) (int, error) {
+	for moved := true; moved; {
+		moved = false
+		for _, e := range used {
+			if start < e.ID+e.Count && e.ID < start+count {
+				start = e.ID + e.Count
+				moved = true
+			}
+		}
+	}
+	if float64(start)+float64(count)-1 > maxID {
+		return 0, fmt.Errorf("no free subid range of %d above %d", count, start)
+	}
+	return start, nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subid
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/promslog"
+	"github.com/treydock/subid-ldap/internal/metrics"
+)
+
+func TestSubIDValidate(t *testing.T) {
+	valid := []SubIDEntry{
+		{UID: "1001", ID: 200000, Count: 65536},
+		{UID: "1000", ID: 100000, Count: 65536},
+		{UID: "1000", ID: 165536, Count: 10},
+	}
+	if err := SubIDValidate(valid); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if valid[0].UID != "1000" || valid[0].ID != 100000 {
+		t.Errorf("Expected ranges sorted by ID, got: %+v", valid)
+	}
+	tests := [][]SubIDEntry{
+		{{UID: "1000", ID: 100000, Count: 65536}, {UID: "1001", ID: 165535, Count: 65536}},
+		{{UID: "1000", ID: 0, Count: 65536}},
+		{{UID: "1000", ID: 100000, Count: 0}},
+		{{UID: "1000", ID: 4294967295, Count: 2}},
+		{{UID: "", ID: 100000, Count: 65536}},
+	}
+	for _, entries := range tests {
+		if err := SubIDValidate(entries); err == nil {
+			t.Errorf("Expected error validating %+v", entries)
+		}
+	}
+}
+
+func TestSubIDSaveRanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "subuid")
+	if err := os.WriteFile(path, []byte("# Managed by subid-ldap: source=ldap\n1000:100000:65536\n1002:300000:65536"), 0644); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	entries := []SubIDEntry{
+		{UID: "1001", ID: 200000, Count: 65536},
+		{UID: "1000", ID: 100000, Count: 65536},
+	}
+	if err := SubIDSaveRanges(entries, path, promslog.NewNopLogger()); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := "# Managed by subid-ldap: source=ldap\n1000:100000:65536\n1001:200000:65536"
+	if string(content) != expected {
+		t.Errorf("Unexpected content:\n%s", string(content))
+	}
+	if added := testutil.ToFloat64(metrics.MetricSubIDAdded); added != 1 {
+		t.Errorf("Unexpected added, got: %v", added)
+	}
+	if removed := testutil.ToFloat64(metrics.MetricSubIDRemoved); removed != 1 {
+		t.Errorf("Unexpected removed, got: %v", removed)
+	}
+	entries = append(entries, SubIDEntry{UID: "1002", ID: 200001, Count: 1})
+	if err := SubIDSaveRanges(entries, path, promslog.NewNopLogger()); err == nil {
+		t.Errorf("Expected error with overlapping ranges")
+	}
+	if content, _ := os.ReadFile(path); string(content) != expected {
+		t.Errorf("Expected file unchanged after validation failure")
+	}
+}
+
+func TestSubIDNextFree(t *testing.T) {
+	used := []SubIDEntry{
+		{UID: "1001", ID: 165536, Count: 65536},
+		{UID: "1000", ID: 100000, Count: 65536},
+	}
+	if start, err := SubIDNextFree(100000, 65536, used); err != nil || start != 231072 {
+		t.Errorf("Unexpected start, got: %d %v", start, err)
+	}
+	if start, err := SubIDNextFree(300000, 65536, used); err != nil || start != 300000 {
+		t.Errorf("Unexpected start, got: %d %v", start, err)
+	}
+	if _, err := SubIDNextFree(4294967295-10, 65536, used); err == nil {
+		t.Errorf("Expected error when the ID space is exhausted")
+	}
+}
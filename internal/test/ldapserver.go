@@ -15,10 +15,12 @@ package test
 
 import (
 	"crypto/tls"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
 	"strings"
+	"sync/atomic"
 
 	"github.com/lor00x/goldap/message"
 	"github.com/treydock/subid-ldap/internal/utils"
@@ -27,12 +29,33 @@ import (
 
 const (
 	BindDN           = "cn=test,dc=test"
+	InvalidPassword  = "invalid"
 	UserBaseDN       = "ou=People,dc=test"
 	UserFilter       = "(objectClass=posixAccount)"
 	UserFilterStatus = "(&(objectClass=posixAccount)(status=ACTIVE))"
 	UserUIDAttr      = "uidNumber"
+	BulkBaseDN       = "ou=Bulk,dc=test"
+	SubIDBaseDN      = "cn=subids,cn=accounts,dc=test"
+	// Number of bulk users with subid ranges
+	BulkSubIDs = 5
 )
 
+const (
+	// Bulk users with this index modulo 100 are disabled or expired
+	BulkDisabled = 1
+	BulkExpired  = 2
+)
+
+// BulkUsers is the number of entries returned by searches of BulkBaseDN
+var BulkUsers = 1000
+
+// DNSHostName is the dnsHostName of the RootDSE, tests change it to act as another server
+var DNSHostName atomic.Value
+
+func init() {
+	DNSHostName.Store("ldap.test")
+}
+
 // GENCERTS: openssl req -newkey rsa:2048 -x509 -sha256 -days 3650 -nodes -out test.out -keyout test.key -subj "/C=US/ST=Ohio/L=Columbus/O=OSC/OU=OSC/CN=127.0.0.1"
 
 // LocalhostCert is a PEM-encoded TLS cert with SAN DNS names
@@ -110,6 +133,24 @@ func LdapServer() *ldap.Server {
 		Filter(UserFilterStatus).
 		Label("SEARCH - USER")
 	//routes.Search(handleSearch).Label("SEARCH - NO MATCH")
+	routes.Search(handleSearchBulk).
+		BaseDn(BulkBaseDN).
+		Label("SEARCH - BULK")
+	routes.Search(handleSearchSubIDs).
+		BaseDn(SubIDBaseDN).
+		Label("SEARCH - SUBIDS")
+	routes.Search(handleSearchStore).
+		BaseDn(WritebackBaseDN).
+		Label("SEARCH - WRITEBACK")
+	routes.Search(handleSearchStore).
+		BaseDn(LedgerDN).
+		Label("SEARCH - LEDGER")
+	routes.Modify(handleModify).Label("MODIFY")
+	routes.NotFound(handleNotFoundStore)
+	routes.Search(handleSearchRootDSE).
+		BaseDn("").
+		Scope(ldap.SearchRequestScopeBaseObject).
+		Label("SEARCH - ROOTDSE")
 	routes.Extended(handleStartTLS).RequestName(ldap.NoticeOfStartTLS).Label("StartTLS")
 	server.Handle(routes)
 	return server
@@ -119,7 +160,7 @@ func handleBind(w ldap.ResponseWriter, m *ldap.Message) {
 	r := m.GetBindRequest()
 	res := ldap.NewBindResponse(ldap.LDAPResultSuccess)
 	if r.AuthenticationChoice() == "simple" {
-		if string(r.Name()) != BindDN {
+		if string(r.Name()) != BindDN || string(r.AuthenticationSimple()) == InvalidPassword {
 			res.SetResultCode(ldap.LDAPResultInvalidCredentials)
 			res.SetDiagnosticMessage("invalid credentials")
 		}
@@ -127,6 +168,19 @@ func handleBind(w ldap.ResponseWriter, m *ldap.Message) {
 	w.Write(res)
 }
 
+// handleNotFoundStore answers searches of single entries in the writeback store, routes only match a base DN exactly.
+func handleNotFoundStore(w ldap.ResponseWriter, m *ldap.Message) {
+	if r, ok := m.ProtocolOp().(message.SearchRequest); ok {
+		if strings.HasSuffix(strings.ToLower(string(r.BaseObject())), ","+strings.ToLower(WritebackBaseDN)) {
+			handleSearchStore(w, m)
+			return
+		}
+	}
+	res := ldap.NewResponse(ldap.LDAPResultUnwillingToPerform)
+	res.SetDiagnosticMessage("Operation not implemented by server")
+	w.Write(res)
+}
+
 /*func handleNotFound(w ldap.ResponseWriter, r *ldap.Message) {
 	switch r.ProtocolOpType() {
 	case ldap.ApplicationBindRequest:
@@ -189,6 +243,107 @@ func handleSearchUser(w ldap.ResponseWriter, m *ldap.Message) {
 	w.Write(res)
 }
 
+// BulkSID returns the binary objectSid S-1-5-21-1-2-3-<rid> of bulk users
+func BulkSID(rid int) []byte {
+	sid := []byte{1, 5, 0, 0, 0, 0, 0, 5}
+	for _, sub := range []uint32{21, 1, 2, 3, uint32(rid)} {
+		sid = binary.LittleEndian.AppendUint32(sid, sub)
+	}
+	return sid
+}
+
+// BulkSubIDStart returns the start of the subid range assigned to a bulk user
+func BulkSubIDStart(i int) int {
+	return 2147483648 + i*65536
+}
+
+func handleSearchSubIDs(w ldap.ResponseWriter, m *ldap.Message) {
+	for i := 0; i < BulkSubIDs; i++ {
+		e := ldap.NewSearchResultEntry(fmt.Sprintf("ipaUniqueID=%d,%s", i, SubIDBaseDN))
+		e.AddAttribute("objectClass", "ipaSubordinateIdEntry")
+		// Owner DN case differs from the user DN like DNs stored by FreeIPA can
+		e.AddAttribute("ipaOwner", message.AttributeValue(fmt.Sprintf("UID=bulkuser%d,OU=Bulk,DC=test", i)))
+		e.AddAttribute("ipaSubUidNumber", message.AttributeValue(fmt.Sprintf("%d", BulkSubIDStart(i))))
+		e.AddAttribute("ipaSubUidCount", "65536")
+		e.AddAttribute("ipaSubGidNumber", message.AttributeValue(fmt.Sprintf("%d", BulkSubIDStart(i)+1000000000)))
+		e.AddAttribute("ipaSubGidCount", "65536")
+		w.Write(e)
+	}
+	// An entry owned by a user not returned by the user search
+	e := ldap.NewSearchResultEntry(fmt.Sprintf("ipaUniqueID=other,%s", SubIDBaseDN))
+	e.AddAttribute("ipaOwner", "uid=other,ou=People,dc=test")
+	e.AddAttribute("ipaSubUidNumber", "2147483648")
+	e.AddAttribute("ipaSubUidCount", "65536")
+	w.Write(e)
+	res := ldap.NewSearchResultDoneResponse(ldap.LDAPResultSuccess)
+	w.Write(res)
+}
+
+func handleSearchBulk(w ldap.ResponseWriter, m *ldap.Message) {
+	r := m.GetSearchRequest()
+	attributes := []string{}
+	for _, attr := range r.Attributes() {
+		if string(attr) == "*" {
+			attributes = []string{}
+			break
+		}
+		attributes = append(attributes, strings.ToLower(string(attr)))
+	}
+	for i := 0; i < BulkUsers; i++ {
+		select {
+		case <-m.Done:
+			return
+		default:
+		}
+		name := fmt.Sprintf("bulkuser%d", i)
+		attrs := map[string]string{
+			"objectClass":   "posixAccount",
+			"uid":           name,
+			"uidNumber":     fmt.Sprintf("%d", 10000+i),
+			"gidNumber":     fmt.Sprintf("%d", 10000+i),
+			"homeDirectory": fmt.Sprintf("/home/%s", name),
+			"loginShell":    "/bin/bash",
+			"gecos":         fmt.Sprintf("Bulk User %d", i),
+			"objectSid":     string(BulkSID(1000 + i)),
+		}
+		if i < BulkSubIDs {
+			attrs["ipaSubUidNumber"] = fmt.Sprintf("%d", BulkSubIDStart(i))
+			attrs["ipaSubUidCount"] = "65536"
+			attrs["ipaSubGidNumber"] = fmt.Sprintf("%d", BulkSubIDStart(i))
+			attrs["ipaSubGidCount"] = "65536"
+		}
+		// Some of the users are disabled or expired for account state tests
+		switch i % 100 {
+		case BulkDisabled:
+			attrs["nsAccountLock"] = "TRUE"
+			attrs["modifyTimestamp"] = "20200101000000Z"
+		case BulkExpired:
+			attrs["shadowExpire"] = "1"
+		}
+		e := ldap.NewSearchResultEntry(fmt.Sprintf("uid=%s,%s", name, BulkBaseDN))
+		for key, value := range attrs {
+			if len(attributes) > 0 && !utils.SliceContains(attributes, strings.ToLower(key)) {
+				continue
+			}
+			e.AddAttribute(message.AttributeDescription(key), message.AttributeValue(value))
+		}
+		w.Write(e)
+	}
+	res := ldap.NewSearchResultDoneResponse(ldap.LDAPResultSuccess)
+	w.Write(res)
+}
+
+func handleSearchRootDSE(w ldap.ResponseWriter, m *ldap.Message) {
+	e := ldap.NewSearchResultEntry("")
+	e.AddAttribute("objectClass", "top", "OpenLDAProotDSE")
+	e.AddAttribute("supportedLDAPVersion", "3")
+	e.AddAttribute("dnsHostName", message.AttributeValue(DNSHostName.Load().(string)))
+	e.AddAttribute("supportedControl", "1.2.840.113556.1.4.319", ControlTypeAssertion)
+	w.Write(e)
+	res := ldap.NewSearchResultDoneResponse(ldap.LDAPResultSuccess)
+	w.Write(res)
+}
+
 /*func handleSearch(w ldap.ResponseWriter, m *ldap.Message) {
 	res := ldap.NewSearchResultDoneResponse(ldap.LDAPResultNoSuchObject)
 	w.Write(res)
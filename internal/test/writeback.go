@@ -0,0 +1,317 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	goldap "github.com/go-ldap/ldap/v3"
+	"github.com/lor00x/goldap/message"
+	ldap "github.com/vjeantet/ldapserver"
+)
+
+const (
+	WritebackBaseDN = "ou=Writeback,dc=test"
+	LedgerDN        = "cn=subid-ledger,dc=test"
+	LedgerAttr      = "description"
+	// Number of writeback users, the first already has a range starting at LedgerStart
+	WritebackUsers = 3
+	LedgerStart    = 2147483648
+	// RFC 4528 assertion control, modifies are rejected when the entry does not match its filter
+	ControlTypeAssertion = "1.3.6.1.1.12"
+)
+
+// singleValued attributes reject adding a value when one exists like a directory schema would
+var singleValued = []string{"ipasubuidnumber", "ipasubuidcount", "ipasubgidnumber", "ipasubgidcount"}
+
+var (
+	storeLock sync.Mutex
+	store     map[string]map[string][]string
+	// usn is the last uSNChanged assigned, incremented by every change like Active Directory
+	usn int
+)
+
+func init() {
+	ResetWriteback()
+}
+
+// ResetWriteback restores the writeback users and ledger to their initial state.
+func ResetWriteback() {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	store = map[string]map[string][]string{
+		strings.ToLower(LedgerDN): {
+			"objectClass": {"organizationalRole"},
+			"cn":          {"subid-ledger"},
+			LedgerAttr:    {fmt.Sprintf("%d", LedgerStart)},
+		},
+	}
+	usn = 0
+	for i := 0; i < WritebackUsers; i++ {
+		name := fmt.Sprintf("writebackuser%d", i)
+		usn++
+		attrs := map[string][]string{
+			"objectClass":     {"posixAccount"},
+			"uid":             {name},
+			"uidNumber":       {fmt.Sprintf("%d", 20000+i)},
+			"modifyTimestamp": {"20200101000000Z"},
+			"uSNChanged":      {strconv.Itoa(usn)},
+		}
+		if i == 0 {
+			attrs["ipaSubUidNumber"] = []string{fmt.Sprintf("%d", LedgerStart)}
+			attrs["ipaSubUidCount"] = []string{"65536"}
+		}
+		store[strings.ToLower(fmt.Sprintf("uid=%s,%s", name, WritebackBaseDN))] = attrs
+	}
+}
+
+// WritebackEntry returns a copy of the attributes of an entry in the writeback store.
+func WritebackEntry(dn string) map[string][]string {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	attrs := make(map[string][]string)
+	for key, values := range store[strings.ToLower(dn)] {
+		attrs[key] = slices.Clone(values)
+	}
+	return attrs
+}
+
+// AddWriteback adds or replaces an entry in the writeback store, setting its modifyTimestamp and uSNChanged.
+func AddWriteback(dn string, attrs map[string][]string) {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	entry := make(map[string][]string)
+	for key, values := range attrs {
+		entry[key] = slices.Clone(values)
+	}
+	store[strings.ToLower(dn)] = entry
+	touch(entry)
+}
+
+// DeleteWriteback removes an entry from the writeback store.
+func DeleteWriteback(dn string) {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	delete(store, strings.ToLower(dn))
+}
+
+// touch updates the operational attributes of a changed entry, storeLock must be held.
+func touch(attrs map[string][]string) {
+	usn++
+	attrs["modifyTimestamp"] = []string{time.Now().UTC().Format("20060102150405Z")}
+	attrs["uSNChanged"] = []string{strconv.Itoa(usn)}
+}
+
+func handleSearchStore(w ldap.ResponseWriter, m *ldap.Message) {
+	r := m.GetSearchRequest()
+	baseDN := strings.ToLower(string(r.BaseObject()))
+	attributes := []string{}
+	for _, attr := range r.Attributes() {
+		attributes = append(attributes, strings.ToLower(string(attr)))
+	}
+	storeLock.Lock()
+	dns := []string{}
+	for dn := range store {
+		if dn == baseDN || (r.Scope() != ldap.SearchRequestScopeBaseObject && strings.HasSuffix(dn, ","+baseDN)) {
+			if !matchFilter(r.Filter(), store[dn]) {
+				continue
+			}
+			dns = append(dns, dn)
+		}
+	}
+	slices.Sort(dns)
+	entries := []message.SearchResultEntry{}
+	for _, dn := range dns {
+		e := ldap.NewSearchResultEntry(dn)
+		for key, values := range store[dn] {
+			if len(attributes) > 0 && !slices.Contains(attributes, "*") && !slices.Contains(attributes, strings.ToLower(key)) {
+				continue
+			}
+			vals := []message.AttributeValue{}
+			for _, value := range values {
+				vals = append(vals, message.AttributeValue(value))
+			}
+			e.AddAttribute(message.AttributeDescription(key), vals...)
+		}
+		entries = append(entries, e)
+	}
+	storeLock.Unlock()
+	for _, e := range entries {
+		w.Write(e)
+	}
+	w.Write(ldap.NewSearchResultDoneResponse(ldap.LDAPResultSuccess))
+}
+
+// handleModify applies all changes of a modify or none of them like a directory server.
+func handleModify(w ldap.ResponseWriter, m *ldap.Message) {
+	r := m.GetModifyRequest()
+	dn := strings.ToLower(string(r.Object()))
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	entry, ok := store[dn]
+	if !ok {
+		w.Write(ldap.NewModifyResponse(ldap.LDAPResultNoSuchObject))
+		return
+	}
+	if !matchAssertion(m, entry) {
+		w.Write(ldap.NewModifyResponse(goldap.LDAPResultAssertionFailed))
+		return
+	}
+	attrs := make(map[string][]string)
+	for key, values := range entry {
+		attrs[key] = slices.Clone(values)
+	}
+	for _, change := range r.Changes() {
+		key := string(change.Modification().Type_())
+		for existing := range attrs {
+			if strings.EqualFold(existing, key) {
+				key = existing
+			}
+		}
+		values := []string{}
+		for _, value := range change.Modification().Vals() {
+			values = append(values, string(value))
+		}
+		switch change.Operation() {
+		case message.ModifyRequestChangeOperationAdd:
+			for _, value := range values {
+				if slices.Contains(attrs[key], value) {
+					w.Write(ldap.NewModifyResponse(ldap.LDAPResultAttributeOrValueExists))
+					return
+				}
+			}
+			if slices.Contains(singleValued, strings.ToLower(key)) && len(attrs[key])+len(values) > 1 {
+				w.Write(ldap.NewModifyResponse(ldap.LDAPResultConstraintViolation))
+				return
+			}
+			attrs[key] = append(attrs[key], values...)
+		case message.ModifyRequestChangeOperationDelete:
+			if len(attrs[key]) == 0 {
+				w.Write(ldap.NewModifyResponse(ldap.LDAPResultNoSuchAttribute))
+				return
+			}
+			for _, value := range values {
+				if !slices.Contains(attrs[key], value) {
+					w.Write(ldap.NewModifyResponse(ldap.LDAPResultNoSuchAttribute))
+					return
+				}
+				attrs[key] = slices.DeleteFunc(attrs[key], func(v string) bool { return v == value })
+			}
+			if len(values) == 0 || len(attrs[key]) == 0 {
+				delete(attrs, key)
+			}
+		case message.ModifyRequestChangeOperationReplace:
+			attrs[key] = values
+		}
+	}
+	touch(attrs)
+	store[dn] = attrs
+	w.Write(ldap.NewModifyResponse(ldap.LDAPResultSuccess))
+}
+
+// matchAssertion evaluates the RFC 4528 assertion control of a request against the entry.
+// Only presence filters, optionally negated, are evaluated and other filters always match.
+func matchAssertion(m *ldap.Message, attrs map[string][]string) bool {
+	if m.Controls() == nil {
+		return true
+	}
+	for _, control := range *m.Controls() {
+		if string(control.ControlType()) != ControlTypeAssertion || control.ControlValue() == nil {
+			continue
+		}
+		packet, err := ber.DecodePacketErr([]byte(*control.ControlValue()))
+		if err != nil {
+			return false
+		}
+		filter, err := goldap.DecompileFilter(packet)
+		if err != nil {
+			return false
+		}
+		negate := strings.HasPrefix(filter, "(!(")
+		filter = strings.TrimSuffix(strings.TrimPrefix(filter, "(!"), ")")
+		attr, ok := strings.CutSuffix(strings.Trim(filter, "()"), "=*")
+		if !ok {
+			continue
+		}
+		present := slices.ContainsFunc(slices.Collect(maps.Keys(attrs)), func(key string) bool {
+			return strings.EqualFold(key, attr) && len(attrs[key]) > 0
+		})
+		if present == negate {
+			return false
+		}
+	}
+	return true
+}
+
+// matchFilter evaluates the filters used against the store, integer values are compared
+// numerically and other values as strings. Other filters always match.
+func matchFilter(filter message.Filter, attrs map[string][]string) bool {
+	values := func(attr message.AttributeDescription) []string {
+		for key, values := range attrs {
+			if strings.EqualFold(key, string(attr)) {
+				return values
+			}
+		}
+		return nil
+	}
+	switch f := filter.(type) {
+	case message.FilterAnd:
+		for _, child := range f {
+			if !matchFilter(child, attrs) {
+				return false
+			}
+		}
+		return true
+	case message.FilterOr:
+		for _, child := range f {
+			if matchFilter(child, attrs) {
+				return true
+			}
+		}
+		return false
+	case message.FilterNot:
+		return !matchFilter(f.Filter, attrs)
+	case message.FilterPresent:
+		return len(values(message.AttributeDescription(f))) > 0
+	case message.FilterEqualityMatch:
+		return slices.ContainsFunc(values(f.AttributeDesc()), func(v string) bool {
+			return strings.EqualFold(v, string(f.AssertionValue()))
+		})
+	case message.FilterGreaterOrEqual:
+		return slices.ContainsFunc(values(f.AttributeDesc()), func(v string) bool {
+			return compareValues(v, string(f.AssertionValue())) >= 0
+		})
+	case message.FilterLessOrEqual:
+		return slices.ContainsFunc(values(f.AttributeDesc()), func(v string) bool {
+			return compareValues(v, string(f.AssertionValue())) <= 0
+		})
+	}
+	return true
+}
+
+func compareValues(a string, b string) int {
+	x, errA := strconv.Atoi(a)
+	y, errB := strconv.Atoi(b)
+	if errA == nil && errB == nil {
+		return x - y
+	}
+	return strings.Compare(a, b)
+}
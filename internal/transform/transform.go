@@ -0,0 +1,186 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+const (
+	StepLowercase  = "lowercase"
+	StepStripRealm = "strip-realm"
+	StepRegex      = "regex"
+	StepTemplate   = "template"
+
+	// ValueKey is the template field holding the value from the previous steps
+	ValueKey = "value"
+)
+
+type step func(value string, attrs map[string]string) (string, error)
+
+// Pipeline transforms a value through a list of steps.
+type Pipeline struct {
+	steps      []step
+	attributes []string
+}
+
+// Compile parses the steps of a pipeline, each one of:
+//
+//	lowercase                      lowercase the value
+//	strip-realm                    remove a @REALM suffix
+//	regex:/pattern/replacement/    replace matches of pattern, any delimiter can be used
+//	template:{{.givenName}}.{{.sn}} execute a template with the entry attributes and value
+func Compile(specs []string) (*Pipeline, error) {
+	p := &Pipeline{}
+	attributes := make(map[string]bool)
+	for _, spec := range specs {
+		name, arg, _ := strings.Cut(spec, ":")
+		switch name {
+		case StepLowercase:
+			p.steps = append(p.steps, func(value string, _ map[string]string) (string, error) {
+				return strings.ToLower(value), nil
+			})
+		case StepStripRealm:
+			p.steps = append(p.steps, func(value string, _ map[string]string) (string, error) {
+				user, _, _ := strings.Cut(value, "@")
+				return user, nil
+			})
+		case StepRegex:
+			s, err := regexStep(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid transform %q: %w", spec, err)
+			}
+			p.steps = append(p.steps, s)
+		case StepTemplate:
+			t, err := template.New(spec).Option("missingkey=error").Parse(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid transform %q: %w", spec, err)
+			}
+			templateFields(t.Tree.Root, attributes)
+			p.steps = append(p.steps, func(value string, attrs map[string]string) (string, error) {
+				data := make(map[string]string, len(attrs)+1)
+				for key, v := range attrs {
+					data[key] = v
+				}
+				data[ValueKey] = value
+				var buf bytes.Buffer
+				if err := t.Execute(&buf, data); err != nil {
+					return "", err
+				}
+				return buf.String(), nil
+			})
+		default:
+			return nil, fmt.Errorf("unknown transform %q", spec)
+		}
+	}
+	delete(attributes, ValueKey)
+	for attr := range attributes {
+		p.attributes = append(p.attributes, attr)
+	}
+	sort.Strings(p.attributes)
+	return p, nil
+}
+
+func regexStep(arg string) (step, error) {
+	if len(arg) < 2 {
+		return nil, fmt.Errorf("expected /pattern/replacement/")
+	}
+	delimiter := arg[:1]
+	parts := strings.Split(arg[1:], delimiter)
+	if len(parts) != 3 || parts[2] != "" {
+		return nil, fmt.Errorf("expected %spattern%sreplacement%s", delimiter, delimiter, delimiter)
+	}
+	re, err := regexp.Compile(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	replacement := parts[1]
+	return func(value string, _ map[string]string) (string, error) {
+		return re.ReplaceAllString(value, replacement), nil
+	}, nil
+}
+
+// templateFields collects the top level fields used by the template which are the
+// attributes that need to be requested.
+func templateFields(node parse.Node, fields map[string]bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			templateFields(child, fields)
+		}
+	case *parse.ActionNode:
+		templateFields(n.Pipe, fields)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			templateFields(cmd, fields)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			templateFields(arg, fields)
+		}
+	case *parse.FieldNode:
+		fields[n.Ident[0]] = true
+	case *parse.IfNode:
+		templateFields(n.Pipe, fields)
+		templateFields(n.List, fields)
+		templateFields(n.ElseList, fields)
+	case *parse.WithNode:
+		templateFields(n.Pipe, fields)
+		templateFields(n.List, fields)
+		templateFields(n.ElseList, fields)
+	}
+}
+
+// Attributes returns the entry attributes used by templates.
+func (p *Pipeline) Attributes() []string {
+	return p.attributes
+}
+
+// Empty returns true when the pipeline has no steps.
+func (p *Pipeline) Empty() bool {
+	return len(p.steps) == 0
+}
+
+// Apply transforms value using lookup to get the value of attributes used by templates.
+func (p *Pipeline) Apply(value string, lookup func(attr string) string) (string, error) {
+	var attrs map[string]string
+	if len(p.attributes) > 0 {
+		attrs = make(map[string]string, len(p.attributes))
+		for _, attr := range p.attributes {
+			if v := lookup(attr); v != "" {
+				attrs[attr] = v
+			}
+		}
+	}
+	var err error
+	for _, s := range p.steps {
+		value, err = s(value, attrs)
+		if err != nil {
+			return "", err
+		}
+	}
+	return value, nil
+}
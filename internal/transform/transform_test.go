@@ -0,0 +1,87 @@
+// Copyright 2021 Trey Dockendorf
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPipeline(t *testing.T) {
+	attrs := map[string]string{
+		"givenName":      "John",
+		"sn":             "Doe",
+		"sAMAccountName": "JDoe",
+	}
+	lookup := func(attr string) string { return attrs[attr] }
+	tests := []struct {
+		name     string
+		specs    []string
+		value    string
+		expected string
+	}{
+		{name: "none", value: "JDoe", expected: "JDoe"},
+		{name: "lowercase", specs: []string{"lowercase"}, value: "JDoe", expected: "jdoe"},
+		{name: "upn", specs: []string{"strip-realm", "lowercase"}, value: "JDoe@AD.EXAMPLE.COM", expected: "jdoe"},
+		{name: "regex", specs: []string{"regex:/^(.*)_adm$/${1}/"}, value: "jdoe_adm", expected: "jdoe"},
+		{name: "regex-delimiter", specs: []string{"regex:|^AD\\\\||"}, value: "AD\\jdoe", expected: "jdoe"},
+		{name: "template", specs: []string{"template:{{.givenName}}.{{.sn}}", "lowercase"}, value: "ignored", expected: "john.doe"},
+		{name: "template-value", specs: []string{"lowercase", "template:{{.value}}-{{.sAMAccountName}}"}, value: "X", expected: "x-JDoe"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := Compile(tt.specs)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			value, err := p.Apply(tt.value, lookup)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if value != tt.expected {
+				t.Errorf("Unexpected value, got: %q", value)
+			}
+		})
+	}
+}
+
+func TestPipelineAttributes(t *testing.T) {
+	p, err := Compile([]string{"template:{{if .mail}}{{.mail}}{{else}}{{.uid}}{{end}}-{{.value}}", "template:{{.sn | printf \"%s\"}}"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if attrs := p.Attributes(); !reflect.DeepEqual(attrs, []string{"mail", "sn", "uid"}) {
+		t.Errorf("Unexpected attributes, got: %v", attrs)
+	}
+}
+
+func TestPipelineErrors(t *testing.T) {
+	for _, specs := range [][]string{
+		{"uppercase"},
+		{"regex:/foo/"},
+		{"regex:/(/x/"},
+		{"template:{{.foo"},
+	} {
+		if _, err := Compile(specs); err == nil {
+			t.Errorf("Expected error compiling %v", specs)
+		}
+	}
+	p, err := Compile([]string{"template:{{.missing}}"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := p.Apply("value", func(string) string { return "" }); err == nil {
+		t.Errorf("Expected error with missing attribute")
+	}
+}
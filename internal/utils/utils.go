@@ -16,8 +16,10 @@ package utils
 import (
 	"errors"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 )
 
 func SliceContains(slice []string, str string) bool {
@@ -29,6 +31,19 @@ func SliceContains(slice []string, str string) bool {
 	return false
 }
 
+// SplitList splits a comma separated list, dropping empty items.
+func SplitList(input string) []string {
+	items := []string{}
+	for _, item := range strings.Split(input, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
 func SortSliceStringInts(input *[]string) {
 	sort.Slice(*input, func(i, j int) bool {
 		numA, _ := strconv.Atoi((*input)[i])
@@ -47,3 +62,25 @@ func Exists(name string) (bool, error) {
 	}
 	return false, err
 }
+
+// WriteFileAtomic replaces path with data so readers and crashes never see a partial file.
+func WriteFileAtomic(path string, data []byte, mode os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), mode)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	return err
+}
@@ -14,6 +14,8 @@
 package utils
 
 import (
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 )
@@ -29,6 +31,17 @@ func TestSliceContains(t *testing.T) {
 	}
 }
 
+func TestSplitList(t *testing.T) {
+	value := SplitList(" foo,bar ,,baz")
+	if !reflect.DeepEqual(value, []string{"foo", "bar", "baz"}) {
+		t.Errorf("Unexpected result, got: %+v", value)
+	}
+	value = SplitList("")
+	if len(value) != 0 {
+		t.Errorf("Unexpected result, got: %+v", value)
+	}
+}
+
 func TestSortSliceStringInts(t *testing.T) {
 	input := []string{"3", "1", "2"}
 	SortSliceStringInts(&input)
@@ -36,3 +49,31 @@ func TestSortSliceStringInts(t *testing.T) {
 		t.Errorf("Unexpected result, got: %+v", input)
 	}
 }
+
+func TestWriteFileAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := WriteFileAtomic(path, []byte("old"), 0600); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := WriteFileAtomic(path, []byte("new"), 0640); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if string(content) != "new" {
+		t.Errorf("Unexpected content, got: %s", content)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("Unexpected mode, got: %s", info.Mode())
+	}
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("Expected temporary file to be removed, got %d files", len(entries))
+	}
+}